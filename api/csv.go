@@ -0,0 +1,64 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"tsdb/ingest"
+)
+
+// csvImportHandler - POST /import/csv?timestamp=time&values=cpu,mem&tags=host&metric=...
+// Тело читается потоком и пишется пачками, ошибки отдельных строк возвращаются в отчете
+func (s *Server) csvImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	delimiter, err := ingest.ParseCSVDelimiter(query.Get("delimiter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mapping := ingest.CSVMapping{
+		TimestampColumn:    query.Get("timestamp"),
+		TimestampFormat:    query.Get("timestamp_format"),
+		TimestampPrecision: query.Get("precision"),
+		MetricColumn:       query.Get("metric_column"),
+		Metric:             query.Get("metric"),
+		TagColumns:         ingest.ParseCSVColumns(query.Get("tags")),
+		ValueColumns:       ingest.ParseCSVColumns(query.Get("values")),
+		Delimiter:          delimiter,
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	result, err := ingest.ImportCSV(body, mapping, s.tsdb, ingest.DefaultBatchSize)
+	if err != nil {
+		if result == nil {
+			http.Error(w, "Invalid CSV import: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// отчет нужен и здесь: по committed_rows клиент продолжит импорт с места сбоя
+		result.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"tsdb/promql"
+	"tsdb/types"
+)
+
+// exprQueryHandler - /query/expr?expr=errors / on(host) requests&step=1m&start=...&end=...:
+// арифметика (+ - * / % ^), сравнения и числа между селекторами в синтаксисе PromQL.
+// Каждый селектор сворачивается на сетку step с window_agg/fn/fill как в /query
+func (s *Server) exprQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	exprStr := r.URL.Query().Get("expr")
+	if exprStr == "" {
+		http.Error(w, "Missing required parameter: expr", http.StatusBadRequest)
+		return
+	}
+	expr, err := promql.ParseExpr(exprStr)
+	if err != nil {
+		http.Error(w, "Invalid expr: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var query types.Query
+	if err := parseQueryOptions(r.URL.Query(), &query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	matrix, err := s.promql.StepQuery(ctx, expr, query)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	result := types.QueryResult{Series: make([]types.SeriesData, len(matrix))}
+	for i, series := range matrix {
+		tags := make(map[string]string, len(series.Labels))
+		for name, value := range series.Labels {
+			if name != types.MetricNameLabel {
+				tags[name] = value
+			}
+		}
+		result.Series[i] = types.SeriesData{
+			SeriesID: types.SeriesIdentifier{Metric: series.Labels[types.MetricNameLabel], Tags: tags},
+			Points:   series.Points,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(seriesResponse(result))
+}
@@ -1,25 +1,48 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 	"tsdb/engine"
 	"tsdb/types"
 )
 
+// sampleValue - значение точки в JSON. NaN (окно без значения после fill) пишется как null
+type sampleValue float64
+
+func (v sampleValue) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(v)) {
+		return []byte("null"), nil
+	}
+	return json.Marshal(float64(v))
+}
+
 type SeriesEntry struct {
 	Series []struct {
 		Metric string            `json:"metric"`
 		Tags   map[string]string `json:"tags"`
 		Points []struct {
-			Timestamp int64   `json:"timestamp"`
-			Value     float64 `json:"value"`
+			Timestamp int64       `json:"timestamp"`
+			Value     sampleValue `json:"value"`
 		} `json:"points"`
 	} `json:"series"`
 }
 
 func (s *Server) writeHandler(w http.ResponseWriter, r *http.Request) {
+	// InfluxDB v1 пишет в /write?db=... в line protocol
+	if r.URL.Query().Has("db") {
+		s.influxWriteHandler(w, r)
+		return
+	}
+
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -40,7 +63,7 @@ func (s *Server) writeHandler(w http.ResponseWriter, r *http.Request) {
 		for j, point := range series.Points {
 			points[j] = types.Point{
 				Timestamp: point.Timestamp,
-				Value:     point.Value,
+				Value:     float64(point.Value),
 			}
 		}
 
@@ -54,7 +77,7 @@ func (s *Server) writeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := s.tsdb.Write(writeReq); err != nil {
-		http.Error(w, "Write failed: "+err.Error(), http.StatusInternalServerError)
+		writeWriteError(w, err)
 		return
 	}
 
@@ -62,6 +85,25 @@ func (s *Server) writeHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
+// queryOptionParams - параметры /query, которые не являются фильтрами по тегам
+var queryOptionParams = map[string]bool{
+	"metric":        true,
+	"start":         true,
+	"end":           true,
+	"step":          true,
+	"window_agg":    true,
+	"fn":            true,
+	"window":        true,
+	"fill":          true,
+	"max_gap":       true,
+	"agg":           true,
+	"group_by":      true,
+	"value_between": true,
+	"topk":          true,
+	"bottomk":       true,
+	"rank_by":       true,
+}
+
 func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -75,64 +117,144 @@ func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tags := make(map[string]string)
 	var (
-		start, end int64
-		err        error
+		matchers    []types.LabelMatcher
+		valueFilter types.ValueFilter
+		hasFilter   bool
 	)
-
-	startStr := r.URL.Query().Get("start")
-	if startStr != "" {
-		start, err = strconv.ParseInt(startStr, 10, 64)
-		if err != nil {
-			http.Error(w, "Invalid start time", http.StatusBadRequest)
-			return
+	for key, values := range r.URL.Query() {
+		if queryOptionParams[key] || len(values) == 0 {
+			continue
 		}
-	} else {
-		start = 0
-	}
-
-	endStr := r.URL.Query().Get("end")
-	if endStr != "" {
-		end, err = strconv.ParseInt(endStr, 10, 64)
-		if err != nil {
-			http.Error(w, "Invalid end time", http.StatusBadRequest)
+		if ok, err := parseValueFilter(&valueFilter, key, values[0]); err != nil {
+			http.Error(w, "Invalid value filter: "+err.Error(), http.StatusBadRequest)
 			return
+		} else if ok {
+			hasFilter = true
+			continue
+		}
+		// если условия только на равенство, ряды ищутся по-старому через FindSeries
+		if m := parseTagFilter(key, values[0]); m.Type == types.MatchEqual && m.Value != "" {
+			tags[m.Name] = m.Value
+		} else {
+			matchers = append(matchers, m)
 		}
-	} else {
-		end = 1<<63 - 1
 	}
 
-	tags := make(map[string]string)
-	for key, values := range r.URL.Query() {
-		if key != "metric" && key != "start" && key != "end" {
-			if len(values) > 0 {
-				tags[key] = values[0]
+	query := types.Query{
+		Metric:      metric,
+		Tags:        tags,
+		Matchers:    matchers,
+		Aggregation: r.URL.Query().Get("agg"),
+	}
+	if err := parseQueryOptions(r.URL.Query(), &query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"topk", &query.TopK}, {"bottomk", &query.BottomK}} {
+		if str := r.URL.Query().Get(param.name); str != "" {
+			k, err := strconv.Atoi(str)
+			if err != nil {
+				http.Error(w, "Invalid "+param.name, http.StatusBadRequest)
+				return
 			}
+			*param.value = k
 		}
 	}
-
-	query := types.Query{
-		Metric: metric,
-		Tags:   tags,
-		TimeRange: types.TimeRange{
-			Start: start,
-			End:   end,
-		},
+	query.RankBy = r.URL.Query().Get("rank_by")
+	if groupBy := r.URL.Query().Get("group_by"); groupBy != "" {
+		query.GroupBy = strings.Split(groupBy, ",")
+	}
+	if between := r.URL.Query().Get("value_between"); between != "" {
+		low, high, ok := strings.Cut(between, ",")
+		lowValue, errLow := parseFilterValue(low)
+		highValue, errHigh := parseFilterValue(high)
+		if !ok || errLow != nil || errHigh != nil {
+			http.Error(w, "Invalid value_between, expected min,max", http.StatusBadRequest)
+			return
+		}
+		valueFilter.Min, valueFilter.MinInclusive = &lowValue, true
+		valueFilter.Max, valueFilter.MaxInclusive = &highValue, true
+		hasFilter = true
+	}
+	if hasFilter {
+		query.ValueFilter = &valueFilter
 	}
 
-	result, err := s.tsdb.Read(query)
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	result, err := s.tsdb.Read(ctx, query)
 	if err != nil {
-		http.Error(w, "Query failed: "+err.Error(), http.StatusInternalServerError)
+		writeQueryError(w, err)
+		return
+	}
+
+	response := seriesResponse(result)
+
+	w.Header().Set("Content-Type", "application/json")
+	if query.ValueFilter != nil {
+		json.NewEncoder(w).Encode(filteredQueryResponse{SeriesEntry: response, BlocksSkipped: result.BlocksSkipped})
 		return
 	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseQueryOptions - диапазон и свертка по времени, общие для /query и /query/expr:
+// start, end, step, window_agg, fn, window, fill, max_gap
+func parseQueryOptions(params url.Values, query *types.Query) error {
+	query.TimeRange = types.TimeRange{Start: 0, End: 1<<63 - 1}
+	if startStr := params.Get("start"); startStr != "" {
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			return errors.New("Invalid start time")
+		}
+		query.TimeRange.Start = start
+	}
+	if endStr := params.Get("end"); endStr != "" {
+		end, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return errors.New("Invalid end time")
+		}
+		query.TimeRange.End = end
+	}
 
+	query.WindowAgg = params.Get("window_agg")
+	query.Function = params.Get("fn")
+	query.Fill = params.Get("fill")
+
+	durations := []struct {
+		name  string
+		value *int64
+	}{
+		{"step", &query.Step},
+		{"window", &query.Window},
+		{"max_gap", &query.MaxGap},
+	}
+	for _, d := range durations {
+		if str := params.Get(d.name); str != "" {
+			value, err := parseDuration(str)
+			if err != nil {
+				return errors.New("Invalid " + d.name)
+			}
+			*d.value = value
+		}
+	}
+	return nil
+}
+
+func seriesResponse(result types.QueryResult) SeriesEntry {
 	response := SeriesEntry{
 		Series: make([]struct {
 			Metric string            `json:"metric"`
 			Tags   map[string]string `json:"tags"`
 			Points []struct {
-				Timestamp int64   `json:"timestamp"`
-				Value     float64 `json:"value"`
+				Timestamp int64       `json:"timestamp"`
+				Value     sampleValue `json:"value"`
 			} `json:"points"`
 		}, len(result.Series)),
 	}
@@ -141,23 +263,134 @@ func (s *Server) queryHandler(w http.ResponseWriter, r *http.Request) {
 		response.Series[i].Metric = series.SeriesID.Metric
 		response.Series[i].Tags = series.SeriesID.Tags
 		response.Series[i].Points = make([]struct {
-			Timestamp int64   `json:"timestamp"`
-			Value     float64 `json:"value"`
+			Timestamp int64       `json:"timestamp"`
+			Value     sampleValue `json:"value"`
 		}, len(series.Points))
 
 		for j, point := range series.Points {
 			response.Series[i].Points[j] = struct {
-				Timestamp int64   `json:"timestamp"`
-				Value     float64 `json:"value"`
+				Timestamp int64       `json:"timestamp"`
+				Value     sampleValue `json:"value"`
 			}{
 				Timestamp: point.Timestamp,
-				Value:     point.Value,
+				Value:     sampleValue(point.Value),
 			}
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return response
+}
+
+// filteredQueryResponse - ответ /query с фильтром по значению
+type filteredQueryResponse struct {
+	SeriesEntry
+	BlocksSkipped int `json:"blocks_skipped"`
+}
+
+// parseValueFilter - value>X, value>=X, value<X, value<=X. Как и в "tag!~", без "=" условие целиком
+// приходит в ключе, а в "value>=X" разбор URL оставляет ">" в ключе. false - параметр не про значение
+func parseValueFilter(filter *types.ValueFilter, key, value string) (bool, error) {
+	rest, ok := strings.CutPrefix(key, "value")
+	if !ok || rest == "" || (rest[0] != '>' && rest[0] != '<') {
+		return false, nil
+	}
+
+	op, operand := rest[:1], rest[1:]
+	inclusive := false
+	if operand == "" {
+		// value>=X
+		operand, inclusive = value, true
+	} else if value != "" {
+		return false, fmt.Errorf("unexpected %q after %s", value, key)
+	}
+
+	v, err := parseFilterValue(operand)
+	if err != nil {
+		return false, err
+	}
+
+	if op == ">" {
+		filter.Min, filter.MinInclusive = &v, inclusive
+	} else {
+		filter.Max, filter.MaxInclusive = &v, inclusive
+	}
+	return true, nil
+}
+
+func parseFilterValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return v, nil
+}
+
+// parseTagFilter - условие на тег из параметра /query: tag=value, tag!=value, tag=~regexp,
+// tag!~regexp. tag= - тега нет, tag=* - тег есть. В "tag!=" и "tag=~" разбор URL оставляет
+// "!" в ключе и "~" в значении, а "tag!~regexp" вообще без "=" и целиком приходит в ключе
+func parseTagFilter(key, value string) types.LabelMatcher {
+	if name, regexp, ok := strings.Cut(key, "!~"); ok {
+		if value != "" {
+			regexp += "=" + value
+		}
+		return types.LabelMatcher{Type: types.MatchNotRegexp, Name: name, Value: regexp}
+	}
+
+	negative := strings.HasSuffix(key, "!")
+	name := strings.TrimSuffix(key, "!")
+
+	if regexp, ok := strings.CutPrefix(value, "~"); ok {
+		if negative {
+			return types.LabelMatcher{Type: types.MatchNotRegexp, Name: name, Value: regexp}
+		}
+		return types.LabelMatcher{Type: types.MatchRegexp, Name: name, Value: regexp}
+	}
+
+	if negative {
+		return types.LabelMatcher{Type: types.MatchNotEqual, Name: name, Value: value}
+	}
+	if value == "*" {
+		return types.LabelMatcher{Type: types.MatchRegexp, Name: name, Value: ".+"}
+	}
+	return types.LabelMatcher{Type: types.MatchEqual, Name: name, Value: value}
+}
+
+// parseDuration - длительность в формате Go (1m, 30s) или целое число наносекунд, как start и end
+func parseDuration(s string) (int64, error) {
+	if d, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return d, nil
+	}
+	d, err := time.ParseDuration(s)
+	return int64(d), err
+}
+
+// writeWriteError - точки, которые движок не принимает, - 400, остальное - 500
+func writeWriteError(w http.ResponseWriter, err error) {
+	if errors.Is(err, types.ErrInvalidWrite) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Write failed: "+err.Error(), http.StatusInternalServerError)
+}
+
+// statusClientClosedRequest - клиент отключился, не дождавшись ответа (как в nginx)
+const statusClientClosedRequest = 499
+
+// writeQueryError - ошибки в параметрах запроса - 400, превышение лимитов - 422,
+// таймаут - 503, отключение клиента - 499, остальное - 500
+func writeQueryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, types.ErrInvalidQuery):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, types.ErrLimitExceeded):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Query timed out", http.StatusServiceUnavailable)
+	case errors.Is(err, context.Canceled):
+		http.Error(w, "Query canceled", statusClientClosedRequest)
+	default:
+		http.Error(w, "Query failed: "+err.Error(), http.StatusInternalServerError)
+	}
 }
 
 // seriesHandler - не костыль, а оптимизация :)
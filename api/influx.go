@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"tsdb/ingest"
+)
+
+const maxInfluxLineSize = 1024 * 1024
+
+// influxWriteHandler - InfluxDB line protocol для /api/v2/write и /write?db=.
+// Корректные строки записываются даже если в батче есть ошибки, ошибки возвращаются как 400 (partial write)
+func (s *Server) influxWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeInfluxError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	precision, err := ingest.ParseInfluxPrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeInfluxError(w, http.StatusBadRequest, "invalid gzip body: "+err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	now := time.Now().UnixNano()
+	batch := ingest.NewBatch()
+	var parseErrors []string
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxInfluxLineSize)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parsed, err := ingest.ParseInfluxLine(line, precision, now)
+		if err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("line %d: %v", lineNum, err))
+			continue
+		}
+		parsed.AddTo(batch)
+
+		if batch.Len() >= ingest.DefaultBatchSize {
+			if err := batch.Flush(s.tsdb); err != nil {
+				writeInfluxError(w, http.StatusInternalServerError, "write failed: "+err.Error())
+				return
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		writeInfluxError(w, http.StatusBadRequest, "failed to read body: "+err.Error())
+		return
+	}
+
+	if err := batch.Flush(s.tsdb); err != nil {
+		writeInfluxError(w, http.StatusInternalServerError, "write failed: "+err.Error())
+		return
+	}
+
+	if len(parseErrors) > 0 {
+		writeInfluxError(w, http.StatusBadRequest, "partial write: "+strings.Join(parseErrors, "; "))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeInfluxError - формат ошибки InfluxDB v2, его понимают Telegraf и клиентские библиотеки
+func writeInfluxError(w http.ResponseWriter, status int, message string) {
+	code := "invalid"
+	if status >= 500 {
+		code = "internal error"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":    code,
+		"message": message,
+	})
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"tsdb/engine"
+	"tsdb/index"
+	"tsdb/types"
+)
+
+// labelOptionParams - параметры справочников, которые не являются фильтрами по тегам
+var labelOptionParams = map[string]bool{
+	"metric": true,
+	"start":  true,
+	"end":    true,
+	"prefix": true,
+	"limit":  true,
+}
+
+// labelsHandler - /labels: имена тегов
+func (s *Server) labelsHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveLabelValues(w, r, func(engine *engine.TSDBEngine, filter index.LabelFilter) ([]string, error) {
+		return engine.LabelNames(filter)
+	})
+}
+
+// labelValuesHandler - /label/{key}/values: значения тега
+func (s *Server) labelValuesHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	s.serveLabelValues(w, r, func(engine *engine.TSDBEngine, filter index.LabelFilter) ([]string, error) {
+		return engine.LabelValues(key, filter)
+	})
+}
+
+// metricsHandler - /metrics: имена метрик
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveLabelValues(w, r, func(engine *engine.TSDBEngine, filter index.LabelFilter) ([]string, error) {
+		return engine.LabelValues(types.MetricNameLabel, filter)
+	})
+}
+
+func (s *Server) serveLabelValues(w http.ResponseWriter, r *http.Request, lookup func(*engine.TSDBEngine, index.LabelFilter) ([]string, error)) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	engine, ok := s.tsdb.(*engine.TSDBEngine)
+	if !ok {
+		http.Error(w, "Not available", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := parseLabelFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values, err := lookup(engine, filter)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
+
+// parseLabelFilter - metric, start и end (наносекунды), prefix, limit и условия на теги в синтаксисе /query
+func parseLabelFilter(r *http.Request) (index.LabelFilter, error) {
+	params := r.URL.Query()
+	filter := index.LabelFilter{Prefix: params.Get("prefix")}
+
+	if metric := params.Get("metric"); metric != "" {
+		filter.Matchers = append(filter.Matchers, types.LabelMatcher{Type: types.MatchEqual, Name: types.MetricNameLabel, Value: metric})
+	}
+	for key, values := range params {
+		if !labelOptionParams[key] && len(values) > 0 {
+			filter.Matchers = append(filter.Matchers, parseTagFilter(key, values[0]))
+		}
+	}
+
+	if params.Has("start") || params.Has("end") {
+		filter.TimeRange = &types.TimeRange{End: 1<<63 - 1}
+		if value := params.Get("start"); value != "" {
+			start, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid start time")
+			}
+			filter.TimeRange.Start = start
+		}
+		if value := params.Get("end"); value != "" {
+			end, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid end time")
+			}
+			filter.TimeRange.End = end
+		}
+	}
+
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return filter, fmt.Errorf("invalid limit")
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
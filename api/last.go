@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"tsdb/engine"
+	"tsdb/types"
+)
+
+// lastQueryHandler - /query/last?metric=...&tag=value: последняя точка каждого ряда,
+// условия на теги как в /query
+func (s *Server) lastQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	engine, ok := s.tsdb.(*engine.TSDBEngine)
+	if !ok {
+		http.Error(w, "Not available", http.StatusInternalServerError)
+		return
+	}
+
+	metric := r.URL.Query().Get("metric")
+	if metric == "" {
+		http.Error(w, "Missing required parameter: metric", http.StatusBadRequest)
+		return
+	}
+
+	query := types.Query{Metric: metric, Tags: make(map[string]string)}
+	for key, values := range r.URL.Query() {
+		if key == "metric" || len(values) == 0 {
+			continue
+		}
+		if m := parseTagFilter(key, values[0]); m.Type == types.MatchEqual && m.Value != "" {
+			query.Tags[m.Name] = m.Value
+		} else {
+			query.Matchers = append(query.Matchers, m)
+		}
+	}
+
+	result, err := engine.LastPoints(query)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(seriesResponse(result))
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"tsdb/ingest"
+	"tsdb/types"
+)
+
+// maxReportedLineErrors - сколько отклоненных строк перечисляется в ответе
+const maxReportedLineErrors = 100
+
+type ndjsonLineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type ndjsonWriteSummary struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Points   int               `json:"points"`
+	Errors   []ndjsonLineError `json:"errors"`
+	Error    string            `json:"error,omitempty"`
+
+	pendingLines  int
+	pendingPoints int
+}
+
+// flush - строки засчитываются принятыми только после записи пачки, при ошибке записи
+// строки пачки считаются отклоненными, а остаток потока не читается
+func (sum *ndjsonWriteSummary) flush(writer types.Writer, batch *ingest.Batch) error {
+	if err := batch.Flush(writer); err != nil {
+		sum.Rejected += sum.pendingLines
+		sum.Error = "Write failed: " + err.Error()
+		return err
+	}
+	sum.Accepted += sum.pendingLines
+	sum.Points += sum.pendingPoints
+	sum.pendingLines, sum.pendingPoints = 0, 0
+	return nil
+}
+
+func (sum *ndjsonWriteSummary) reject(line int, reason string) {
+	sum.Rejected++
+	if len(sum.Errors) < maxReportedLineErrors {
+		sum.Errors = append(sum.Errors, ndjsonLineError{Line: line, Error: reason})
+	}
+}
+
+// ndjsonWriteHandler - потоковая запись: каждая строка - ряд или точка. Строки разбираются
+// по одной и пишутся пачками по DefaultBatchSize точек, так что уже записанные пачки
+// остаются в базе, даже если дальше в потоке что-то сломалось
+func (s *Server) ndjsonWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	reader := bufio.NewReaderSize(body, 64*1024)
+	batch := ingest.NewBatch()
+	summary := ndjsonWriteSummary{Errors: []ndjsonLineError{}}
+	status := http.StatusOK
+
+	for lineNum := 1; ; lineNum++ {
+		line, tooLong, err := ingest.ReadNDJSONLine(reader, ingest.MaxNDJSONLineSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			summary.Error = "Failed to read body: " + err.Error()
+			status = http.StatusBadRequest
+			break
+		}
+
+		if tooLong {
+			summary.reject(lineNum, "line exceeds maximum size")
+			continue
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		series, err := ingest.ParseNDJSONLine(line)
+		if err != nil {
+			summary.reject(lineNum, err.Error())
+			continue
+		}
+
+		for _, point := range series.Points {
+			batch.Add(series.SeriesID, point)
+		}
+		summary.pendingLines++
+		summary.pendingPoints += len(series.Points)
+
+		if batch.Len() >= ingest.DefaultBatchSize {
+			if err := summary.flush(s.tsdb, batch); err != nil {
+				status = http.StatusInternalServerError
+				break
+			}
+		}
+	}
+
+	if status != http.StatusInternalServerError {
+		if err := summary.flush(s.tsdb, batch); err != nil {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"tsdb/ingest"
+)
+
+// maxOpenTSDBPutBody - тело /api/put читается целиком, поэтому больше не принимается
+const maxOpenTSDBPutBody = 32 << 20
+
+type openTSDBPutError struct {
+	Datapoint ingest.OpenTSDBDataPoint `json:"datapoint"`
+	Error     string                   `json:"error"`
+}
+
+// openTSDBPutHandler - совместимый с OpenTSDB /api/put. Как и в OpenTSDB, ?summary и ?details
+// возвращают сводку вместо пустого 204, а ошибочные точки не мешают записи остальных
+func (s *Server) openTSDBPutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOpenTSDBPutBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dataPoints, err := ingest.ParseOpenTSDBDataPoints(body)
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	batch := ingest.NewBatch()
+	var putErrors []openTSDBPutError
+	success := 0
+
+	// пишется пачками по DefaultBatchSize точек, как и остальные протоколы
+	flush := func() bool {
+		points := batch.Len()
+		if err := batch.Flush(s.tsdb); err != nil {
+			writeWriteError(w, err)
+			return false
+		}
+		success += points
+		return true
+	}
+
+	for _, dp := range dataPoints {
+		sample, err := dp.Sample()
+		if err != nil {
+			putErrors = append(putErrors, openTSDBPutError{Datapoint: dp, Error: err.Error()})
+			continue
+		}
+		batch.Add(sample.SeriesID, sample.Point)
+		if batch.Len() >= ingest.DefaultBatchSize && !flush() {
+			return
+		}
+	}
+	if !flush() {
+		return
+	}
+
+	status := http.StatusNoContent
+	if len(putErrors) > 0 {
+		status = http.StatusBadRequest
+	}
+
+	query := r.URL.Query()
+	if !query.Has("summary") && !query.Has("details") {
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		http.Error(w, putErrors[0].Error, status)
+		return
+	}
+
+	if status == http.StatusNoContent {
+		status = http.StatusOK
+	}
+
+	response := map[string]interface{}{
+		"success": success,
+		"failed":  len(putErrors),
+	}
+	if query.Has("details") {
+		if putErrors == nil {
+			putErrors = []openTSDBPutError{}
+		}
+		response["errors"] = putErrors
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
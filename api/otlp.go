@@ -0,0 +1,72 @@
+package api
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"tsdb/ingest"
+)
+
+type otlpPartialSuccess struct {
+	RejectedDataPoints string `json:"rejectedDataPoints"`
+	ErrorMessage       string `json:"errorMessage"`
+}
+
+type otlpExportResponse struct {
+	PartialSuccess *otlpPartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+// otlpMetricsHandler - OTLP/HTTP с JSON-кодировкой. Отброшенные точки возвращаются
+// в partialSuccess, как того требует спецификация, а не ошибкой всего запроса
+func (s *Server) otlpMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Only application/json OTLP payloads are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var req ingest.OTLPMetricsRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	batch := ingest.NewBatch()
+	deltas, rejected, reasons := s.otlp.Convert(&req, batch)
+
+	if err := batch.Flush(s.tsdb); err != nil {
+		http.Error(w, "Write failed: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	s.otlp.Commit(deltas)
+
+	response := otlpExportResponse{}
+	if rejected > 0 {
+		response.PartialSuccess = &otlpPartialSuccess{
+			RejectedDataPoints: strconv.Itoa(rejected),
+			ErrorMessage:       strings.Join(reasons, "; "),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"tsdb/promql"
+)
+
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type promQueryData struct {
+	ResultType promql.ValueType `json:"resultType"`
+	Result     interface{}      `json:"result"`
+}
+
+type promSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+type promSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+// promInstantQueryHandler - /api/v1/query?query=...&time=... в формате HTTP API Prometheus
+func (s *Server) promInstantQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.FormValue("query")
+	if query == "" {
+		writePromError(w, http.StatusBadRequest, "bad_data", "missing required parameter: query")
+		return
+	}
+
+	ts := time.Now().UnixNano()
+	if value := r.FormValue("time"); value != "" {
+		var err error
+		if ts, err = parsePromTime(value); err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"time\": "+err.Error())
+			return
+		}
+	}
+
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	result, err := s.promql.InstantQuery(ctx, expr, ts)
+	if err != nil {
+		writePromQueryError(w, err)
+		return
+	}
+
+	writePromData(w, promQueryData{ResultType: result.Type(), Result: promResult(result)})
+}
+
+// promRangeQueryHandler - /api/v1/query_range?query=...&start=...&end=...&step=...
+func (s *Server) promRangeQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.FormValue("query")
+	if query == "" {
+		writePromError(w, http.StatusBadRequest, "bad_data", "missing required parameter: query")
+		return
+	}
+
+	start, err := parsePromTime(r.FormValue("start"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"start\": "+err.Error())
+		return
+	}
+	end, err := parsePromTime(r.FormValue("end"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"end\": "+err.Error())
+		return
+	}
+	step, err := parsePromDuration(r.FormValue("step"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid parameter \"step\": "+err.Error())
+		return
+	}
+
+	if end < start {
+		writePromError(w, http.StatusBadRequest, "bad_data", "end timestamp must not be before start time")
+		return
+	}
+	if step <= 0 {
+		writePromError(w, http.StatusBadRequest, "bad_data", "zero or negative query resolution step widths are not accepted. Try a positive integer")
+		return
+	}
+	if (end-start)/int64(step) >= promql.MaxRangeSteps {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", promql.MaxRangeSteps))
+		return
+	}
+
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	if t := expr.Type(); t != promql.ValueTypeVector && t != promql.ValueTypeScalar {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("invalid expression type %q for range query, must be scalar or instant vector", t))
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	result, err := s.promql.RangeQuery(ctx, expr, start, end, step)
+	if err != nil {
+		writePromQueryError(w, err)
+		return
+	}
+
+	writePromData(w, promQueryData{ResultType: promql.ValueTypeMatrix, Result: promResult(result)})
+}
+
+func promResult(value promql.Value) interface{} {
+	switch v := value.(type) {
+	case promql.Scalar:
+		return promPoint(v.T, v.V)
+	case promql.String:
+		return [2]interface{}{promTimestamp(v.T), v.V}
+	case promql.Vector:
+		result := make([]promSample, len(v))
+		for i, s := range v {
+			result[i] = promSample{Metric: s.Labels, Value: promPoint(s.T, s.V)}
+		}
+		return result
+	case promql.Matrix:
+		result := make([]promSeries, len(v))
+		for i, series := range v {
+			values := make([][2]interface{}, len(series.Points))
+			for j, p := range series.Points {
+				values[j] = promPoint(p.Timestamp, p.Value)
+			}
+			result[i] = promSeries{Metric: series.Labels, Values: values}
+		}
+		return result
+	}
+	return nil
+}
+
+// promPoint - [секунды, "значение"]: Prometheus отдает значения строками, чтобы не терять NaN и Inf
+func promPoint(t int64, v float64) [2]interface{} {
+	return [2]interface{}{promTimestamp(t), strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+func promTimestamp(t int64) json.Number {
+	return json.Number(strconv.FormatFloat(float64(t)/1e9, 'f', -1, 64))
+}
+
+// parsePromTime - unix-время в секундах (возможно дробное) или RFC3339, результат в наносекундах
+func parsePromTime(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing value")
+	}
+
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(seconds) || math.Abs(seconds) > math.MaxInt64/1e9 {
+			return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+		}
+		whole, frac := math.Modf(seconds)
+		return int64(whole)*int64(time.Second) + int64(math.Round(frac*1e9)), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixNano(), nil
+	}
+
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parsePromDuration - секунды (возможно дробные) или длительность PromQL (15s, 1m)
+func parsePromDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing value")
+	}
+
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(seconds) || math.Abs(seconds) > math.MaxInt64/1e9 {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+		}
+		return time.Duration(seconds * 1e9), nil
+	}
+
+	return promql.ParseDuration(s)
+}
+
+func writePromData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(promResponse{Status: "success", Data: data})
+}
+
+// writePromQueryError - коды и errorType как у Prometheus: timeout - 503, canceled - 499
+func writePromQueryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writePromError(w, http.StatusServiceUnavailable, "timeout", "query timed out")
+	case errors.Is(err, context.Canceled):
+		writePromError(w, statusClientClosedRequest, "canceled", "query was canceled")
+	default:
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+	}
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(promResponse{Status: "error", ErrorType: errorType, Error: message})
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+	"tsdb/encoding"
+	"tsdb/engine"
+	"tsdb/index"
+	"tsdb/prompb"
+	"tsdb/types"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// remoteReadHandler - Prometheus remote_read. Отдает SAMPLES или, если клиент согласен, STREAMED_XOR_CHUNKS
+func (s *Server) remoteReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, ok := readSnappyBody(w, r)
+	if !ok {
+		return
+	}
+
+	var req prompb.ReadRequest
+	if err := req.Unmarshal(data); err != nil {
+		http.Error(w, "Invalid protobuf: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queries := make([]types.Query, len(req.Queries))
+	for i, q := range req.Queries {
+		query, err := convertRemoteQuery(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queries[i] = query
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	if acceptsStreamedChunks(req.AcceptedResponseTypes) {
+		s.streamChunkedReadResponse(ctx, w, queries)
+		return
+	}
+
+	response := prompb.ReadResponse{
+		Results: make([]prompb.QueryResult, len(queries)),
+	}
+
+	for i, query := range queries {
+		result, err := s.tsdb.Read(ctx, query)
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		sortSeries(result.Series)
+		timeseries := make([]prompb.TimeSeries, 0, len(result.Series))
+		for _, series := range result.Series {
+			points := remotePoints(series.Points)
+			ts := prompb.TimeSeries{
+				Labels:  seriesIDToLabels(series.SeriesID),
+				Samples: make([]prompb.Sample, len(points)),
+			}
+			for j, point := range points {
+				ts.Samples[j] = prompb.Sample{
+					Value:     point.Value,
+					Timestamp: point.Timestamp / int64(time.Millisecond),
+				}
+			}
+			timeseries = append(timeseries, ts)
+		}
+		response.Results[i].Timeseries = timeseries
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(encoding.SnappyEncode(response.Marshal()))
+}
+
+// streamChunkedReadResponse - по фрейму на ряд: uvarint длины, crc32 (Castagnoli) и ChunkedReadResponse
+func (s *Server) streamChunkedReadResponse(ctx context.Context, w http.ResponseWriter, queries []types.Query) {
+	flusher, _ := w.(http.Flusher)
+	headerWritten := false
+
+	for i, query := range queries {
+		result, err := s.tsdb.Read(ctx, query)
+		if err != nil {
+			if !headerWritten {
+				writeQueryError(w, err)
+			}
+			return
+		}
+
+		sortSeries(result.Series)
+		for _, series := range result.Series {
+			frame := prompb.ChunkedReadResponse{
+				ChunkedSeries: []prompb.ChunkedSeries{{
+					Labels: seriesIDToLabels(series.SeriesID),
+					Chunks: encodeXORChunks(remotePoints(series.Points)),
+				}},
+				QueryIndex: int64(i),
+			}
+
+			if !headerWritten {
+				w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+				headerWritten = true
+			}
+
+			if err := writeChunkedFrame(w, frame.Marshal()); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	if !headerWritten {
+		w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func writeChunkedFrame(w io.Writer, msg []byte) error {
+	header := binary.AppendUvarint(nil, uint64(len(msg)))
+	header = binary.BigEndian.AppendUint32(header, crc32.Checksum(msg, castagnoliTable))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// remotePoints - точки по возрастанию миллисекунд без повторов: блоки в файле не обязаны идти
+// по времени, а Prometheus не принимает чанки, где время идет назад. Из точек одной миллисекунды
+// остается последняя записанная
+func remotePoints(points []types.Point) []types.Point {
+	result := engine.DedupPoints(points)
+	unique := result[:0]
+	for _, point := range result {
+		n := len(unique)
+		if n > 0 && unique[n-1].Timestamp/int64(time.Millisecond) == point.Timestamp/int64(time.Millisecond) {
+			unique[n-1] = point
+			continue
+		}
+		unique = append(unique, point)
+	}
+	return unique
+}
+
+func encodeXORChunks(points []types.Point) []prompb.Chunk {
+	var chunks []prompb.Chunk
+	var encoder *prompb.XORChunkEncoder
+	var chunk prompb.Chunk
+
+	for _, point := range points {
+		ts := point.Timestamp / int64(time.Millisecond)
+
+		if encoder == nil {
+			encoder = prompb.NewXORChunkEncoder()
+			chunk = prompb.Chunk{MinTimeMs: ts, Type: prompb.Chunk_XOR}
+		}
+
+		encoder.Append(ts, point.Value)
+		chunk.MaxTimeMs = ts
+
+		if encoder.NumSamples() >= prompb.MaxSamplesPerChunk {
+			chunk.Data = encoder.Bytes()
+			chunks = append(chunks, chunk)
+			encoder = nil
+		}
+	}
+
+	if encoder != nil {
+		chunk.Data = encoder.Bytes()
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// msToNanos - за пределами int64 время упирается в границу: клиенты шлют MaxInt64 как "до бесконечности"
+func msToNanos(ms int64) int64 {
+	switch {
+	case ms >= math.MaxInt64/int64(time.Millisecond):
+		return math.MaxInt64
+	case ms <= math.MinInt64/int64(time.Millisecond):
+		return math.MinInt64
+	}
+	return ms * int64(time.Millisecond)
+}
+
+func acceptsStreamedChunks(accepted []prompb.ReadRequest_ResponseType) bool {
+	for _, t := range accepted {
+		if t == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+			return true
+		}
+	}
+	return false
+}
+
+func convertRemoteQuery(q prompb.Query) (types.Query, error) {
+	// конец диапазона включительно до последней наносекунды миллисекунды
+	end := msToNanos(q.EndTimestampMs)
+	if end != math.MaxInt64 {
+		end += int64(time.Millisecond) - 1
+	}
+
+	query := types.Query{
+		Matchers:  make([]types.LabelMatcher, len(q.Matchers)),
+		TimeRange: types.TimeRange{Start: msToNanos(q.StartTimestampMs), End: end},
+	}
+
+	for i, m := range q.Matchers {
+		var matchType types.MatchType
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			matchType = types.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			matchType = types.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			matchType = types.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			matchType = types.MatchNotRegexp
+		default:
+			return query, fmt.Errorf("unknown matcher type %d", m.Type)
+		}
+
+		query.Matchers[i] = types.LabelMatcher{Type: matchType, Name: m.Name, Value: m.Value}
+	}
+
+	if err := index.ValidateMatchers(query.Matchers); err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+// seriesIDToLabels - метки с __name__, отсортированные по имени, как их ждет Prometheus
+func seriesIDToLabels(seriesID types.SeriesIdentifier) []prompb.Label {
+	labels := make([]prompb.Label, 0, len(seriesID.Tags)+1)
+	labels = append(labels, prompb.Label{Name: types.MetricNameLabel, Value: seriesID.Metric})
+
+	for name, value := range seriesID.Tags {
+		labels = append(labels, prompb.Label{Name: name, Value: value})
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+
+	return labels
+}
+
+func sortSeries(series []types.SeriesData) {
+	sort.Slice(series, func(i, j int) bool {
+		return seriesSortKey(series[i].SeriesID) < seriesSortKey(series[j].SeriesID)
+	})
+}
+
+func seriesSortKey(seriesID types.SeriesIdentifier) string {
+	key := ""
+	for _, label := range seriesIDToLabels(seriesID) {
+		key += label.Name + "\xff" + label.Value + "\xff"
+	}
+	return key
+}
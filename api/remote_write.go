@@ -0,0 +1,131 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"tsdb/encoding"
+	"tsdb/prompb"
+	"tsdb/types"
+)
+
+// remoteWriteHandler - приемник Prometheus remote_write.
+// Prometheus повторяет запрос только на 5xx, поэтому ошибки в самих данных отдаем как 400
+func (s *Server) remoteWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, ok := readSnappyBody(w, r)
+	if !ok {
+		return
+	}
+
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(data); err != nil {
+		http.Error(w, "Invalid protobuf: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeReq, err := convertRemoteWrite(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(writeReq.Series) > 0 {
+		if err := s.tsdb.Write(writeReq); err != nil {
+			writeWriteError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readSnappyBody - тело remote_write/remote_read, распакованное. Сжатое тело не длиннее
+// SnappyMaxDecodedLen, распакованное - тоже. false - ответ с ошибкой уже записан
+func readSnappyBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, encoding.SnappyMaxDecodedLen))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+		http.Error(w, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	data, err := encoding.SnappyDecode(compressed)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, encoding.ErrSnappyTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, "Invalid snappy body: "+err.Error(), status)
+		return nil, false
+	}
+	return data, true
+}
+
+func convertRemoteWrite(req *prompb.WriteRequest) (types.WriteRequest, error) {
+	writeReq := types.WriteRequest{
+		Series: make([]types.SeriesData, 0, len(req.Timeseries)),
+	}
+
+	for _, ts := range req.Timeseries {
+		seriesID, err := labelsToSeriesID(ts.Labels)
+		if err != nil {
+			return writeReq, err
+		}
+
+		points := make([]types.Point, 0, len(ts.Samples))
+		for _, sample := range ts.Samples {
+			// NaN, в том числе маркер устаревания ряда, как точку не храним
+			if !types.IsFinite(sample.Value) {
+				continue
+			}
+			points = append(points, types.Point{
+				Timestamp: sample.Timestamp * int64(time.Millisecond),
+				Value:     sample.Value,
+			})
+		}
+
+		if len(points) == 0 {
+			continue
+		}
+
+		writeReq.Series = append(writeReq.Series, types.SeriesData{
+			SeriesID: seriesID,
+			Points:   points,
+		})
+	}
+
+	return writeReq, nil
+}
+
+func labelsToSeriesID(labels []prompb.Label) (types.SeriesIdentifier, error) {
+	seriesID := types.SeriesIdentifier{
+		Tags: make(map[string]string, len(labels)),
+	}
+
+	for _, label := range labels {
+		if label.Name == types.MetricNameLabel {
+			seriesID.Metric = label.Value
+			continue
+		}
+		if label.Value != "" {
+			seriesID.Tags[label.Name] = label.Value
+		}
+	}
+
+	if seriesID.Metric == "" {
+		return seriesID, fmt.Errorf("series without %s label", types.MetricNameLabel)
+	}
+
+	return seriesID, nil
+}
@@ -1,25 +1,60 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
+	"tsdb/ingest"
+	"tsdb/promql"
+	"tsdb/sql"
 	"tsdb/types"
 )
 
 type Server struct {
 	tsdb   types.TSDB
 	server *http.Server
+	otlp   *ingest.OTLPConverter
+	promql *promql.Engine
+	sql    *sql.Engine
+
+	// QueryTimeout - сколько может идти один запрос на чтение, 0 - без ограничения
+	QueryTimeout time.Duration
 }
 
 func NewServer(tsdb types.TSDB, host string, port int) *Server {
+	// итоги delta-рядов OTLP после рестарта продолжаются с последних записанных точек
+	last, _ := tsdb.(ingest.LastPointReader)
+
 	mux := http.NewServeMux()
-	server := &Server{tsdb: tsdb}
+	server := &Server{
+		tsdb:   tsdb,
+		otlp:   ingest.NewOTLPConverter(last),
+		promql: promql.NewEngine(tsdb),
+		sql:    sql.NewEngine(tsdb),
+	}
 
 	mux.HandleFunc("/write", server.writeHandler)
+	mux.HandleFunc("/write/ndjson", server.ndjsonWriteHandler)
 	mux.HandleFunc("/query", server.queryHandler)
+	mux.HandleFunc("/query/last", server.lastQueryHandler)
+	mux.HandleFunc("/query/expr", server.exprQueryHandler)
 	mux.HandleFunc("/health", server.healthHandler)
 	mux.HandleFunc("/series", server.seriesHandler)
+	mux.HandleFunc("/labels", server.labelsHandler)
+	mux.HandleFunc("/label/{key}/values", server.labelValuesHandler)
+	mux.HandleFunc("/metrics", server.metricsHandler)
+	mux.HandleFunc("/status/cardinality", server.cardinalityHandler)
+	mux.HandleFunc("/sql", server.sqlHandler)
+	mux.HandleFunc("/api/v1/write", server.remoteWriteHandler)
+	mux.HandleFunc("/api/v1/read", server.remoteReadHandler)
+	mux.HandleFunc("/api/v1/query", server.promInstantQueryHandler)
+	mux.HandleFunc("/api/v1/query_range", server.promRangeQueryHandler)
+	mux.HandleFunc("/api/v2/write", server.influxWriteHandler)
+	mux.HandleFunc("/api/put", server.openTSDBPutHandler)
+	mux.HandleFunc("/v1/metrics", server.otlpMetricsHandler)
+	mux.HandleFunc("/import/csv", server.csvImportHandler)
 
 	server.server = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", host, port),
@@ -34,6 +69,14 @@ func (s *Server) Start() error {
 	return s.server.ListenAndServe()
 }
 
+// queryContext - контекст запроса на чтение: отменяется, когда клиент отключился или вышел QueryTimeout
+func (s *Server) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.QueryTimeout > 0 {
+		return context.WithTimeout(r.Context(), s.QueryTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
 func (s *Server) Shutdown() error {
 	return s.server.Close()
 }
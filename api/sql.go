@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+	"tsdb/sql"
+)
+
+// sqlHandler - GET /sql?q=SELECT ... или POST с запросом в теле. Ответ - {"columns": [...], "rows": [[...], ...]}
+func (s *Server) sqlHandler(w http.ResponseWriter, r *http.Request) {
+	var query string
+	switch r.Method {
+	case "GET":
+		query = r.URL.Query().Get("q")
+	case "POST":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		query = string(body)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if query == "" {
+		http.Error(w, "Missing required parameter: q", http.StatusBadRequest)
+		return
+	}
+
+	stmt, err := sql.Parse(query)
+	if err != nil {
+		http.Error(w, "Invalid SQL: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.queryContext(r)
+	defer cancel()
+
+	result, err := s.sql.Exec(ctx, stmt, time.Now().UnixNano())
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	// NaN в JSON не бывает, пишется как null
+	for _, row := range result.Rows {
+		for i, v := range row {
+			if f, ok := v.(float64); ok {
+				row[i] = sampleValue(f)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"tsdb/engine"
+)
+
+// DefaultCardinalityLimit - размер топов в /status/cardinality по умолчанию
+const DefaultCardinalityLimit = 10
+
+// cardinalityHandler - /status/cardinality?limit=N&since=...: since - таймстемп в наносекундах
+// или длительность назад от текущего момента (1h, 30m)
+func (s *Server) cardinalityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	engine, ok := s.tsdb.(*engine.TSDBEngine)
+	if !ok {
+		http.Error(w, "Not available", http.StatusInternalServerError)
+		return
+	}
+
+	limit := DefaultCardinalityLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var since int64
+	if value := r.URL.Query().Get("since"); value != "" {
+		if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+			since = ts
+		} else if ago, err := time.ParseDuration(value); err == nil && ago > 0 {
+			since = time.Now().Add(-ago).UnixNano()
+		} else {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(engine.Cardinality(limit, since))
+}
@@ -0,0 +1,209 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Блочный формат Snappy (без framing), которым Prometheus сжимает remote_write/remote_read
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	snappyHashBits   = 14
+	snappyMinMatch   = 4
+	snappyMaxOffset  = 1 << 15
+	snappyMaxCopyLen = 64
+)
+
+// SnappyMaxDecodedLen - больше не распаковываем: длина берется из заголовка входа и без предела
+// пятибайтное тело могло бы запросить 4 ГБ
+const SnappyMaxDecodedLen = 32 << 20
+
+var (
+	ErrSnappyCorrupt  = errors.New("snappy: corrupt input")
+	ErrSnappyTooLarge = errors.New("snappy: decoded length exceeds limit")
+)
+
+func SnappyDecode(src []byte) ([]byte, error) {
+	n, read := binary.Uvarint(src)
+	if read <= 0 || n > 0xffffffff {
+		return nil, ErrSnappyCorrupt
+	}
+	if n > SnappyMaxDecodedLen {
+		return nil, ErrSnappyTooLarge
+	}
+
+	dst := make([]byte, 0, n)
+	s := read
+
+	for s < len(src) {
+		tag := src[s]
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			length := int(tag >> 2)
+			s++
+			if length >= 60 {
+				extra := length - 59
+				if s+extra > len(src) {
+					return nil, ErrSnappyCorrupt
+				}
+				length = 0
+				for i := 0; i < extra; i++ {
+					length |= int(src[s+i]) << (8 * i)
+				}
+				s += extra
+			}
+			length++
+
+			if length <= 0 || s+length > len(src) || len(dst)+length > int(n) {
+				return nil, ErrSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+
+		case snappyTagCopy1:
+			if s+2 > len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length := 4 + int(tag>>2)&0x07
+			offset := int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+			var err error
+			if dst, err = snappyCopy(dst, offset, length, int(n)); err != nil {
+				return nil, err
+			}
+
+		case snappyTagCopy2:
+			if s+3 > len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+			var err error
+			if dst, err = snappyCopy(dst, offset, length, int(n)); err != nil {
+				return nil, err
+			}
+
+		case snappyTagCopy4:
+			if s+5 > len(src) {
+				return nil, ErrSnappyCorrupt
+			}
+			length := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+			var err error
+			if dst, err = snappyCopy(dst, offset, length, int(n)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(dst) != int(n) {
+		return nil, ErrSnappyCorrupt
+	}
+
+	return dst, nil
+}
+
+func SnappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)+len(src)/6+16), uint64(len(src)))
+	if len(src) < snappyMinMatch+1 {
+		return snappyEmitLiteral(dst, src)
+	}
+
+	var table [1 << snappyHashBits]int32
+	for i := range table {
+		table[i] = -1
+	}
+
+	literalStart := 0
+	s := 0
+	for s+snappyMinMatch <= len(src) {
+		h := snappyHash(binary.LittleEndian.Uint32(src[s:]))
+		candidate := int(table[h])
+		table[h] = int32(s)
+
+		if candidate < 0 || s-candidate > snappyMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[s:]) {
+			s++
+			continue
+		}
+
+		dst = snappyEmitLiteral(dst, src[literalStart:s])
+
+		matchLen := snappyMinMatch
+		for s+matchLen < len(src) && src[candidate+matchLen] == src[s+matchLen] {
+			matchLen++
+		}
+
+		dst = snappyEmitCopy(dst, s-candidate, matchLen)
+		s += matchLen
+		literalStart = s
+	}
+
+	return snappyEmitLiteral(dst, src[literalStart:])
+}
+
+func snappyCopy(dst []byte, offset, length, limit int) ([]byte, error) {
+	if offset <= 0 || offset > len(dst) || len(dst)+length > limit {
+		return nil, ErrSnappyCorrupt
+	}
+
+	// копирование побайтно: источник и приемник могут перекрываться
+	start := len(dst) - offset
+	for i := 0; i < length; i++ {
+		dst = append(dst, dst[start+i])
+	}
+	return dst, nil
+}
+
+func snappyHash(v uint32) uint32 {
+	return (v * 0x1e35a7bd) >> (32 - snappyHashBits)
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+
+	return append(dst, lit...)
+}
+
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		chunk := length
+		if chunk > snappyMaxCopyLen {
+			chunk = snappyMaxCopyLen
+		}
+
+		if chunk >= 4 && chunk < 12 && offset < 2048 {
+			dst = append(dst, byte(offset>>8)<<5|byte(chunk-4)<<2|snappyTagCopy1, byte(offset))
+		} else {
+			dst = append(dst, byte(chunk-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		}
+
+		length -= chunk
+	}
+
+	return dst
+}
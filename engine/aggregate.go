@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"tsdb/types"
+)
+
+var aggregations = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true, "stddev": true,
+}
+
+// Aggregator - накопитель для агрегатов. Хранит сумму и сумму квадратов, а не среднее,
+// чтобы накопители можно было складывать между собой. Им же пользуется /sql
+type Aggregator struct {
+	Count int64
+	Sum   float64
+	SumSq float64
+	Min   float64
+	Max   float64
+	First float64
+	Last  float64
+}
+
+func (a *Aggregator) Add(v float64) {
+	if a.Count == 0 {
+		a.First = v
+	}
+	if a.Count == 0 || v < a.Min {
+		a.Min = v
+	}
+	if a.Count == 0 || v > a.Max {
+		a.Max = v
+	}
+	a.Last = v
+	a.Count++
+	a.Sum += v
+	a.SumSq += v * v
+}
+
+// Merge - first и last у слитых накопителей не определены
+func (a *Aggregator) Merge(other Aggregator) {
+	if other.Count == 0 {
+		return
+	}
+	if a.Count == 0 || other.Min < a.Min {
+		a.Min = other.Min
+	}
+	if a.Count == 0 || other.Max > a.Max {
+		a.Max = other.Max
+	}
+	a.Count += other.Count
+	a.Sum += other.Sum
+	a.SumSq += other.SumSq
+}
+
+func (a *Aggregator) Value(op string) float64 {
+	if a.Count == 0 {
+		return math.NaN()
+	}
+	switch op {
+	case "sum":
+		return a.Sum
+	case "avg":
+		return a.Sum / float64(a.Count)
+	case "min":
+		return a.Min
+	case "max":
+		return a.Max
+	case "count":
+		return float64(a.Count)
+	case "first":
+		return a.First
+	case "last":
+		return a.Last
+	case "stddev":
+		mean := a.Sum / float64(a.Count)
+		// из-за округления дисперсия может получиться чуть меньше нуля
+		return math.Sqrt(math.Max(0, a.SumSq/float64(a.Count)-mean*mean))
+	}
+	return math.NaN()
+}
+
+func validateAggregation(query types.Query) error {
+	if query.Aggregation == "" {
+		if len(query.GroupBy) > 0 {
+			return fmt.Errorf("%w: group_by requires agg", types.ErrInvalidQuery)
+		}
+		return nil
+	}
+	if !aggregations[query.Aggregation] {
+		return fmt.Errorf("%w: unknown aggregation %q", types.ErrInvalidQuery, query.Aggregation)
+	}
+	return nil
+}
+
+// aggregateSeries - сливает ряды в один ряд на группу GroupBy. Точки разных рядов
+// объединяются по совпадающим таймстемпам
+func aggregateSeries(query types.Query, series []types.SeriesData) []types.SeriesData {
+	type group struct {
+		tags   map[string]string
+		points map[int64]*Aggregator
+	}
+	groups := make(map[string]*group)
+
+	for _, data := range series {
+		tags := make(map[string]string, len(query.GroupBy))
+		for _, key := range query.GroupBy {
+			if value, ok := data.SeriesID.Tags[key]; ok {
+				tags[key] = value
+			}
+		}
+
+		key := groupKey(tags)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{tags: tags, points: make(map[int64]*Aggregator)}
+			groups[key] = g
+		}
+
+		for _, point := range DedupPoints(data.Points) {
+			acc, ok := g.points[point.Timestamp]
+			if !ok {
+				acc = &Aggregator{}
+				g.points[point.Timestamp] = acc
+			}
+			// пустые окна после fill=null в агрегат не входят
+			if !math.IsNaN(point.Value) {
+				acc.Add(point.Value)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]types.SeriesData, 0, len(groups))
+	for _, key := range keys {
+		g := groups[key]
+
+		points := make([]types.Point, 0, len(g.points))
+		for ts, acc := range g.points {
+			points = append(points, types.Point{Timestamp: ts, Value: acc.Value(query.Aggregation)})
+		}
+		sort.Slice(points, func(i, j int) bool {
+			return points[i].Timestamp < points[j].Timestamp
+		})
+
+		result = append(result, types.SeriesData{
+			SeriesID: types.SeriesIdentifier{Metric: query.Metric, Tags: g.tags},
+			Points:   points,
+		})
+	}
+
+	return result
+}
+
+func groupKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(tags[k])
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// DedupPoints - точки по возрастанию времени, из точек с одинаковым таймстемпом остается последняя записанная
+func DedupPoints(points []types.Point) []types.Point {
+	sorted := make([]types.Point, len(points))
+	copy(sorted, points)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+
+	result := sorted[:0]
+	for _, p := range sorted {
+		if n := len(result); n > 0 && result[n-1].Timestamp == p.Timestamp {
+			result[n-1] = p
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
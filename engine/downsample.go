@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"tsdb/storage"
+	"tsdb/types"
+)
+
+// DefaultWindowAgg - функция окна, если задан только step
+const DefaultWindowAgg = "avg"
+
+var windowAggregations = map[string]bool{
+	"avg": true, "min": true, "max": true, "first": true, "last": true, "sum": true, "count": true, "stddev": true,
+}
+
+// headerWindowAggregations - функции окна, которые считаются по заголовкам блоков
+var headerWindowAggregations = map[string]bool{
+	"avg": true, "min": true, "max": true, "sum": true, "count": true, "stddev": true,
+}
+
+func validateDownsampling(query types.Query) error {
+	if query.Step < 0 {
+		return fmt.Errorf("%w: step must be positive", types.ErrInvalidQuery)
+	}
+	if query.Step == 0 {
+		if query.WindowAgg != "" {
+			return fmt.Errorf("%w: window_agg requires step", types.ErrInvalidQuery)
+		}
+		return nil
+	}
+	if query.WindowAgg != "" && !windowAggregations[query.WindowAgg] {
+		return fmt.Errorf("%w: unknown window_agg %q", types.ErrInvalidQuery, query.WindowAgg)
+	}
+	return nil
+}
+
+// downsample - сворачивает точки в окна [k*step, (k+1)*step), выровненные по step от нуля.
+// Точка окна ставится на его начало, пустые окна пропускаются
+func downsample(points []types.Point, step int64, op string) []types.Point {
+	if op == "" {
+		op = DefaultWindowAgg
+	}
+
+	var (
+		result []types.Point
+		acc    Aggregator
+		window int64
+	)
+	for _, point := range DedupPoints(points) {
+		start := WindowStart(point.Timestamp, step)
+		if acc.Count > 0 && start != window {
+			result = append(result, types.Point{Timestamp: window, Value: acc.Value(op)})
+			acc = Aggregator{}
+		}
+		window = start
+		acc.Add(point.Value)
+	}
+	if acc.Count > 0 {
+		result = append(result, types.Point{Timestamp: window, Value: acc.Value(op)})
+	}
+
+	return result
+}
+
+// WindowStart - начало окна с округлением вниз и для отрицательных таймстемпов
+func WindowStart(ts, step int64) int64 {
+	start := ts - ts%step
+	if ts < 0 && start != ts {
+		start -= step
+	}
+	return start
+}
+
+// readDownsampled - downsample без распаковки блоков, которые целиком лежат в одном окне:
+// они учитываются по Sum/SumSq/MinValue/MaxValue заголовка. Распаковываются только блоки
+// на границах окон и диапазона. Только для рядов без повторов таймстемпов: заголовок про повторы
+// ничего не знает, а downsample их схлопывает
+func (e *TSDBEngine) readDownsampled(ctx context.Context, seriesID types.SeriesIdentifier, query types.Query) ([]types.Point, storage.ReadStats, error) {
+	metadata, exists := e.indexManager.GetSeries(seriesID)
+	if !exists {
+		log.Printf("Series not found in index: %s %v", seriesID.Metric, seriesID.Tags)
+		return nil, storage.ReadStats{}, nil
+	}
+
+	windows := make(map[int64]*Aggregator)
+	window := func(ts int64) *Aggregator {
+		start := WindowStart(ts, query.Step)
+		acc, ok := windows[start]
+		if !ok {
+			acc = &Aggregator{}
+			windows[start] = acc
+		}
+		return acc
+	}
+
+	stats, err := e.fileManager.ScanBlocks(ctx, metadata.FilePath, storage.BlockScan{
+		StartTime: query.TimeRange.Start,
+		EndTime:   query.TimeRange.End,
+		Filter:    query.ValueFilter,
+		UseHeader: func(header types.BlockHeader) bool {
+			if WindowStart(header.StartTime, query.Step) != WindowStart(header.EndTime, query.Step) {
+				return false
+			}
+			window(header.StartTime).Merge(Aggregator{
+				Count: int64(header.PointCount),
+				Sum:   header.Sum,
+				SumSq: header.SumSq,
+				Min:   header.MinValue,
+				Max:   header.MaxValue,
+			})
+			return true
+		},
+		Points: func(points []types.Point) error {
+			for _, point := range points {
+				window(point.Timestamp).Add(point.Value)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+	log.Printf("Series %s: %d blocks from headers, %d decompressed", seriesID.Metric, stats.BlocksFromHeader, stats.BlocksRead)
+
+	op := query.WindowAgg
+	if op == "" {
+		op = DefaultWindowAgg
+	}
+
+	points := make([]types.Point, 0, len(windows))
+	for start, acc := range windows {
+		points = append(points, types.Point{Timestamp: start, Value: acc.Value(op)})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Timestamp < points[j].Timestamp
+	})
+
+	return points, stats, nil
+}
@@ -1,11 +1,14 @@
 package engine
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 	"tsdb/index"
 	"tsdb/storage"
 	"tsdb/types"
@@ -21,6 +24,12 @@ type TSDBEngine struct {
 	activeWriters map[string]*SeriesWriter
 	writersMutex  sync.RWMutex
 	initialized   bool
+	// walMutex - под ним inflight, номера записей WAL, чьи точки еще не в файлах рядов
+	walMutex sync.Mutex
+	inflight map[uint64]bool
+
+	// Limits - ограничения запросов на чтение, задаются до того, как движок начнет их обслуживать
+	Limits QueryLimits
 }
 
 func NewTSDBEngine(dataDir string, blockSize int) (*TSDBEngine, error) {
@@ -40,10 +49,7 @@ func NewTSDBEngine(dataDir string, blockSize int) (*TSDBEngine, error) {
 		wal:           wal,
 		blockSize:     blockSize,
 		activeWriters: make(map[string]*SeriesWriter),
-	}
-
-	if err := engine.recoverFromWAL(); err != nil {
-		return nil, err
+		inflight:      make(map[uint64]bool),
 	}
 
 	if err := engine.indexManager.Load(); err != nil && !os.IsNotExist(err) {
@@ -54,7 +60,18 @@ func NewTSDBEngine(dataDir string, blockSize int) (*TSDBEngine, error) {
 		return nil, err
 	}
 
-	log.Printf("TSDB initialized. Series in index: %d", len(engine.indexManager.GetAllSeries()))
+	// WAL применяется через восстановленных писателей, чтобы метаданные рядов в индексе учли его точки
+	if err := engine.recoverFromWAL(); err != nil {
+		return nil, err
+	}
+	if err := engine.indexManager.Save(); err != nil {
+		return nil, err
+	}
+	if err := engine.wal.Checkpoint(engine.wal.LastLSN()); err != nil {
+		return nil, err
+	}
+
+	log.Printf("TSDB initialized. Series in index: %d", engine.indexManager.SeriesCount())
 	engine.initialized = true
 	return engine, nil
 }
@@ -62,11 +79,29 @@ func NewTSDBEngine(dataDir string, blockSize int) (*TSDBEngine, error) {
 func (e *TSDBEngine) Write(request types.WriteRequest) error {
 	log.Printf("Writing %d series", len(request.Series))
 
+	if err := validateWrite(request); err != nil {
+		return err
+	}
+
 	walData := types.WriteData{Series: request.Series}
-	if err := e.wal.Write("write", walData); err != nil {
+	e.walMutex.Lock()
+	lsn, err := e.wal.Write("write", walData)
+	if err == nil {
+		e.inflight[lsn] = true
+	}
+	e.walMutex.Unlock()
+	if err != nil {
 		return err
 	}
 
+	// неудачная запись тоже перестает держать контрольную точку, иначе WAL рос бы без конца
+	applied := false
+	defer func() {
+		if !applied {
+			e.applyWrite(lsn)
+		}
+	}()
+
 	for _, seriesData := range request.Series {
 		seriesHash := e.indexManager.HashSeries(seriesData.SeriesID)
 
@@ -92,32 +127,122 @@ func (e *TSDBEngine) Write(request types.WriteRequest) error {
 		e.writersMutex.Unlock()
 	}
 
-	if err := e.indexManager.Save(); err != nil {
+	// все записи до checkpoint уже в файлах рядов, сохраненный ниже индекс их учитывает
+	checkpoint := e.applyWrite(lsn)
+	applied = true
+
+	// метаданные рядов меняются писателями, поэтому индекс сохраняется под их мьютексом
+	e.writersMutex.RLock()
+	err = e.indexManager.Save()
+	e.writersMutex.RUnlock()
+	if err != nil {
 		log.Printf("Failed to save index: %v", err)
+		return nil
+	}
+
+	// после контрольной точки при старте эти записи не применятся второй раз
+	if err := e.wal.Checkpoint(checkpoint); err != nil {
+		log.Printf("Failed to checkpoint WAL: %v", err)
+	}
+	return nil
+}
+
+// applyWrite - точки записи lsn уже в файлах рядов. Возвращает номер, до которого
+// в файлах лежат все записи WAL: он не доходит до самой старой незавершенной записи
+func (e *TSDBEngine) applyWrite(lsn uint64) uint64 {
+	e.walMutex.Lock()
+	defer e.walMutex.Unlock()
+
+	delete(e.inflight, lsn)
+	checkpoint := e.wal.LastLSN()
+	for pending := range e.inflight {
+		checkpoint = min(checkpoint, pending-1)
 	}
+	return checkpoint
+}
 
+// validateWrite - запрос с несохраняемым значением отклоняется целиком до записи, а не падает на ней
+func validateWrite(request types.WriteRequest) error {
+	for _, series := range request.Series {
+		for _, point := range series.Points {
+			if !types.IsFinite(point.Value) {
+				return fmt.Errorf("%w: non-finite value %v in %s at %d", types.ErrInvalidWrite, point.Value, series.SeriesID.Metric, point.Timestamp)
+			}
+		}
+	}
 	return nil
 }
 
-func (e *TSDBEngine) Read(query types.Query) (types.QueryResult, error) {
-	log.Printf("Query: metric=%s, tags=%v, start=%d, end=%d",
-		query.Metric, query.Tags, query.TimeRange.Start, query.TimeRange.End)
+func (e *TSDBEngine) Read(ctx context.Context, query types.Query) (types.QueryResult, error) {
+	log.Printf("Query: metric=%s, tags=%v, matchers=%v, start=%d, end=%d, step=%d, window_agg=%s, fn=%s, window=%d, fill=%s, max_gap=%d, agg=%s, group_by=%v, topk=%d, bottomk=%d, rank_by=%s",
+		query.Metric, query.Tags, query.Matchers, query.TimeRange.Start, query.TimeRange.End,
+		query.Step, query.WindowAgg, query.Function, query.Window, query.Fill, query.MaxGap, query.Aggregation, query.GroupBy, query.TopK, query.BottomK, query.RankBy)
 
-	seriesList := e.FindSeries(query.Metric, query.Tags)
+	if err := validateFunction(query); err != nil {
+		return types.QueryResult{}, err
+	}
+	if err := validateDownsampling(query); err != nil {
+		return types.QueryResult{}, err
+	}
+	if err := validateFill(query); err != nil {
+		return types.QueryResult{}, err
+	}
+	if err := validateAggregation(query); err != nil {
+		return types.QueryResult{}, err
+	}
+	if err := validateRank(query); err != nil {
+		return types.QueryResult{}, err
+	}
+
+	seriesList, err := e.findSeriesForQuery(query)
+	if err != nil {
+		return types.QueryResult{}, err
+	}
 	log.Printf("Found %d series matching the query", len(seriesList))
 
+	budget := &pointBudget{limit: e.Limits.MaxPoints}
+	if query.TopK > 0 || query.BottomK > 0 {
+		if seriesList, err = e.rankSeries(ctx, seriesList, query, budget); err != nil {
+			return types.QueryResult{}, err
+		}
+	}
+	if err := e.Limits.checkSeries(len(seriesList)); err != nil {
+		return types.QueryResult{}, err
+	}
+
 	result := types.QueryResult{
 		Series: make([]types.SeriesData, 0, len(seriesList)),
 	}
 
 	for i, seriesID := range seriesList {
 		log.Printf("Reading series %d: %s %v", i, seriesID.Metric, seriesID.Tags)
-		points, err := e.readPointsFromSeries(seriesID, query.TimeRange.Start, query.TimeRange.End)
+		if query.Function == "" && query.Step > 0 && (query.WindowAgg == "" || headerWindowAggregations[query.WindowAgg]) && e.hasUniqueTimestamps(seriesID) {
+			points, stats, err := e.readDownsampled(ctx, seriesID, query)
+			if err != nil {
+				return result, err
+			}
+			if err := budget.take(len(points)); err != nil {
+				return result, err
+			}
+			result.BlocksSkipped += stats.BlocksSkipped
+			if len(points) > 0 {
+				result.Series = append(result.Series, types.SeriesData{SeriesID: seriesID, Points: points})
+			}
+			continue
+		}
+
+		points, stats, err := e.readPointsFromSeries(ctx, seriesID, readStart(query), query.TimeRange.End, query.ValueFilter, budget)
 		if err != nil {
 			return result, err
 		}
+		result.BlocksSkipped += stats.BlocksSkipped
 
 		log.Printf("Series %d has %d points", i, len(points))
+		if query.Function != "" {
+			points = applyFunction(query, points)
+		} else if query.Step > 0 {
+			points = downsample(points, query.Step, query.WindowAgg)
+		}
 		if len(points) > 0 {
 			result.Series = append(result.Series, types.SeriesData{
 				SeriesID: seriesID,
@@ -126,7 +251,48 @@ func (e *TSDBEngine) Read(query types.Query) (types.QueryResult, error) {
 		}
 	}
 
-	log.Printf("Query result: %d series with data", len(result.Series))
+	if query.Fill != "" && query.Fill != "none" {
+		if err := fillSeries(query, result.Series); err != nil {
+			return types.QueryResult{}, err
+		}
+	}
+
+	if query.Aggregation != "" {
+		result.Series = aggregateSeries(query, result.Series)
+	}
+
+	log.Printf("Query result: %d series with data, %d blocks skipped by value filter", len(result.Series), result.BlocksSkipped)
+	return result, nil
+}
+
+// LastPoints - последняя точка каждого подходящего ряда из кэша писателей, файлы не читаются.
+// TimeRange, шаги и агрегации запроса не учитываются
+func (e *TSDBEngine) LastPoints(query types.Query) (types.QueryResult, error) {
+	seriesList, err := e.findSeriesForQuery(query)
+	if err != nil {
+		return types.QueryResult{}, err
+	}
+
+	result := types.QueryResult{
+		Series: make([]types.SeriesData, 0, len(seriesList)),
+	}
+
+	e.writersMutex.RLock()
+	defer e.writersMutex.RUnlock()
+
+	for _, seriesID := range seriesList {
+		writer, exists := e.activeWriters[e.indexManager.HashSeries(seriesID)]
+		if !exists {
+			continue
+		}
+		if point, ok := writer.LastPoint(); ok {
+			result.Series = append(result.Series, types.SeriesData{
+				SeriesID: seriesID,
+				Points:   []types.Point{point},
+			})
+		}
+	}
+
 	return result, nil
 }
 
@@ -134,6 +300,32 @@ func (e *TSDBEngine) FindSeries(metric string, tags map[string]string) []types.S
 	return e.indexManager.FindSeries(metric, tags)
 }
 
+// findSeriesForQuery - Metric и Tags сводятся к условиям равенства, если в запросе есть Matchers
+func (e *TSDBEngine) findSeriesForQuery(query types.Query) ([]types.SeriesIdentifier, error) {
+	if len(query.Matchers) == 0 {
+		return e.FindSeries(query.Metric, query.Tags), nil
+	}
+
+	matchers := make([]types.LabelMatcher, 0, len(query.Matchers)+len(query.Tags)+1)
+	if query.Metric != "" {
+		matchers = append(matchers, types.LabelMatcher{Type: types.MatchEqual, Name: types.MetricNameLabel, Value: query.Metric})
+	}
+	for key, value := range query.Tags {
+		if value == "*" {
+			matchers = append(matchers, types.LabelMatcher{Type: types.MatchRegexp, Name: key, Value: ".+"})
+		} else {
+			matchers = append(matchers, types.LabelMatcher{Type: types.MatchEqual, Name: key, Value: value})
+		}
+	}
+	matchers = append(matchers, query.Matchers...)
+
+	seriesList, err := e.indexManager.FindSeriesByMatchers(matchers)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", types.ErrInvalidQuery, err)
+	}
+	return seriesList, nil
+}
+
 func (e *TSDBEngine) Flush() error {
 	e.writersMutex.Lock()
 	defer e.writersMutex.Unlock()
@@ -213,22 +405,48 @@ func (e *TSDBEngine) createNewSeries(seriesID types.SeriesIdentifier) (*types.Se
 	}
 
 	metadata := &types.SeriesMetadata{
-		SeriesID: seriesID,
-		FilePath: filePath,
+		SeriesID:         seriesID,
+		FilePath:         filePath,
+		CreatedAt:        time.Now().UnixNano(),
+		UniqueTimestamps: true,
 	}
 
 	return metadata, file, nil
 }
 
-func (e *TSDBEngine) readPointsFromSeries(seriesID types.SeriesIdentifier, start, end int64) ([]types.Point, error) {
+// hasUniqueTimestamps - при повторах таймстемпов downsample оставляет последнюю записанную точку,
+// а заголовки блоков учитывают все, поэтому такие ряды сворачиваются только по точкам
+func (e *TSDBEngine) hasUniqueTimestamps(seriesID types.SeriesIdentifier) bool {
+	metadata, exists := e.indexManager.GetSeries(seriesID)
+	return exists && metadata.UniqueTimestamps
+}
+
+// readPointsFromSeries - прочитанные точки списываются с budget, чтение прерывается, как только он исчерпан
+func (e *TSDBEngine) readPointsFromSeries(ctx context.Context, seriesID types.SeriesIdentifier, start, end int64, filter *types.ValueFilter, budget *pointBudget) ([]types.Point, storage.ReadStats, error) {
 	metadata, exists := e.indexManager.GetSeries(seriesID)
 	if !exists {
 		log.Printf("Series not found in index: %s %v", seriesID.Metric, seriesID.Tags)
-		return nil, nil
+		return nil, storage.ReadStats{}, nil
 	}
 
 	log.Printf("Reading points for series: %s, file: %s", seriesID.Metric, metadata.FilePath)
-	return e.fileManager.ReadPointsFromFile(metadata.FilePath, start, end)
+	var result []types.Point
+	stats, err := e.fileManager.ScanBlocks(ctx, metadata.FilePath, storage.BlockScan{
+		StartTime: start,
+		EndTime:   end,
+		Filter:    filter,
+		Points: func(points []types.Point) error {
+			if err := budget.take(len(points)); err != nil {
+				return err
+			}
+			result = append(result, points...)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+	return result, stats, nil
 }
 
 func (e *TSDBEngine) restoreWriters() error {
@@ -253,6 +471,9 @@ func (e *TSDBEngine) restoreWriters() error {
 		metadata.FilePath = filePath
 
 		writer := NewSeriesWriter(metadata, file, e.blockSize)
+		if err := writer.restoreLastPoint(); err != nil {
+			log.Printf("Warning: could not restore last point of %s: %v", filePath, err)
+		}
 		e.activeWriters[seriesHash] = writer
 	}
 
@@ -264,5 +485,32 @@ func (e *TSDBEngine) GetAllSeries() map[string]*types.SeriesMetadata {
 }
 
 func (e *TSDBEngine) GetSeriesCount() int {
-	return len(e.indexManager.GetAllSeries())
+	return e.indexManager.SeriesCount()
+}
+
+// LabelNames - времена рядов в метаданных меняются писателями, поэтому справочник строится под их мьютексом
+func (e *TSDBEngine) LabelNames(filter index.LabelFilter) ([]string, error) {
+	e.writersMutex.RLock()
+	defer e.writersMutex.RUnlock()
+
+	names, err := e.indexManager.LabelNames(filter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", types.ErrInvalidQuery, err)
+	}
+	return names, nil
+}
+
+func (e *TSDBEngine) LabelValues(name string, filter index.LabelFilter) ([]string, error) {
+	e.writersMutex.RLock()
+	defer e.writersMutex.RUnlock()
+
+	values, err := e.indexManager.LabelValues(name, filter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", types.ErrInvalidQuery, err)
+	}
+	return values, nil
+}
+
+func (e *TSDBEngine) Cardinality(limit int, since int64) index.CardinalityStats {
+	return e.indexManager.Cardinality(limit, since)
 }
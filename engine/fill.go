@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"tsdb/types"
+)
+
+// MaxFillBuckets - больше окон на ряд при заполнении пропусков не выдается
+const MaxFillBuckets = 11000
+
+var fillModes = map[string]bool{
+	"none": true, "null": true, "previous": true, "linear": true, "zero": true,
+}
+
+func validateFill(query types.Query) error {
+	if query.Fill == "" || query.Fill == "none" {
+		if query.MaxGap != 0 {
+			return fmt.Errorf("%w: max_gap requires fill", types.ErrInvalidQuery)
+		}
+		return nil
+	}
+	if !fillModes[query.Fill] {
+		return fmt.Errorf("%w: unknown fill %q", types.ErrInvalidQuery, query.Fill)
+	}
+	if query.Step <= 0 {
+		return fmt.Errorf("%w: fill requires step", types.ErrInvalidQuery)
+	}
+	if query.MaxGap < 0 {
+		return fmt.Errorf("%w: max_gap must not be negative", types.ErrInvalidQuery)
+	}
+	return nil
+}
+
+// fillSeries - дополняет ряды до точки в каждом окне step. Сетка окон - диапазон запроса, а если
+// в нем больше MaxFillBuckets окон - промежуток от первой до последней точки всех рядов.
+// Пустое значение (fill=null или пропуск длиннее MaxGap) - NaN
+func fillSeries(query types.Query, series []types.SeriesData) error {
+	if len(series) == 0 {
+		return nil
+	}
+
+	first := WindowStart(query.TimeRange.Start, query.Step)
+	if query.Function != "" {
+		// функции считаются в узлах сетки не раньше начала запроса
+		first = alignUp(query.TimeRange.Start, query.Step)
+	}
+	last := WindowStart(query.TimeRange.End, query.Step)
+
+	if bucketCount(first, last, query.Step) > MaxFillBuckets {
+		first, last = math.MaxInt64, math.MinInt64
+		for _, data := range series {
+			first = min(first, data.Points[0].Timestamp)
+			last = max(last, data.Points[len(data.Points)-1].Timestamp)
+		}
+		if bucketCount(first, last, query.Step) > MaxFillBuckets {
+			return fmt.Errorf("%w: fill would produce more than %d points per series, increase step", types.ErrInvalidQuery, MaxFillBuckets)
+		}
+	}
+
+	for i := range series {
+		series[i].Points = fillPoints(series[i].Points, first, last, query.Step, query.Fill, query.MaxGap)
+	}
+	return nil
+}
+
+// bucketCount - число окон от first до last включительно, с защитой от переполнения
+func bucketCount(first, last, step int64) uint64 {
+	if last < first {
+		return 0
+	}
+	return (uint64(last)-uint64(first))/uint64(step) + 1
+}
+
+// fillPoints - points отсортированы и лежат в узлах сетки step. previous и linear не тянут
+// значение через пропуск длиннее maxGap (0 - без ограничения). Сетка пустая, если first > last
+func fillPoints(points []types.Point, first, last, step int64, mode string, maxGap int64) []types.Point {
+	if first > last {
+		return nil
+	}
+
+	result := make([]types.Point, 0, bucketCount(first, last, step))
+	within := func(gap int64) bool {
+		return maxGap == 0 || gap <= maxGap
+	}
+
+	next := 0
+	for t := first; ; t += step {
+		for next < len(points) && points[next].Timestamp < t {
+			next++
+		}
+
+		if next < len(points) && points[next].Timestamp == t {
+			result = append(result, points[next])
+		} else {
+			value := math.NaN()
+			switch mode {
+			case "zero":
+				value = 0
+			case "previous":
+				if next > 0 && within(t-points[next-1].Timestamp) {
+					value = points[next-1].Value
+				}
+			case "linear":
+				if next > 0 && next < len(points) && within(points[next].Timestamp-points[next-1].Timestamp) {
+					prev, following := points[next-1], points[next]
+					ratio := float64(t-prev.Timestamp) / float64(following.Timestamp-prev.Timestamp)
+					value = prev.Value + (following.Value-prev.Value)*ratio
+				}
+			}
+			result = append(result, types.Point{Timestamp: t, Value: value})
+		}
+
+		// t+step дальше last или не помещается в int64 (end по умолчанию - MaxInt64)
+		if uint64(last)-uint64(t) < uint64(step) {
+			break
+		}
+	}
+
+	return result
+}
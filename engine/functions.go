@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"tsdb/promql"
+	"tsdb/types"
+)
+
+var rangeFunctions = map[string]bool{
+	"rate": true, "irate": true, "increase": true, "delta": true, "derivative": true,
+}
+
+func validateFunction(query types.Query) error {
+	if query.Function == "" {
+		if query.Window != 0 {
+			return fmt.Errorf("%w: window requires fn", types.ErrInvalidQuery)
+		}
+		return nil
+	}
+	if !rangeFunctions[query.Function] {
+		return fmt.Errorf("%w: unknown fn %q", types.ErrInvalidQuery, query.Function)
+	}
+	if query.Window <= 0 {
+		return fmt.Errorf("%w: fn requires a positive window", types.ErrInvalidQuery)
+	}
+	if query.WindowAgg != "" {
+		return fmt.Errorf("%w: window_agg cannot be combined with fn", types.ErrInvalidQuery)
+	}
+	return nil
+}
+
+// readStart - функциям нужны точки за window до начала запроса, чтобы первые окна были полными
+func readStart(query types.Query) int64 {
+	if query.Function == "" {
+		return query.TimeRange.Start
+	}
+	if query.TimeRange.Start < math.MinInt64+query.Window {
+		return math.MinInt64
+	}
+	return query.TimeRange.Start - query.Window
+}
+
+// applyFunction - значение функции по окну (t-window, t] в каждой точке ряда из диапазона
+// запроса, а если задан step - в узлах сетки step. Окна, где функцию не посчитать, пропускаются
+func applyFunction(query types.Query, points []types.Point) []types.Point {
+	points = DedupPoints(points)
+	if len(points) == 0 {
+		return nil
+	}
+
+	var result []types.Point
+	// окно - points[lo:hi]
+	lo, hi := 0, 0
+	eval := func(t int64) {
+		for hi < len(points) && points[hi].Timestamp <= t {
+			hi++
+		}
+		for lo < hi && points[lo].Timestamp <= t-query.Window {
+			lo++
+		}
+		if v, ok := evalFunction(query.Function, points[lo:hi], t-query.Window, t); ok {
+			result = append(result, types.Point{Timestamp: t, Value: v})
+		}
+	}
+
+	if query.Step <= 0 {
+		for _, point := range points {
+			if point.Timestamp >= query.TimeRange.Start && point.Timestamp <= query.TimeRange.End {
+				eval(point.Timestamp)
+			}
+		}
+		return result
+	}
+
+	// после последней точки окна еще window непустые
+	last := points[len(points)-1].Timestamp
+	end := query.TimeRange.End
+	if last <= math.MaxInt64-query.Window && last+query.Window < end {
+		end = last + query.Window
+	}
+
+	t := alignUp(max(query.TimeRange.Start, points[0].Timestamp), query.Step)
+	for t <= end {
+		eval(t)
+		if lo == hi {
+			if hi == len(points) {
+				break
+			}
+			// пустые окна на длинных пропусках в данных не перебираем
+			if next := alignUp(points[hi].Timestamp, query.Step); next > t {
+				t = next
+				continue
+			}
+		}
+		if t > end-query.Step {
+			break
+		}
+		t += query.Step
+	}
+
+	return result
+}
+
+func evalFunction(fn string, points []types.Point, rangeStart, rangeEnd int64) (float64, bool) {
+	switch fn {
+	case "rate":
+		return promql.ExtrapolatedRate(points, rangeStart, rangeEnd, true, true)
+	case "increase":
+		return promql.ExtrapolatedRate(points, rangeStart, rangeEnd, true, false)
+	case "delta":
+		return promql.ExtrapolatedRate(points, rangeStart, rangeEnd, false, false)
+	case "irate":
+		return promql.InstantValue(points, true)
+	case "derivative":
+		return derivative(points)
+	}
+	return 0, false
+}
+
+// derivative - наклон прямой МНК в единицах в секунду, как deriv в Prometheus.
+// Время отсчитывается от первой точки, чтобы не терять точность на больших таймстемпах
+func derivative(points []types.Point) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	var sumX, sumY, sumXY, sumX2 float64
+	for _, p := range points {
+		x := float64(p.Timestamp-points[0].Timestamp) / 1e9
+		sumX += x
+		sumY += p.Value
+		sumXY += x * p.Value
+		sumX2 += x * x
+	}
+
+	n := float64(len(points))
+	return (n*sumXY - sumX*sumY) / (n*sumX2 - sumX*sumX), true
+}
+
+// alignUp - ближайший узел сетки step не раньше ts
+func alignUp(ts, step int64) int64 {
+	start := WindowStart(ts, step)
+	if start < ts {
+		start += step
+	}
+	return start
+}
@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"fmt"
+	"tsdb/types"
+)
+
+// QueryLimits - ограничения одного запроса на чтение, 0 - без ограничения.
+// MaxSeries проверяется после выбора рядов (и после topk/bottomk), MaxPoints - по мере чтения:
+// считаются точки, которые запрос держит в памяти, то есть прочитанные из файлов и окна step,
+// посчитанные по заголовкам блоков
+type QueryLimits struct {
+	MaxSeries int
+	MaxPoints int
+}
+
+func (l QueryLimits) checkSeries(count int) error {
+	if l.MaxSeries > 0 && count > l.MaxSeries {
+		return fmt.Errorf("%w: query matches %d series, the limit is %d; narrow the tag filters or use topk",
+			types.ErrLimitExceeded, count, l.MaxSeries)
+	}
+	return nil
+}
+
+// pointBudget - сколько точек запрос уже загрузил, общий для всех его рядов
+type pointBudget struct {
+	limit int
+	used  int
+}
+
+func (b *pointBudget) take(count int) error {
+	b.used += count
+	if b.limit > 0 && b.used > b.limit {
+		return fmt.Errorf("%w: query loads more than %d points; narrow the time range or use a larger step",
+			types.ErrLimitExceeded, b.limit)
+	}
+	return nil
+}
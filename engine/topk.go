@@ -0,0 +1,359 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"tsdb/storage"
+	"tsdb/types"
+)
+
+// DefaultRankBy - чем ранжируются ряды в topk/bottomk, если rank_by не задан
+const DefaultRankBy = "max"
+
+var rankReducers = map[string]bool{
+	"max": true, "min": true, "avg": true, "sum": true, "last": true,
+}
+
+func validateRank(query types.Query) error {
+	if query.TopK == 0 && query.BottomK == 0 {
+		if query.RankBy != "" {
+			return fmt.Errorf("%w: rank_by requires topk or bottomk", types.ErrInvalidQuery)
+		}
+		return nil
+	}
+	if query.TopK < 0 || query.BottomK < 0 {
+		return fmt.Errorf("%w: topk and bottomk must be positive", types.ErrInvalidQuery)
+	}
+	if query.TopK > 0 && query.BottomK > 0 {
+		return fmt.Errorf("%w: topk and bottomk cannot be combined", types.ErrInvalidQuery)
+	}
+	if query.RankBy != "" && !rankReducers[query.RankBy] {
+		return fmt.Errorf("%w: unknown rank_by %q", types.ErrInvalidQuery, query.RankBy)
+	}
+	if query.Function != "" || query.Aggregation != "" {
+		return fmt.Errorf("%w: topk and bottomk cannot be combined with fn or agg", types.ErrInvalidQuery)
+	}
+	return nil
+}
+
+// valueSummary - что известно о точках без распаковки: по метаданным ряда или заголовку блока
+type valueSummary struct {
+	start, end int64
+	count      int64
+	min, max   float64
+	sum        float64
+	hasSum     bool
+}
+
+// rankCandidate - ряд и границы его оценки [lo, hi]. Оценка - значение reducer для topk
+// и оно же со знаком минус для bottomk, так что лучшие ряды всегда с наибольшей оценкой.
+// certain - в диапазоне точно есть точки, exact - lo == hi и это точное значение.
+// coveredEnd - конец последнего блока, целиком лежащего в диапазоне: раньше него last не бывает
+type rankCandidate struct {
+	seriesID types.SeriesIdentifier
+	// key - ключ ряда в индексе, по нему упорядочиваются ряды с равными значениями
+	key        string
+	metadata   *types.SeriesMetadata
+	lo, hi     float64
+	certain    bool
+	exact      bool
+	coveredEnd int64
+}
+
+// rankSeries - k рядов с наибольшим (bottomk - наименьшим) значением RankBy, по месту в рейтинге.
+// Ряд выбывает, если даже его лучшая возможная оценка хуже порога, который уже гарантирован
+// k другими рядами. Границы сначала берутся из метаданных рядов, потом из заголовков блоков,
+// и только оставшиеся ряды читаются - с распаковкой лишь тех блоков, что попадают в диапазон частично
+func (e *TSDBEngine) rankSeries(ctx context.Context, seriesList []types.SeriesIdentifier, query types.Query, budget *pointBudget) ([]types.SeriesIdentifier, error) {
+	k, sign := query.TopK, 1.0
+	if query.BottomK > 0 {
+		k, sign = query.BottomK, -1
+	}
+	reducer := query.RankBy
+	if reducer == "" {
+		reducer = DefaultRankBy
+	}
+
+	candidates := make([]*rankCandidate, 0, len(seriesList))
+	for _, seriesID := range seriesList {
+		metadata, exists := e.indexManager.GetSeries(seriesID)
+		if !exists {
+			continue
+		}
+		candidate := &rankCandidate{seriesID: seriesID, key: e.indexManager.HashSeries(seriesID), metadata: metadata}
+		summary := valueSummary{
+			start: metadata.StartTime,
+			end:   metadata.EndTime,
+			count: metadata.TotalPoints,
+			min:   metadata.MinValue,
+			max:   metadata.MaxValue,
+		}
+		if candidate.bound(reducer, []valueSummary{summary}, query, sign) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	candidates = pruneCandidates(candidates, k)
+	afterMetadata := len(candidates)
+
+	remaining := candidates[:0]
+	for _, candidate := range candidates {
+		if candidate.exact {
+			remaining = append(remaining, candidate)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		headers, hasSums, err := e.fileManager.ReadBlockHeaders(candidate.metadata.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		summaries := make([]valueSummary, len(headers))
+		for i, header := range headers {
+			summaries[i] = valueSummary{
+				start:  header.StartTime,
+				end:    header.EndTime,
+				count:  int64(header.PointCount),
+				min:    header.MinValue,
+				max:    header.MaxValue,
+				sum:    header.Sum,
+				hasSum: hasSums,
+			}
+		}
+		if candidate.bound(reducer, summaries, query, sign) {
+			remaining = append(remaining, candidate)
+		}
+	}
+	candidates = pruneCandidates(remaining, k)
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].hi > candidates[j].hi
+	})
+
+	var (
+		winners []*rankCandidate
+		stats   storage.ReadStats
+		scanned int
+	)
+	for _, candidate := range candidates {
+		if len(winners) == k && candidate.hi < winners[k-1].lo {
+			break
+		}
+
+		if !candidate.exact {
+			value, ok, readStats, err := e.rankValue(ctx, candidate, reducer, query, budget)
+			if err != nil {
+				return nil, err
+			}
+			scanned++
+			stats.BlocksRead += readStats.BlocksRead
+			stats.BlocksFromHeader += readStats.BlocksFromHeader
+			if !ok || math.IsNaN(value) {
+				continue
+			}
+			candidate.lo, candidate.hi = sign*value, sign*value
+		}
+
+		winners = append(winners, candidate)
+		sort.SliceStable(winners, func(i, j int) bool {
+			if winners[i].lo != winners[j].lo {
+				return winners[i].lo > winners[j].lo
+			}
+			return winners[i].key < winners[j].key
+		})
+		if len(winners) > k {
+			winners = winners[:k]
+		}
+	}
+
+	log.Printf("Rank %s: %d series, %d left after metadata, %d after block headers, %d scanned (%d blocks decompressed, %d from headers)",
+		reducer, len(seriesList), afterMetadata, len(candidates), scanned, stats.BlocksRead, stats.BlocksFromHeader)
+
+	result := make([]types.SeriesIdentifier, len(winners))
+	for i, winner := range winners {
+		result[i] = winner.seriesID
+	}
+	return result, nil
+}
+
+// bound - границы оценки по сводкам блоков, которые пересекают диапазон запроса. Блок,
+// целиком лежащий в диапазоне (и целиком проходящий ValueFilter), дает точные min/max/sum
+// своих точек, а частично попавший - только их пределы. false - точек в диапазоне точно нет
+func (c *rankCandidate) bound(reducer string, blocks []valueSummary, query types.Query, sign float64) bool {
+	start, end, filter := query.TimeRange.Start, query.TimeRange.End, query.ValueFilter
+
+	var overlapping []valueSummary
+	var (
+		overlapMin, overlapMax = math.Inf(1), math.Inf(-1)
+		coveredMin, coveredMax = math.Inf(1), math.Inf(-1)
+		sumLow, sumHigh        float64
+		total                  float64
+		count                  int64
+		coveredEnd             int64 = math.MinInt64
+		allCovered, allSums          = true, true
+	)
+	for _, b := range blocks {
+		if b.count == 0 || b.end < start || b.start > end || filter != nil && !filter.MayMatch(b.min, b.max) {
+			continue
+		}
+		overlapping = append(overlapping, b)
+		overlapMin, overlapMax = min(overlapMin, b.min), max(overlapMax, b.max)
+
+		// при повторах таймстемпов в счет идет только последняя записанная точка, а сводка блока
+		// учитывает все, поэтому такой блок дает только пределы
+		covered := c.metadata.UniqueTimestamps && b.start >= start && b.end <= end &&
+			(filter == nil || filter.Match(b.min) && filter.Match(b.max))
+		n := float64(b.count)
+		switch {
+		case !covered:
+			allCovered = false
+			sumLow += min(0, n*b.min)
+			sumHigh += max(0, n*b.max)
+		case b.hasSum:
+			coveredMin, coveredMax = min(coveredMin, b.min), max(coveredMax, b.max)
+			coveredEnd = max(coveredEnd, b.end)
+			sumLow += b.sum
+			sumHigh += b.sum
+			total += b.sum
+			count += b.count
+		default:
+			coveredMin, coveredMax = min(coveredMin, b.min), max(coveredMax, b.max)
+			coveredEnd = max(coveredEnd, b.end)
+			allSums = false
+			sumLow += n * b.min
+			sumHigh += n * b.max
+		}
+	}
+	if len(overlapping) == 0 {
+		return false
+	}
+	c.certain = coveredEnd != math.MinInt64
+	c.coveredEnd = coveredEnd
+
+	var low, high float64
+	exact := false
+	switch reducer {
+	case "max":
+		low, high, exact = coveredMax, overlapMax, allCovered
+	case "min":
+		low, high, exact = overlapMin, coveredMin, allCovered
+	case "avg":
+		low, high = overlapMin, overlapMax
+		if allCovered && allSums {
+			low, high, exact = total/float64(count), total/float64(count), true
+		}
+	case "sum":
+		low, high, exact = sumLow, sumHigh, allCovered && allSums
+	case "last":
+		// последняя точка не раньше конца последнего целиком попавшего блока
+		low, high = math.Inf(1), math.Inf(-1)
+		for _, b := range overlapping {
+			if b.end >= coveredEnd {
+				low, high = min(low, b.min), max(high, b.max)
+			}
+		}
+	}
+
+	c.exact = exact
+	c.lo, c.hi = low, high
+	if sign < 0 {
+		c.lo, c.hi = -high, -low
+	}
+	return true
+}
+
+// pruneCandidates - порог - k-я по величине гарантированная оценка lo среди рядов, у которых
+// точки в диапазоне точно есть. Ряды, у которых даже hi ниже порога, в рейтинг не попадут
+func pruneCandidates(candidates []*rankCandidate, k int) []*rankCandidate {
+	var lows []float64
+	for _, candidate := range candidates {
+		if candidate.certain {
+			lows = append(lows, candidate.lo)
+		}
+	}
+	if len(lows) < k {
+		return candidates
+	}
+	sort.Float64s(lows)
+	threshold := lows[len(lows)-k]
+
+	result := candidates[:0]
+	for _, candidate := range candidates {
+		if candidate.hi >= threshold {
+			result = append(result, candidate)
+		}
+	}
+	return result
+}
+
+// rankValue - точное значение reducer по точкам диапазона. Блоки, целиком лежащие в диапазоне,
+// учитываются по заголовку, а для last - пропускаются, если кончаются раньше coveredEnd.
+// Ряды с повторами таймстемпов читаются целиком, их точки списываются с budget. false - точек в диапазоне нет
+func (e *TSDBEngine) rankValue(ctx context.Context, candidate *rankCandidate, reducer string, query types.Query, budget *pointBudget) (float64, bool, storage.ReadStats, error) {
+	var (
+		acc    Aggregator
+		last   *types.Point
+		points []types.Point
+	)
+	add := func(point types.Point) {
+		acc.Add(point.Value)
+		if last == nil || point.Timestamp >= last.Timestamp {
+			p := point
+			last = &p
+		}
+	}
+	unique := candidate.metadata.UniqueTimestamps
+
+	stats, err := e.fileManager.ScanBlocks(ctx, candidate.metadata.FilePath, storage.BlockScan{
+		StartTime: query.TimeRange.Start,
+		EndTime:   query.TimeRange.End,
+		Filter:    query.ValueFilter,
+		UseHeader: func(header types.BlockHeader) bool {
+			if !unique {
+				return false
+			}
+			if reducer == "last" {
+				return header.EndTime < candidate.coveredEnd
+			}
+			acc.Merge(Aggregator{
+				Count: int64(header.PointCount),
+				Sum:   header.Sum,
+				SumSq: header.SumSq,
+				Min:   header.MinValue,
+				Max:   header.MaxValue,
+			})
+			return true
+		},
+		Points: func(block []types.Point) error {
+			if !unique {
+				if err := budget.take(len(block)); err != nil {
+					return err
+				}
+				points = append(points, block...)
+				return nil
+			}
+			for _, point := range block {
+				add(point)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, false, stats, err
+	}
+	// повторы схлопываются так же, как в downsample: остается последняя записанная точка
+	for _, point := range DedupPoints(points) {
+		add(point)
+	}
+
+	if reducer == "last" {
+		if last == nil {
+			return 0, false, stats, nil
+		}
+		return last.Value, true, stats, nil
+	}
+	return acc.Value(reducer), acc.Count > 0, stats, nil
+}
@@ -2,6 +2,8 @@ package engine
 
 import (
 	"os"
+	"slices"
+	"sort"
 	"tsdb/storage"
 	"tsdb/types"
 )
@@ -13,6 +15,8 @@ type SeriesWriter struct {
 	blockSize    int
 	blockManager *storage.BlockManager
 	fileManager  *storage.FileManager
+	// lastPoint - точка с наибольшим таймстемпом среди записанных в файл, для /query/last
+	lastPoint *types.Point
 }
 
 func NewSeriesWriter(metadata *types.SeriesMetadata, file *os.File, blockSize int) *SeriesWriter {
@@ -41,16 +45,34 @@ func (sw *SeriesWriter) Flush() error {
 		return nil
 	}
 
-	block, err := sw.blockManager.CreateBlock(sw.blockBuffer)
-	if err != nil {
-		return err
+	// большая запись делится на блоки по blockSize точек в порядке времени, иначе
+	// блоки пересекались бы и PointCount мог переполниться
+	limit := min(sw.blockSize, storage.MaxBlockPoints)
+	if limit <= 0 {
+		limit = storage.MaxBlockPoints
 	}
-
-	if err := sw.fileManager.WriteBlock(sw.file, block); err != nil {
-		return err
+	if len(sw.blockBuffer) > limit {
+		sort.SliceStable(sw.blockBuffer, func(i, j int) bool {
+			return sw.blockBuffer[i].Timestamp < sw.blockBuffer[j].Timestamp
+		})
 	}
 
-	sw.updateMetadata(block)
+	for start := 0; start < len(sw.blockBuffer); start += limit {
+		points := sw.blockBuffer[start:min(start+limit, len(sw.blockBuffer))]
+
+		block, err := sw.blockManager.CreateBlock(points)
+		if err == nil {
+			err = sw.fileManager.WriteBlock(sw.file, block)
+		}
+		if err != nil {
+			// записанные блоки из буфера убираются, чтобы не записать их второй раз
+			sw.blockBuffer = append(sw.blockBuffer[:0], sw.blockBuffer[start:]...)
+			return err
+		}
+
+		sw.updateMetadata(block, points)
+		sw.updateLastPoint(points)
+	}
 	sw.blockBuffer = sw.blockBuffer[:0]
 
 	return nil
@@ -60,15 +82,24 @@ func (sw *SeriesWriter) Close() error {
 	return sw.Flush()
 }
 
-func (sw *SeriesWriter) updateMetadata(block *types.DataBlock) {
+func (sw *SeriesWriter) updateMetadata(block *types.DataBlock, points []types.Point) {
+	if sw.metadata.TotalPoints > 0 && block.StartTime <= sw.metadata.EndTime || hasDuplicateTimestamps(points) {
+		sw.metadata.UniqueTimestamps = false
+	}
+
 	if sw.metadata.TotalPoints == 0 {
 		sw.metadata.StartTime = block.StartTime
+		sw.metadata.EndTime = block.EndTime
 		sw.metadata.MinValue = block.MinValue
 		sw.metadata.MaxValue = block.MaxValue
 	} else {
 		if block.StartTime < sw.metadata.StartTime {
 			sw.metadata.StartTime = block.StartTime
 		}
+		// блоки с опоздавшими точками не должны сдвигать конец ряда назад
+		if block.EndTime > sw.metadata.EndTime {
+			sw.metadata.EndTime = block.EndTime
+		}
 		if block.MinValue < sw.metadata.MinValue {
 			sw.metadata.MinValue = block.MinValue
 		}
@@ -77,7 +108,48 @@ func (sw *SeriesWriter) updateMetadata(block *types.DataBlock) {
 		}
 	}
 
-	sw.metadata.EndTime = block.EndTime
 	sw.metadata.TotalPoints += int64(block.PointCount)
 	sw.metadata.BlockCount++
 }
+
+func hasDuplicateTimestamps(points []types.Point) bool {
+	timestamps := make([]int64, len(points))
+	for i, p := range points {
+		timestamps[i] = p.Timestamp
+	}
+	slices.Sort(timestamps)
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] == timestamps[i-1] {
+			return true
+		}
+	}
+	return false
+}
+
+// updateLastPoint - из точек с одинаковым таймстемпом побеждает записанная позже
+func (sw *SeriesWriter) updateLastPoint(points []types.Point) {
+	for _, p := range points {
+		if sw.lastPoint == nil || p.Timestamp >= sw.lastPoint.Timestamp {
+			last := p
+			sw.lastPoint = &last
+		}
+	}
+}
+
+// LastPoint - false, если в ряду еще нет точек
+func (sw *SeriesWriter) LastPoint() (types.Point, bool) {
+	if sw.lastPoint == nil {
+		return types.Point{}, false
+	}
+	return *sw.lastPoint, true
+}
+
+// restoreLastPoint - при старте последняя точка берется из последнего по времени блока файла
+func (sw *SeriesWriter) restoreLastPoint() error {
+	point, ok, err := sw.fileManager.ReadLastPoint(sw.metadata.FilePath)
+	if err != nil || !ok {
+		return err
+	}
+	sw.lastPoint = &point
+	return nil
+}
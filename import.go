@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"tsdb/engine"
+	"tsdb/ingest"
+)
+
+// runImport - подкоманда `tsdb import csv [flags] <file.csv|->`. Пишет напрямую в data-dir,
+// поэтому сервер с той же директорией в это время должен быть остановлен
+func runImport(args []string) {
+	if len(args) == 0 || args[0] != "csv" {
+		fmt.Fprintln(os.Stderr, "usage: tsdb import csv [flags] <file.csv|->")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("import csv", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "./tsdb_data", "Data directory")
+	blockSize := fs.Int("block-size", 1000, "Points per block")
+	batchSize := fs.Int("batch-size", ingest.DefaultBatchSize, "Points per write batch")
+	timestamp := fs.String("timestamp", "", "Timestamp column")
+	timestampFormat := fs.String("timestamp-format", "unix", "Timestamp format: unix, rfc3339 or a Go time layout")
+	precision := fs.String("precision", "s", "Unix timestamp precision: s, ms, us, ns")
+	metric := fs.String("metric", "", "Metric name for all rows")
+	metricColumn := fs.String("metric-column", "", "Column with the metric name")
+	tags := fs.String("tags", "", "Comma-separated tag columns")
+	values := fs.String("values", "", "Comma-separated value columns")
+	delimiter := fs.String("delimiter", ",", "Field delimiter (\"tab\" for TSV)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tsdb import csv [flags] <file.csv|->")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	comma, err := ingest.ParseCSVDelimiter(*delimiter)
+	if err != nil {
+		log.Fatalf("Invalid delimiter: %v", err)
+	}
+
+	var input io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", path, err)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	tsdb, err := engine.NewTSDBEngine(*dataDir, *blockSize)
+	if err != nil {
+		log.Fatalf("Failed to create TSDB: %v", err)
+	}
+
+	result, err := ingest.ImportCSV(input, ingest.CSVMapping{
+		TimestampColumn:    *timestamp,
+		TimestampFormat:    *timestampFormat,
+		TimestampPrecision: *precision,
+		MetricColumn:       *metricColumn,
+		Metric:             *metric,
+		TagColumns:         ingest.ParseCSVColumns(*tags),
+		ValueColumns:       ingest.ParseCSVColumns(*values),
+		Delimiter:          comma,
+	}, tsdb, *batchSize)
+
+	if closeErr := tsdb.Close(); closeErr != nil {
+		log.Printf("Failed to close TSDB: %v", closeErr)
+	}
+	// отчет по уже разобранным строкам печатается и когда импорт прервался
+	if result != nil {
+		if err != nil {
+			result.Error = err.Error()
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	}
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+
+	if result.FailedRows > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,87 @@
+package index
+
+import "sort"
+
+// CardinalityEntry - имя (метрика, тег или пара tag=value) и число рядов или значений
+type CardinalityEntry struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// CardinalityStats - отчет о числе рядов. Growth заполняется, если задан since
+type CardinalityStats struct {
+	TotalSeries   int                `json:"total_series"`
+	TopMetrics    []CardinalityEntry `json:"top_metrics"`
+	TopLabelNames []CardinalityEntry `json:"top_label_names"`
+	TopLabelPairs []CardinalityEntry `json:"top_label_pairs"`
+	Growth        *CardinalityGrowth `json:"growth,omitempty"`
+}
+
+// CardinalityGrowth - ряды, созданные начиная с Since
+type CardinalityGrowth struct {
+	Since      int64              `json:"since"`
+	NewSeries  int                `json:"new_series"`
+	TopMetrics []CardinalityEntry `json:"top_metrics"`
+}
+
+// Cardinality - топ limit метрик по числу рядов, тегов по числу разных значений и пар tag=value
+// по числу рядов. Если since > 0, считаются ряды, созданные не раньше since (по CreatedAt)
+func (im *IndexManager) Cardinality(limit int, since int64) CardinalityStats {
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
+	stats := CardinalityStats{TotalSeries: len(im.index.Series)}
+
+	metrics := make([]CardinalityEntry, 0, len(im.index.MetricToSeries))
+	for metric, seriesHashes := range im.index.MetricToSeries {
+		metrics = append(metrics, CardinalityEntry{Name: metric, Count: len(seriesHashes)})
+	}
+	stats.TopMetrics = topEntries(metrics, limit)
+
+	var names, pairs []CardinalityEntry
+	for name, values := range im.index.TagIndex {
+		names = append(names, CardinalityEntry{Name: name, Count: len(values)})
+		for value, seriesHashes := range values {
+			pairs = append(pairs, CardinalityEntry{Name: name + "=" + value, Count: len(seriesHashes)})
+		}
+	}
+	stats.TopLabelNames = topEntries(names, limit)
+	stats.TopLabelPairs = topEntries(pairs, limit)
+
+	if since > 0 {
+		stats.Growth = &CardinalityGrowth{Since: since}
+		growth := make(map[string]int)
+		for _, metadata := range im.index.Series {
+			if metadata.CreatedAt >= since {
+				stats.Growth.NewSeries++
+				growth[metadata.SeriesID.Metric]++
+			}
+		}
+
+		growing := make([]CardinalityEntry, 0, len(growth))
+		for metric, count := range growth {
+			growing = append(growing, CardinalityEntry{Name: metric, Count: count})
+		}
+		stats.Growth.TopMetrics = topEntries(growing, limit)
+	}
+
+	return stats
+}
+
+// topEntries - по убыванию Count, при равенстве по имени
+func topEntries(entries []CardinalityEntry, limit int) []CardinalityEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []CardinalityEntry{}
+	}
+	return entries
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 	"tsdb/types"
 )
 
@@ -27,6 +28,10 @@ func NewGlobalIndex() *GlobalIndex {
 type IndexManager struct {
 	index     *GlobalIndex
 	indexFile string
+	mutex     sync.RWMutex
+	// saveMutex - сохранения идут по одному: у них общий временный файл, и более старый снимок
+	// не должен лечь поверх нового
+	saveMutex sync.Mutex
 }
 
 func NewIndexManager(dataDir string) *IndexManager {
@@ -37,6 +42,9 @@ func NewIndexManager(dataDir string) *IndexManager {
 }
 
 func (im *IndexManager) AddSeries(metadata *types.SeriesMetadata) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+
 	seriesHash := im.HashSeries(metadata.SeriesID)
 
 	im.index.Series[seriesHash] = metadata
@@ -59,12 +67,30 @@ func (im *IndexManager) AddSeries(metadata *types.SeriesMetadata) {
 
 func (im *IndexManager) GetSeries(seriesID types.SeriesIdentifier) (*types.SeriesMetadata, bool) {
 	seriesHash := im.HashSeries(seriesID)
+
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
 	metadata, exists := im.index.Series[seriesHash]
 	return metadata, exists
 }
 
+// GetAllSeries - копия карты рядов, ее можно обходить без блокировки индекса
 func (im *IndexManager) GetAllSeries() map[string]*types.SeriesMetadata {
-	return im.index.Series
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
+	series := make(map[string]*types.SeriesMetadata, len(im.index.Series))
+	for seriesHash, metadata := range im.index.Series {
+		series[seriesHash] = metadata
+	}
+	return series
+}
+
+func (im *IndexManager) SeriesCount() int {
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+	return len(im.index.Series)
 }
 
 func (im *IndexManager) HashSeries(seriesID types.SeriesIdentifier) string {
@@ -86,7 +112,12 @@ func (im *IndexManager) HashSeries(seriesID types.SeriesIdentifier) string {
 }
 
 func (im *IndexManager) Save() error {
+	im.saveMutex.Lock()
+	defer im.saveMutex.Unlock()
+
+	im.mutex.RLock()
 	data, err := json.MarshalIndent(im.index, "", "  ")
+	im.mutex.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -105,10 +136,15 @@ func (im *IndexManager) Load() error {
 		return err
 	}
 
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
 	return json.Unmarshal(data, &im.index)
 }
 
 func (im *IndexManager) FindSeries(metric string, tagFilters map[string]string) []types.SeriesIdentifier {
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
 	var result []types.SeriesIdentifier
 
 	seriesHashes, exists := im.index.MetricToSeries[metric]
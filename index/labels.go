@@ -0,0 +1,104 @@
+package index
+
+import (
+	"sort"
+	"strings"
+	"tsdb/types"
+)
+
+// LabelFilter - ограничения для справочников тегов и метрик. TimeRange == nil - без ограничения
+// по времени, Limit == 0 - без ограничения количества
+type LabelFilter struct {
+	Matchers  []types.LabelMatcher
+	TimeRange *types.TimeRange
+	Prefix    string
+	Limit     int
+}
+
+// LabelNames - имена тегов рядов, подходящих под фильтр, по алфавиту
+func (im *IndexManager) LabelNames(filter LabelFilter) ([]string, error) {
+	compiled, err := compileMatchers(filter.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
+	names := make(map[string]bool)
+	if len(compiled) == 0 && filter.TimeRange == nil {
+		for name := range im.index.TagIndex {
+			names[name] = true
+		}
+	} else {
+		for _, metadata := range im.selectSeries(compiled) {
+			if !overlaps(metadata, filter.TimeRange) {
+				continue
+			}
+			for name := range metadata.SeriesID.Tags {
+				names[name] = true
+			}
+		}
+	}
+
+	return sortedWithPrefix(names, filter.Prefix, filter.Limit), nil
+}
+
+// LabelValues - значения тега name у рядов, подходящих под фильтр, по алфавиту.
+// Для types.MetricNameLabel - имена метрик
+func (im *IndexManager) LabelValues(name string, filter LabelFilter) ([]string, error) {
+	compiled, err := compileMatchers(filter.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
+	values := make(map[string]bool)
+	if len(compiled) == 0 && filter.TimeRange == nil {
+		postings := im.index.TagIndex[name]
+		if name == types.MetricNameLabel {
+			postings = im.index.MetricToSeries
+		}
+		for value := range postings {
+			values[value] = true
+		}
+	} else {
+		for _, metadata := range im.selectSeries(compiled) {
+			if !overlaps(metadata, filter.TimeRange) {
+				continue
+			}
+			if name == types.MetricNameLabel {
+				values[metadata.SeriesID.Metric] = true
+			} else if value, ok := metadata.SeriesID.Tags[name]; ok {
+				values[value] = true
+			}
+		}
+	}
+
+	return sortedWithPrefix(values, filter.Prefix, filter.Limit), nil
+}
+
+// overlaps - пересекаются ли записанные точки ряда с диапазоном. Ряд без точек не пересекается ни с чем
+func overlaps(metadata *types.SeriesMetadata, timeRange *types.TimeRange) bool {
+	if timeRange == nil {
+		return true
+	}
+	return metadata.TotalPoints > 0 && metadata.StartTime <= timeRange.End && metadata.EndTime >= timeRange.Start
+}
+
+func sortedWithPrefix(set map[string]bool, prefix string, limit int) []string {
+	result := make([]string, 0, len(set))
+	for s := range set {
+		if strings.HasPrefix(s, prefix) {
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
@@ -0,0 +1,177 @@
+package index
+
+import (
+	"fmt"
+	"regexp"
+	"tsdb/types"
+)
+
+// matcher - LabelMatcher со скомпилированным регулярным выражением
+type matcher struct {
+	types.LabelMatcher
+	re *regexp.Regexp
+}
+
+func compileMatchers(matchers []types.LabelMatcher) ([]matcher, error) {
+	compiled := make([]matcher, len(matchers))
+
+	for i, m := range matchers {
+		compiled[i] = matcher{LabelMatcher: m}
+
+		switch m.Type {
+		case types.MatchEqual, types.MatchNotEqual:
+		case types.MatchRegexp, types.MatchNotRegexp:
+			// как в Prometheus, регулярка должна совпасть со всем значением
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regexp %q for tag %s: %w", m.Value, m.Name, err)
+			}
+			compiled[i].re = re
+		default:
+			return nil, fmt.Errorf("unknown match type %d for tag %s", m.Type, m.Name)
+		}
+	}
+
+	return compiled, nil
+}
+
+// matches - отсутствующий тег считается пустой строкой
+func (m *matcher) matches(value string) bool {
+	switch m.Type {
+	case types.MatchEqual:
+		return value == m.Value
+	case types.MatchNotEqual:
+		return value != m.Value
+	case types.MatchRegexp:
+		return m.re.MatchString(value)
+	case types.MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+func (m *matcher) matchesSeries(seriesID types.SeriesIdentifier) bool {
+	if m.Name == types.MetricNameLabel {
+		return m.matches(seriesID.Metric)
+	}
+	return m.matches(seriesID.Tags[m.Name])
+}
+
+func ValidateMatchers(matchers []types.LabelMatcher) error {
+	_, err := compileMatchers(matchers)
+	return err
+}
+
+// FindSeriesByMatchers - поиск рядов по произвольному набору условий
+func (im *IndexManager) FindSeriesByMatchers(matchers []types.LabelMatcher) ([]types.SeriesIdentifier, error) {
+	compiled, err := compileMatchers(matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	im.mutex.RLock()
+	defer im.mutex.RUnlock()
+
+	series := im.selectSeries(compiled)
+	result := make([]types.SeriesIdentifier, len(series))
+	for i, metadata := range series {
+		result[i] = metadata.SeriesID
+	}
+	return result, nil
+}
+
+// selectSeries - кандидаты берутся из MetricToSeries/TagIndex: сначала по условиям равенства,
+// затем по остальным условиям через перебор значений тега. Условия, под которые подходит
+// отсутствующий тег, проверяются на каждом кандидате. Вызывается под мьютексом индекса
+func (im *IndexManager) selectSeries(compiled []matcher) []*types.SeriesMetadata {
+	var candidates map[string]bool
+	for _, equal := range []bool{true, false} {
+		for i := range compiled {
+			if (compiled[i].Type == types.MatchEqual) != equal {
+				continue
+			}
+
+			postings, ok := im.postingsForMatcher(&compiled[i])
+			if !ok {
+				continue
+			}
+
+			candidates = intersectPostings(candidates, postings)
+			if len(candidates) == 0 {
+				return nil
+			}
+		}
+	}
+
+	var result []*types.SeriesMetadata
+	check := func(seriesHash string) {
+		metadata, exists := im.index.Series[seriesHash]
+		if !exists {
+			return
+		}
+		for i := range compiled {
+			if !compiled[i].matchesSeries(metadata.SeriesID) {
+				return
+			}
+		}
+		result = append(result, metadata)
+	}
+
+	if candidates == nil {
+		for seriesHash := range im.index.Series {
+			check(seriesHash)
+		}
+	} else {
+		for seriesHash := range candidates {
+			check(seriesHash)
+		}
+	}
+
+	return result
+}
+
+// postingsForMatcher - ряды, у которых значение тега подходит под условие. false - условие
+// не сужает поиск, потому что под него подходят и ряды без этого тега
+func (im *IndexManager) postingsForMatcher(m *matcher) (map[string]bool, bool) {
+	if m.matches("") {
+		return nil, false
+	}
+
+	values := im.index.TagIndex[m.Name]
+	if m.Name == types.MetricNameLabel {
+		values = im.index.MetricToSeries
+	}
+
+	if m.Type == types.MatchEqual {
+		return values[m.Value], true
+	}
+
+	postings := make(map[string]bool)
+	for value, seriesHashes := range values {
+		if !m.matches(value) {
+			continue
+		}
+		for seriesHash := range seriesHashes {
+			postings[seriesHash] = true
+		}
+	}
+	return postings, true
+}
+
+// intersectPostings - nil в acc означает "еще не ограничено"
+func intersectPostings(acc, postings map[string]bool) map[string]bool {
+	if acc == nil {
+		result := make(map[string]bool, len(postings))
+		for seriesHash := range postings {
+			result[seriesHash] = true
+		}
+		return result
+	}
+
+	for seriesHash := range acc {
+		if !postings[seriesHash] {
+			delete(acc, seriesHash)
+		}
+	}
+	return acc
+}
@@ -0,0 +1,95 @@
+package ingest
+
+import (
+	"sort"
+	"strings"
+	"tsdb/types"
+)
+
+// DefaultBatchSize - сколько точек копить перед записью в движок
+const DefaultBatchSize = 5000
+
+// Batch - накопитель точек из разных протоколов, группирующий их по рядам
+type Batch struct {
+	series map[string]*types.SeriesData
+	order  []string
+	points int
+}
+
+func NewBatch() *Batch {
+	return &Batch{
+		series: make(map[string]*types.SeriesData),
+	}
+}
+
+func (b *Batch) Add(seriesID types.SeriesIdentifier, point types.Point) {
+	key := seriesKey(seriesID)
+
+	series, exists := b.series[key]
+	if !exists {
+		series = &types.SeriesData{SeriesID: seriesID}
+		b.series[key] = series
+		b.order = append(b.order, key)
+	}
+
+	series.Points = append(series.Points, point)
+	b.points++
+}
+
+// Len - количество точек в батче
+func (b *Batch) Len() int {
+	return b.points
+}
+
+// WriteRequest - точки каждого ряда сортируются по времени, иначе у блока будут неверные StartTime/EndTime
+func (b *Batch) WriteRequest() types.WriteRequest {
+	request := types.WriteRequest{
+		Series: make([]types.SeriesData, 0, len(b.order)),
+	}
+
+	for _, key := range b.order {
+		series := b.series[key]
+		sort.SliceStable(series.Points, func(i, j int) bool {
+			return series.Points[i].Timestamp < series.Points[j].Timestamp
+		})
+		request.Series = append(request.Series, *series)
+	}
+
+	return request
+}
+
+func (b *Batch) Reset() {
+	b.series = make(map[string]*types.SeriesData)
+	b.order = b.order[:0]
+	b.points = 0
+}
+
+// Flush - записывает накопленное и очищает батч
+func (b *Batch) Flush(writer types.Writer) error {
+	if b.points == 0 {
+		return nil
+	}
+
+	err := writer.Write(b.WriteRequest())
+	b.Reset()
+	return err
+}
+
+func seriesKey(seriesID types.SeriesIdentifier) string {
+	keys := make([]string, 0, len(seriesID.Tags))
+	for k := range seriesID.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(seriesID.Metric)
+	for _, k := range keys {
+		sb.WriteByte(0)
+		sb.WriteString(k)
+		sb.WriteByte(0)
+		sb.WriteString(seriesID.Tags[k])
+	}
+
+	return sb.String()
+}
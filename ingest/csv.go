@@ -0,0 +1,344 @@
+package ingest
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb/types"
+)
+
+// maxReportedCSVErrors - сколько ошибок строк попадает в отчет, остальные только считаются
+const maxReportedCSVErrors = 100
+
+// CSVMapping - какие колонки CSV во что превращаются. Колонки задаются по именам из заголовка.
+// Ряд называется по MetricColumn или Metric; если колонок значений несколько, к имени
+// добавляется имя колонки (metric_column), если имени метрики нет - ряд называется по колонке значения
+type CSVMapping struct {
+	TimestampColumn    string
+	TimestampFormat    string // unix (по умолчанию), rfc3339 или layout в формате time.Parse
+	TimestampPrecision string // для unix: s (по умолчанию), ms, us, ns
+	MetricColumn       string
+	Metric             string
+	TagColumns         []string
+	ValueColumns       []string
+	Delimiter          rune
+}
+
+// CSVRowError - ошибка конкретной строки файла (нумерация с 1, заголовок - строка 1)
+type CSVRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// CSVImportResult - отчет об импорте. CommittedRows - сколько первых строк данных уже записано,
+// с них можно продолжить прерванный импорт
+type CSVImportResult struct {
+	Rows          int           `json:"rows"`
+	Points        int           `json:"points"`
+	FailedRows    int           `json:"failed_rows"`
+	CommittedRows int           `json:"committed_rows"`
+	Errors        []CSVRowError `json:"errors"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// csvColumns - индексы колонок из маппинга в текущем файле
+type csvColumns struct {
+	timestamp int
+	metric    int
+	tags      []int
+	values    []int
+}
+
+// ParseCSVColumns - список колонок через запятую ("host, env" -> [host env])
+func ParseCSVColumns(s string) []string {
+	var columns []string
+	for _, column := range strings.Split(s, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// ImportCSV - читает CSV построчно и пишет точки пачками по batchSize, не загружая файл целиком.
+// Ошибки отдельных строк попадают в отчет, error возвращается только если импорт
+// продолжать нельзя (битый заголовок, неверный маппинг, ошибка записи)
+func ImportCSV(r io.Reader, mapping CSVMapping, writer types.Writer, batchSize int) (*CSVImportResult, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	precision, err := csvTimestampPrecision(mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(r)
+	if mapping.Delimiter != 0 {
+		reader.Comma = mapping.Delimiter
+	}
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("empty CSV")
+		}
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	columns, err := mapping.resolve(header)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CSVImportResult{Errors: []CSVRowError{}}
+	batch := NewBatch()
+	row := 1
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row++
+		result.Rows++
+
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return result, err
+			}
+			result.addError(row, err)
+			continue
+		}
+
+		points, err := mapping.addRow(batch, columns, record, precision)
+		if err != nil {
+			result.addError(row, err)
+			continue
+		}
+		result.Points += points
+
+		if batch.Len() >= batchSize {
+			if err := batch.Flush(writer); err != nil {
+				return result, err
+			}
+			result.CommittedRows = result.Rows
+		}
+	}
+
+	if err := batch.Flush(writer); err != nil {
+		return result, err
+	}
+	result.CommittedRows = result.Rows
+
+	return result, nil
+}
+
+func (res *CSVImportResult) addError(row int, err error) {
+	res.FailedRows++
+	if len(res.Errors) < maxReportedCSVErrors {
+		res.Errors = append(res.Errors, CSVRowError{Row: row, Error: err.Error()})
+	}
+}
+
+func csvTimestampPrecision(mapping CSVMapping) (time.Duration, error) {
+	switch mapping.TimestampFormat {
+	case "", "unix":
+		if mapping.TimestampPrecision == "" {
+			return time.Second, nil
+		}
+		return ParseInfluxPrecision(mapping.TimestampPrecision)
+	}
+	return 0, nil
+}
+
+func (mapping CSVMapping) resolve(header []string) (csvColumns, error) {
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+
+	lookup := func(name string) (int, error) {
+		i, ok := index[name]
+		if !ok {
+			return 0, fmt.Errorf("column %q not found in header", name)
+		}
+		return i, nil
+	}
+
+	columns := csvColumns{metric: -1}
+	var err error
+
+	if mapping.TimestampColumn == "" {
+		return columns, fmt.Errorf("timestamp column is required")
+	}
+	if columns.timestamp, err = lookup(mapping.TimestampColumn); err != nil {
+		return columns, err
+	}
+
+	if mapping.MetricColumn != "" {
+		if columns.metric, err = lookup(mapping.MetricColumn); err != nil {
+			return columns, err
+		}
+	}
+
+	for _, name := range mapping.TagColumns {
+		i, err := lookup(name)
+		if err != nil {
+			return columns, err
+		}
+		columns.tags = append(columns.tags, i)
+	}
+
+	if len(mapping.ValueColumns) == 0 {
+		return columns, fmt.Errorf("at least one value column is required")
+	}
+	for _, name := range mapping.ValueColumns {
+		i, err := lookup(name)
+		if err != nil {
+			return columns, err
+		}
+		columns.values = append(columns.values, i)
+	}
+
+	return columns, nil
+}
+
+// addRow - добавляет точки строки в batch. Пустые ячейки значений пропускаются
+func (mapping CSVMapping) addRow(batch *Batch, columns csvColumns, record []string, precision time.Duration) (int, error) {
+	field := func(i int) (string, error) {
+		if i >= len(record) {
+			return "", fmt.Errorf("expected at least %d fields, got %d", i+1, len(record))
+		}
+		return strings.TrimSpace(record[i]), nil
+	}
+
+	rawTimestamp, err := field(columns.timestamp)
+	if err != nil {
+		return 0, err
+	}
+	timestamp, err := mapping.parseTimestamp(rawTimestamp, precision)
+	if err != nil {
+		return 0, err
+	}
+
+	metric := mapping.Metric
+	if columns.metric >= 0 {
+		if metric, err = field(columns.metric); err != nil {
+			return 0, err
+		}
+		if metric == "" {
+			return 0, fmt.Errorf("empty metric name")
+		}
+	}
+
+	tags := make(map[string]string, len(columns.tags))
+	for j, i := range columns.tags {
+		value, err := field(i)
+		if err != nil {
+			return 0, err
+		}
+		if value != "" {
+			tags[mapping.TagColumns[j]] = value
+		}
+	}
+
+	type rowPoint struct {
+		metric string
+		value  float64
+	}
+	points := make([]rowPoint, 0, len(columns.values))
+
+	for j, i := range columns.values {
+		raw, err := field(i)
+		if err != nil {
+			return 0, err
+		}
+		if raw == "" {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q in column %s", raw, mapping.ValueColumns[j])
+		}
+		if !types.IsFinite(value) {
+			return 0, fmt.Errorf("non-finite value %q in column %s", raw, mapping.ValueColumns[j])
+		}
+
+		name := mapping.ValueColumns[j]
+		if metric != "" {
+			name = metric
+			if len(columns.values) > 1 {
+				name = metric + "_" + mapping.ValueColumns[j]
+			}
+		}
+		points = append(points, rowPoint{metric: name, value: value})
+	}
+
+	// строка добавляется целиком или не добавляется вовсе
+	for _, p := range points {
+		batch.Add(types.SeriesIdentifier{Metric: p.metric, Tags: copyTags(tags)}, types.Point{Timestamp: timestamp, Value: p.value})
+	}
+
+	return len(points), nil
+}
+
+func (mapping CSVMapping) parseTimestamp(raw string, precision time.Duration) (int64, error) {
+	if raw == "" {
+		return 0, fmt.Errorf("empty timestamp")
+	}
+
+	switch mapping.TimestampFormat {
+	case "", "unix":
+		if ts, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			if ts > math.MaxInt64/int64(precision) || ts < math.MinInt64/int64(precision) {
+				return 0, fmt.Errorf("timestamp %q out of range", raw)
+			}
+			return ts * int64(precision), nil
+		}
+
+		// дробные таймстемпы вида 1609459200.123
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(f) || math.Abs(f*float64(precision)) > math.MaxInt64 {
+			return 0, fmt.Errorf("invalid timestamp %q", raw)
+		}
+		return int64(f * float64(precision)), nil
+	case "rfc3339":
+		t, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", raw)
+		}
+		return t.UnixNano(), nil
+	default:
+		t, err := time.Parse(mapping.TimestampFormat, raw)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q for layout %q", raw, mapping.TimestampFormat)
+		}
+		return t.UnixNano(), nil
+	}
+}
+
+// ParseCSVDelimiter - разделитель из одного символа, "tab" или "\t" для TSV
+func ParseCSVDelimiter(s string) (rune, error) {
+	switch s {
+	case "":
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+
+	runes := []rune(s)
+	if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+		return 0, fmt.Errorf("invalid delimiter %q", s)
+	}
+	return runes[0], nil
+}
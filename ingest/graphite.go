@@ -0,0 +1,201 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb/types"
+)
+
+// GraphiteTemplate - шаблон разбора пути в стиле InfluxDB: "[фильтр] шаблон [tag=value,...]".
+// Части шаблона: measurement (measurement* - до конца пути), имя тега или пустая часть (пропустить)
+type GraphiteTemplate struct {
+	filter      []string
+	parts       []string
+	defaultTags map[string]string
+}
+
+// GraphiteParser - выбирает самый специфичный шаблон по фильтру
+type GraphiteParser struct {
+	templates []*GraphiteTemplate
+	separator string
+}
+
+func ParseGraphiteTemplate(spec string) (*GraphiteTemplate, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid graphite template %q", spec)
+	}
+
+	tmpl := &GraphiteTemplate{defaultTags: make(map[string]string)}
+
+	// последняя часть с "=" - теги по умолчанию
+	if last := fields[len(fields)-1]; len(fields) > 1 && strings.Contains(last, "=") {
+		for _, pair := range strings.Split(last, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("invalid default tag %q in template %q", pair, spec)
+			}
+			tmpl.defaultTags[kv[0]] = kv[1]
+		}
+		fields = fields[:len(fields)-1]
+	}
+
+	switch len(fields) {
+	case 1:
+		tmpl.parts = strings.Split(fields[0], ".")
+	case 2:
+		tmpl.filter = strings.Split(fields[0], ".")
+		tmpl.parts = strings.Split(fields[1], ".")
+	default:
+		return nil, fmt.Errorf("invalid graphite template %q", spec)
+	}
+
+	hasMeasurement := false
+	for _, part := range tmpl.parts {
+		if part == "measurement" || part == "measurement*" {
+			hasMeasurement = true
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("graphite template %q has no measurement part", spec)
+	}
+
+	return tmpl, nil
+}
+
+// NewGraphiteParser - separator склеивает части, попавшие в measurement
+func NewGraphiteParser(specs []string, separator string) (*GraphiteParser, error) {
+	parser := &GraphiteParser{separator: separator}
+
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		tmpl, err := ParseGraphiteTemplate(spec)
+		if err != nil {
+			return nil, err
+		}
+		parser.templates = append(parser.templates, tmpl)
+	}
+
+	return parser, nil
+}
+
+// ParseLine - строка "path.to.metric value [timestamp]", таймстемп в секундах
+func (p *GraphiteParser) ParseLine(line string, now time.Time) (types.SeriesIdentifier, types.Point, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return types.SeriesIdentifier{}, types.Point{}, fmt.Errorf("invalid graphite line %q", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return types.SeriesIdentifier{}, types.Point{}, fmt.Errorf("invalid value %q", fields[1])
+	}
+	if !types.IsFinite(value) {
+		return types.SeriesIdentifier{}, types.Point{}, fmt.Errorf("non-finite value %q", fields[1])
+	}
+
+	timestamp := now.UnixNano()
+	if len(fields) == 3 && fields[2] != "-1" {
+		seconds, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || math.IsNaN(seconds) || math.Abs(seconds) > math.MaxInt64/float64(time.Second) {
+			return types.SeriesIdentifier{}, types.Point{}, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+		timestamp = int64(seconds * float64(time.Second))
+	}
+
+	seriesID, err := p.ParsePath(fields[0])
+	if err != nil {
+		return types.SeriesIdentifier{}, types.Point{}, err
+	}
+
+	return seriesID, types.Point{Timestamp: timestamp, Value: value}, nil
+}
+
+// ParsePath - без подходящего шаблона весь путь становится именем метрики
+func (p *GraphiteParser) ParsePath(path string) (types.SeriesIdentifier, error) {
+	if path == "" {
+		return types.SeriesIdentifier{}, errors.New("empty metric path")
+	}
+
+	parts := strings.Split(path, ".")
+	tmpl := p.match(parts)
+	if tmpl == nil {
+		return types.SeriesIdentifier{Metric: path, Tags: map[string]string{}}, nil
+	}
+
+	tags := copyTags(tmpl.defaultTags)
+
+	var measurement []string
+	fromPath := make(map[string]bool)
+	for i, name := range tmpl.parts {
+		if i >= len(parts) {
+			break
+		}
+
+		switch name {
+		case "":
+		case "measurement":
+			measurement = append(measurement, parts[i])
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+		default:
+			// тег, повторенный в шаблоне, собирается из нескольких частей
+			if fromPath[name] {
+				tags[name] += p.separator + parts[i]
+			} else {
+				tags[name] = parts[i]
+			}
+			fromPath[name] = true
+		}
+
+		if name == "measurement*" {
+			break
+		}
+	}
+
+	if len(measurement) == 0 {
+		return types.SeriesIdentifier{}, fmt.Errorf("template gave no measurement for %q", path)
+	}
+
+	return types.SeriesIdentifier{
+		Metric: strings.Join(measurement, p.separator),
+		Tags:   tags,
+	}, nil
+}
+
+// match - из подходящих фильтров выигрывает самый длинный, шаблон без фильтра подходит всегда
+func (p *GraphiteParser) match(parts []string) *GraphiteTemplate {
+	var best *GraphiteTemplate
+	bestLen := -1
+
+	for _, tmpl := range p.templates {
+		if !matchGraphiteFilter(tmpl.filter, parts) {
+			continue
+		}
+		if len(tmpl.filter) > bestLen {
+			best = tmpl
+			bestLen = len(tmpl.filter)
+		}
+	}
+
+	return best
+}
+
+func matchGraphiteFilter(filter, parts []string) bool {
+	if len(filter) > len(parts) {
+		return false
+	}
+
+	for i, f := range filter {
+		if f != "*" && f != parts[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package ingest
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"tsdb/types"
+)
+
+const maxUDPPacketSize = 64 * 1024
+
+// GraphiteConfig - настройки приема Graphite plaintext, пустой адрес отключает транспорт
+type GraphiteConfig struct {
+	TCPAddr       string
+	UDPAddr       string
+	Templates     []string
+	Separator     string
+	BatchSize     int
+	QueueSize     int
+	FlushInterval time.Duration
+}
+
+// GraphiteListener - прием строк "path.to.metric value timestamp" по TCP и UDP
+type GraphiteListener struct {
+	config GraphiteConfig
+	parser *GraphiteParser
+	writer *BatchWriter
+	tcp    *tcpLineServer
+	udp    net.PacketConn
+	wg     sync.WaitGroup
+}
+
+func NewGraphiteListener(config GraphiteConfig, writer types.Writer) (*GraphiteListener, error) {
+	if config.Separator == "" {
+		config.Separator = "."
+	}
+
+	parser, err := NewGraphiteParser(config.Templates, config.Separator)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GraphiteListener{
+		config: config,
+		parser: parser,
+		writer: NewBatchWriter(writer, config.BatchSize, config.QueueSize, config.FlushInterval),
+	}, nil
+}
+
+func (l *GraphiteListener) Start() error {
+	if l.config.TCPAddr != "" {
+		tcp, err := listenTCPLines(l.config.TCPAddr, func(_ net.Conn, line string) {
+			l.handleLine(line)
+		})
+		if err != nil {
+			return err
+		}
+		l.tcp = tcp
+	}
+
+	if l.config.UDPAddr != "" {
+		udp, err := net.ListenPacket("udp", l.config.UDPAddr)
+		if err != nil {
+			if l.tcp != nil {
+				l.tcp.Close()
+			}
+			return err
+		}
+		l.udp = udp
+	}
+
+	l.writer.Start()
+
+	if l.tcp != nil {
+		log.Printf("Graphite TCP listener on %s", l.tcp.Addr())
+		l.tcp.Start()
+	}
+	if l.udp != nil {
+		log.Printf("Graphite UDP listener on %s", l.udp.LocalAddr())
+		l.wg.Add(1)
+		go l.readUDP()
+	}
+
+	return nil
+}
+
+// Close - закрывает сокеты, ждет обработчики и дописывает очередь в движок
+func (l *GraphiteListener) Close() error {
+	if l.tcp != nil {
+		l.tcp.Close()
+	}
+	if l.udp != nil {
+		l.udp.Close()
+	}
+
+	l.wg.Wait()
+	l.writer.Close()
+	return nil
+}
+
+func (l *GraphiteListener) readUDP() {
+	defer l.wg.Done()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, _, err := l.udp.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.handleLine(line)
+		}
+	}
+}
+
+func (l *GraphiteListener) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	seriesID, point, err := l.parser.ParseLine(line, time.Now())
+	if err != nil {
+		log.Printf("Graphite: %v", err)
+		return
+	}
+
+	l.writer.Add(Sample{SeriesID: seriesID, Point: point})
+}
@@ -0,0 +1,232 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb/types"
+)
+
+// InfluxLine - разобранная строка InfluxDB line protocol
+type InfluxLine struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	Timestamp   int64
+}
+
+// ParseInfluxPrecision - понимает и v1 (n, u, ms, s, m, h), и v2 (ns, us, ms, s) обозначения
+func ParseInfluxPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("unknown precision %q", precision)
+}
+
+// ParseInfluxLine - разбирает строку `measurement,tag=v field=1,other=2i 1700000000`.
+// Строковые поля пропускаются, булевы становятся 1/0. Без таймстемпа берется now (в наносекундах)
+func ParseInfluxLine(line string, precision time.Duration, now int64) (*InfluxLine, error) {
+	result := &InfluxLine{
+		Tags:   make(map[string]string),
+		Fields: make(map[string]float64),
+	}
+
+	measurement, pos := scanEscaped(line, 0, ", ", ", ")
+	if measurement == "" {
+		return nil, errors.New("missing measurement")
+	}
+	result.Measurement = measurement
+
+	for pos < len(line) && line[pos] == ',' {
+		var key, value string
+		key, pos = scanEscaped(line, pos+1, "=", ",= ")
+		if pos >= len(line) || line[pos] != '=' || key == "" {
+			return nil, fmt.Errorf("invalid tag set in %q", measurement)
+		}
+		value, pos = scanEscaped(line, pos+1, ", ", ",= ")
+		if value == "" {
+			return nil, fmt.Errorf("missing value for tag %q", key)
+		}
+		result.Tags[key] = value
+	}
+
+	pos = skipSpaces(line, pos)
+	if pos >= len(line) {
+		return nil, errors.New("missing fields")
+	}
+
+	hasFields := false
+	for {
+		var key string
+		key, pos = scanEscaped(line, pos, "=", ",= ")
+		if pos >= len(line) || line[pos] != '=' || key == "" {
+			return nil, errors.New("invalid field set")
+		}
+		pos++
+
+		var value string
+		quoted := pos < len(line) && line[pos] == '"'
+		if quoted {
+			var err error
+			if value, pos, err = scanQuoted(line, pos); err != nil {
+				return nil, err
+			}
+		} else {
+			start := pos
+			for pos < len(line) && line[pos] != ',' && line[pos] != ' ' {
+				pos++
+			}
+			value = line[start:pos]
+		}
+
+		hasFields = true
+		if !quoted {
+			number, err := parseInfluxFieldValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: %w", key, err)
+			}
+			result.Fields[key] = number
+		}
+
+		if pos >= len(line) || line[pos] != ',' {
+			break
+		}
+		pos++
+	}
+
+	if !hasFields {
+		return nil, errors.New("missing fields")
+	}
+
+	pos = skipSpaces(line, pos)
+	tsStr := strings.TrimSpace(line[pos:])
+	if tsStr == "" {
+		result.Timestamp = now
+		return result, nil
+	}
+
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", tsStr)
+	}
+	if ts > math.MaxInt64/int64(precision) || ts < math.MinInt64/int64(precision) {
+		return nil, fmt.Errorf("timestamp %d out of range for precision %s", ts, precision)
+	}
+	result.Timestamp = ts * int64(precision)
+
+	return result, nil
+}
+
+// AddTo - каждое числовое поле становится отдельным рядом measurement_field
+func (l *InfluxLine) AddTo(batch *Batch) {
+	for field, value := range l.Fields {
+		batch.Add(types.SeriesIdentifier{
+			Metric: l.Measurement + "_" + field,
+			Tags:   copyTags(l.Tags),
+		}, types.Point{
+			Timestamp: l.Timestamp,
+			Value:     value,
+		})
+	}
+}
+
+func parseInfluxFieldValue(value string) (float64, error) {
+	if value == "" {
+		return 0, errors.New("missing value")
+	}
+
+	switch value {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+
+	switch value[len(value)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer %q", value)
+		}
+		return float64(v), nil
+	case 'u':
+		v, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid unsigned integer %q", value)
+		}
+		return float64(v), nil
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid float %q", value)
+	}
+	if !types.IsFinite(v) {
+		return 0, fmt.Errorf("non-finite float %q", value)
+	}
+	return v, nil
+}
+
+// scanEscaped - читает до первого неэкранированного символа из stops.
+// Обратный слеш снимается только перед символами из escapable, иначе остается как есть
+func scanEscaped(line string, pos int, stops, escapable string) (string, int) {
+	var sb strings.Builder
+
+	for pos < len(line) {
+		c := line[pos]
+		if c == '\\' && pos+1 < len(line) && strings.IndexByte(escapable, line[pos+1]) >= 0 {
+			sb.WriteByte(line[pos+1])
+			pos += 2
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		sb.WriteByte(c)
+		pos++
+	}
+
+	return sb.String(), pos
+}
+
+func scanQuoted(line string, pos int) (string, int, error) {
+	var sb strings.Builder
+	pos++
+
+	for pos < len(line) {
+		c := line[pos]
+		if c == '\\' && pos+1 < len(line) && (line[pos+1] == '"' || line[pos+1] == '\\') {
+			sb.WriteByte(line[pos+1])
+			pos += 2
+			continue
+		}
+		if c == '"' {
+			return sb.String(), pos + 1, nil
+		}
+		sb.WriteByte(c)
+		pos++
+	}
+
+	return "", pos, errors.New("unterminated string field")
+}
+
+func skipSpaces(line string, pos int) int {
+	for pos < len(line) && line[pos] == ' ' {
+		pos++
+	}
+	return pos
+}
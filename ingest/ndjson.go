@@ -0,0 +1,76 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"tsdb/types"
+)
+
+// MaxNDJSONLineSize - строки длиннее отбрасываются целиком, чтобы один ряд не съел всю память
+const MaxNDJSONLineSize = 16 * 1024 * 1024
+
+// NDJSONLine - одна строка /write/ndjson: либо ряд с points, либо одна точка с timestamp и value
+type NDJSONLine struct {
+	Metric    string            `json:"metric"`
+	Tags      map[string]string `json:"tags"`
+	Points    []types.Point     `json:"points"`
+	Timestamp *int64            `json:"timestamp"`
+	Value     *float64          `json:"value"`
+}
+
+func ParseNDJSONLine(line []byte) (types.SeriesData, error) {
+	var parsed NDJSONLine
+	if err := json.Unmarshal(line, &parsed); err != nil {
+		return types.SeriesData{}, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	if parsed.Metric == "" {
+		return types.SeriesData{}, fmt.Errorf("missing metric")
+	}
+
+	points := parsed.Points
+	switch {
+	case points != nil && (parsed.Timestamp != nil || parsed.Value != nil):
+		return types.SeriesData{}, fmt.Errorf("line has both points and timestamp/value")
+	case points == nil:
+		if parsed.Timestamp == nil || parsed.Value == nil {
+			return types.SeriesData{}, fmt.Errorf("point line requires timestamp and value")
+		}
+		points = []types.Point{{Timestamp: *parsed.Timestamp, Value: *parsed.Value}}
+	case len(points) == 0:
+		return types.SeriesData{}, fmt.Errorf("empty points")
+	}
+
+	return types.SeriesData{
+		SeriesID: types.SeriesIdentifier{Metric: parsed.Metric, Tags: parsed.Tags},
+		Points:   points,
+	}, nil
+}
+
+// ReadNDJSONLine - следующая строка без '\n'. Если строка длиннее maxSize, ее остаток
+// вычитывается и отбрасывается, а tooLong = true. В конце потока возвращается io.EOF
+func ReadNDJSONLine(r *bufio.Reader, maxSize int) (line []byte, tooLong bool, err error) {
+	var buf []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if len(buf)+len(chunk) > maxSize+1 {
+				tooLong = true
+				buf = nil
+			} else {
+				buf = append(buf, chunk...)
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (len(buf) > 0 || tooLong) {
+			// последняя строка без '\n'
+			err = nil
+		}
+		return bytes.TrimRight(buf, "\r\n"), tooLong, err
+	}
+}
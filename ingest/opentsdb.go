@@ -0,0 +1,123 @@
+package ingest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb/types"
+)
+
+// maxOpenTSDBSeconds - таймстемпы длиннее 10 цифр OpenTSDB считает миллисекундами
+const maxOpenTSDBSeconds = 9999999999
+
+// OpenTSDBDataPoint - точка в формате HTTP /api/put
+type OpenTSDBDataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.Number       `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// NormalizeOpenTSDBTimestamp - секунды, миллисекунды или "секунды.миллисекунды" в наносекунды
+func NormalizeOpenTSDBTimestamp(raw string) (int64, error) {
+	if seconds, millis, found := strings.Cut(raw, "."); found {
+		if len(millis) == 0 || len(millis) > 3 {
+			return 0, fmt.Errorf("invalid timestamp %q", raw)
+		}
+		s, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil || s < 0 || s > maxOpenTSDBSeconds {
+			return 0, fmt.Errorf("invalid timestamp %q", raw)
+		}
+		ms, err := strconv.ParseInt((millis + "00")[:3], 10, 64)
+		if err != nil || ms < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", raw)
+		}
+		return s*int64(time.Second) + ms*int64(time.Millisecond), nil
+	}
+
+	ts, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, fmt.Errorf("invalid timestamp %q", raw)
+	}
+
+	if ts > maxOpenTSDBSeconds {
+		if ts > math.MaxInt64/int64(time.Millisecond) {
+			return 0, fmt.Errorf("timestamp %q out of range", raw)
+		}
+		return ts * int64(time.Millisecond), nil
+	}
+	return ts * int64(time.Second), nil
+}
+
+// ParseOpenTSDBPut - строка telnet-протокола "put <metric> <ts> <value> <tagk=tagv>..."
+func ParseOpenTSDBPut(line string) (Sample, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "put" {
+		return Sample{}, errors.New("expected: put <metric> <timestamp> <value> <tagk=tagv> [...]")
+	}
+
+	tags := make(map[string]string, len(fields)-4)
+	for _, pair := range fields[4:] {
+		k, v, found := strings.Cut(pair, "=")
+		if !found || k == "" || v == "" {
+			return Sample{}, fmt.Errorf("invalid tag %q", pair)
+		}
+		tags[k] = v
+	}
+
+	return newOpenTSDBSample(fields[1], fields[2], fields[3], tags)
+}
+
+func (dp *OpenTSDBDataPoint) Sample() (Sample, error) {
+	tags := dp.Tags
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	return newOpenTSDBSample(dp.Metric, dp.Timestamp.String(), dp.Value.String(), tags)
+}
+
+// ParseOpenTSDBDataPoints - тело /api/put бывает одиночным объектом или массивом
+func ParseOpenTSDBDataPoints(body []byte) ([]OpenTSDBDataPoint, error) {
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") {
+		var points []OpenTSDBDataPoint
+		if err := json.Unmarshal(body, &points); err != nil {
+			return nil, err
+		}
+		return points, nil
+	}
+
+	var point OpenTSDBDataPoint
+	if err := json.Unmarshal(body, &point); err != nil {
+		return nil, err
+	}
+	return []OpenTSDBDataPoint{point}, nil
+}
+
+func newOpenTSDBSample(metric, rawTimestamp, rawValue string, tags map[string]string) (Sample, error) {
+	if metric == "" {
+		return Sample{}, errors.New("missing metric")
+	}
+
+	timestamp, err := NormalizeOpenTSDBTimestamp(rawTimestamp)
+	if err != nil {
+		return Sample{}, err
+	}
+
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return Sample{}, fmt.Errorf("invalid value %q", rawValue)
+	}
+	if !types.IsFinite(value) {
+		return Sample{}, fmt.Errorf("non-finite value %q", rawValue)
+	}
+
+	return Sample{
+		SeriesID: types.SeriesIdentifier{Metric: metric, Tags: tags},
+		Point:    types.Point{Timestamp: timestamp, Value: value},
+	}, nil
+}
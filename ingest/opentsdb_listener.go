@@ -0,0 +1,77 @@
+package ingest
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+	"tsdb/types"
+)
+
+// OpenTSDBConfig - настройки telnet-приемника OpenTSDB
+type OpenTSDBConfig struct {
+	Addr          string
+	BatchSize     int
+	QueueSize     int
+	FlushInterval time.Duration
+}
+
+// OpenTSDBListener - telnet-протокол OpenTSDB: put, version и exit.
+// Как и OpenTSDB, на ошибочную команду отвечает текстом ошибки в соединение
+type OpenTSDBListener struct {
+	config OpenTSDBConfig
+	writer *BatchWriter
+	tcp    *tcpLineServer
+}
+
+func NewOpenTSDBListener(config OpenTSDBConfig, writer types.Writer) *OpenTSDBListener {
+	return &OpenTSDBListener{
+		config: config,
+		writer: NewBatchWriter(writer, config.BatchSize, config.QueueSize, config.FlushInterval),
+	}
+}
+
+func (l *OpenTSDBListener) Start() error {
+	tcp, err := listenTCPLines(l.config.Addr, l.handleLine)
+	if err != nil {
+		return err
+	}
+	l.tcp = tcp
+
+	l.writer.Start()
+	log.Printf("OpenTSDB telnet listener on %s", tcp.Addr())
+	tcp.Start()
+
+	return nil
+}
+
+func (l *OpenTSDBListener) Close() error {
+	l.tcp.Close()
+	l.writer.Close()
+	return nil
+}
+
+func (l *OpenTSDBListener) handleLine(conn net.Conn, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	command, _, _ := strings.Cut(line, " ")
+	switch command {
+	case "put":
+		sample, err := ParseOpenTSDBPut(line)
+		if err != nil {
+			fmt.Fprintf(conn, "put: %v\n", err)
+			return
+		}
+		l.writer.Add(sample)
+	case "version":
+		fmt.Fprintln(conn, "tsdb OpenTSDB-compatible telnet listener")
+	case "exit":
+		conn.Close()
+	default:
+		fmt.Fprintf(conn, "unknown command: %s\n", command)
+	}
+}
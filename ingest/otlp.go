@@ -0,0 +1,489 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"tsdb/types"
+)
+
+// Подмножество OTLP JSON (ExportMetricsServiceRequest), которое нужно для gauge, sum, histogram и summary
+
+const (
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+type OTLPMetricsRequest struct {
+	ResourceMetrics []OTLPResourceMetrics `json:"resourceMetrics"`
+}
+
+type OTLPResourceMetrics struct {
+	Resource     OTLPResource       `json:"resource"`
+	ScopeMetrics []OTLPScopeMetrics `json:"scopeMetrics"`
+}
+
+type OTLPResource struct {
+	Attributes []OTLPKeyValue `json:"attributes"`
+}
+
+type OTLPScopeMetrics struct {
+	Scope   OTLPScope    `json:"scope"`
+	Metrics []OTLPMetric `json:"metrics"`
+}
+
+type OTLPScope struct {
+	Name       string         `json:"name"`
+	Version    string         `json:"version"`
+	Attributes []OTLPKeyValue `json:"attributes"`
+}
+
+type OTLPMetric struct {
+	Name                 string           `json:"name"`
+	Gauge                *OTLPGauge       `json:"gauge"`
+	Sum                  *OTLPSum         `json:"sum"`
+	Histogram            *OTLPHistogram   `json:"histogram"`
+	Summary              *OTLPSummary     `json:"summary"`
+	ExponentialHistogram *OTLPUnsupported `json:"exponentialHistogram"`
+}
+
+type OTLPGauge struct {
+	DataPoints []OTLPNumberDataPoint `json:"dataPoints"`
+}
+
+type OTLPSum struct {
+	DataPoints             []OTLPNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality OTLPTemporality       `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type OTLPHistogram struct {
+	DataPoints             []OTLPHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality OTLPTemporality          `json:"aggregationTemporality"`
+}
+
+type OTLPSummary struct {
+	DataPoints []OTLPSummaryDataPoint `json:"dataPoints"`
+}
+
+type OTLPUnsupported struct {
+	DataPoints []json.RawMessage `json:"dataPoints"`
+}
+
+type OTLPNumberDataPoint struct {
+	Attributes   []OTLPKeyValue `json:"attributes"`
+	TimeUnixNano OTLPInt64      `json:"timeUnixNano"`
+	AsDouble     *float64       `json:"asDouble"`
+	AsInt        *OTLPInt64     `json:"asInt"`
+}
+
+type OTLPHistogramDataPoint struct {
+	Attributes     []OTLPKeyValue `json:"attributes"`
+	TimeUnixNano   OTLPInt64      `json:"timeUnixNano"`
+	Count          OTLPInt64      `json:"count"`
+	Sum            *float64       `json:"sum"`
+	BucketCounts   []OTLPInt64    `json:"bucketCounts"`
+	ExplicitBounds []float64      `json:"explicitBounds"`
+}
+
+type OTLPSummaryDataPoint struct {
+	Attributes     []OTLPKeyValue `json:"attributes"`
+	TimeUnixNano   OTLPInt64      `json:"timeUnixNano"`
+	Count          OTLPInt64      `json:"count"`
+	Sum            float64        `json:"sum"`
+	QuantileValues []struct {
+		Quantile float64 `json:"quantile"`
+		Value    float64 `json:"value"`
+	} `json:"quantileValues"`
+}
+
+type OTLPKeyValue struct {
+	Key   string       `json:"key"`
+	Value OTLPAnyValue `json:"value"`
+}
+
+type OTLPAnyValue struct {
+	StringValue *string    `json:"stringValue"`
+	BoolValue   *bool      `json:"boolValue"`
+	IntValue    *OTLPInt64 `json:"intValue"`
+	DoubleValue *float64   `json:"doubleValue"`
+	BytesValue  *string    `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []OTLPAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []OTLPKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+// OTLPInt64 - в OTLP JSON 64-битные числа приходят строками, но клиенты шлют и числа
+type OTLPInt64 int64
+
+func (v *OTLPInt64) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*v = 0
+		return nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(s, 10, 64)
+		if uerr != nil {
+			return fmt.Errorf("invalid int64 %s", data)
+		}
+		n = int64(u)
+	}
+	*v = OTLPInt64(n)
+	return nil
+}
+
+// OTLPTemporality - enum приходит либо числом, либо именем
+type OTLPTemporality int
+
+func (t *OTLPTemporality) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "1", "AGGREGATION_TEMPORALITY_DELTA":
+		*t = otlpTemporalityDelta
+	case "2", "AGGREGATION_TEMPORALITY_CUMULATIVE":
+		*t = otlpTemporalityCumulative
+	default:
+		*t = 0
+	}
+	return nil
+}
+
+const (
+	// otlpTotalTTL - итог delta-ряда, который столько не обновлялся, забывается
+	otlpTotalTTL = 30 * time.Minute
+	// maxOTLPTotals - больше итогов в памяти не держится, лишние забываются все разом
+	maxOTLPTotals = 100000
+)
+
+// LastPointReader - последняя записанная точка рядов, ее отдает engine.TSDBEngine
+type LastPointReader interface {
+	LastPoints(query types.Query) (types.QueryResult, error)
+}
+
+// OTLPConverter - переводит OTLP в точки. Delta-ряды накапливаются до cumulative,
+// чтобы их можно было читать так же, как счетчики Prometheus. Забытый итог (после рестарта
+// или по TTL) продолжается с последней записанной точки ряда
+type OTLPConverter struct {
+	mutex     sync.Mutex
+	totals    map[string]otlpTotal
+	lastPrune time.Time
+	last      LastPointReader
+}
+
+type otlpTotal struct {
+	value float64
+	seen  time.Time
+}
+
+// OTLPDeltas - delta одного запроса. В итоги конвертера они попадают через Commit только после
+// успешной записи: иначе повтор запроса экспортером сложил бы те же delta второй раз
+type OTLPDeltas struct {
+	base  map[string]float64
+	delta map[string]float64
+}
+
+// NewOTLPConverter - last может быть nil, тогда забытые итоги начинаются с нуля
+func NewOTLPConverter(last LastPointReader) *OTLPConverter {
+	return &OTLPConverter{
+		totals: make(map[string]otlpTotal),
+		last:   last,
+	}
+}
+
+// Convert - добавляет точки в batch и возвращает delta запроса для Commit и количество
+// отброшенных точек с причинами
+func (c *OTLPConverter) Convert(req *OTLPMetricsRequest, batch *Batch) (*OTLPDeltas, int, []string) {
+	deltas := &OTLPDeltas{base: make(map[string]float64), delta: make(map[string]float64)}
+	rejected := 0
+	var reasons []string
+	now := time.Now().UnixNano()
+
+	reject := func(n int, reason string) {
+		rejected += n
+		reasons = append(reasons, reason)
+	}
+
+	for _, rm := range req.ResourceMetrics {
+		resourceTags := make(map[string]string)
+		flattenOTLPAttributes(resourceTags, "", rm.Resource.Attributes)
+
+		for _, sm := range rm.ScopeMetrics {
+			scopeTags := copyTags(resourceTags)
+			if sm.Scope.Name != "" {
+				scopeTags["otel_scope_name"] = sm.Scope.Name
+			}
+			if sm.Scope.Version != "" {
+				scopeTags["otel_scope_version"] = sm.Scope.Version
+			}
+			flattenOTLPAttributes(scopeTags, "", sm.Scope.Attributes)
+
+			for _, metric := range sm.Metrics {
+				if metric.Name == "" {
+					reject(countOTLPPoints(metric), "metric without name")
+					continue
+				}
+
+				switch {
+				case metric.Gauge != nil:
+					for _, dp := range metric.Gauge.DataPoints {
+						if !c.addNumber(deltas, batch, metric.Name, scopeTags, dp, false, now) {
+							reject(1, fmt.Sprintf("%s: data point without value", metric.Name))
+						}
+					}
+				case metric.Sum != nil:
+					delta := metric.Sum.AggregationTemporality == otlpTemporalityDelta
+					for _, dp := range metric.Sum.DataPoints {
+						if !c.addNumber(deltas, batch, metric.Name, scopeTags, dp, delta, now) {
+							reject(1, fmt.Sprintf("%s: data point without value", metric.Name))
+						}
+					}
+				case metric.Histogram != nil:
+					delta := metric.Histogram.AggregationTemporality == otlpTemporalityDelta
+					for _, dp := range metric.Histogram.DataPoints {
+						if err := c.addHistogram(deltas, batch, metric.Name, scopeTags, dp, delta, now); err != nil {
+							reject(1, fmt.Sprintf("%s: %v", metric.Name, err))
+						}
+					}
+				case metric.Summary != nil:
+					for _, dp := range metric.Summary.DataPoints {
+						c.addSummary(batch, metric.Name, scopeTags, dp, now)
+					}
+				default:
+					reject(countOTLPPoints(metric), fmt.Sprintf("%s: unsupported metric type", metric.Name))
+				}
+			}
+		}
+	}
+
+	return deltas, rejected, reasons
+}
+
+func (c *OTLPConverter) addNumber(deltas *OTLPDeltas, batch *Batch, name string, scopeTags map[string]string, dp OTLPNumberDataPoint, delta bool, now int64) bool {
+	var value float64
+	switch {
+	case dp.AsDouble != nil:
+		value = *dp.AsDouble
+	case dp.AsInt != nil:
+		value = float64(*dp.AsInt)
+	default:
+		return false
+	}
+
+	tags := copyTags(scopeTags)
+	flattenOTLPAttributes(tags, "", dp.Attributes)
+	seriesID := types.SeriesIdentifier{Metric: name, Tags: tags}
+
+	if delta {
+		value = c.accumulate(deltas, seriesID, value)
+	}
+
+	batch.Add(seriesID, types.Point{Timestamp: otlpTimestamp(dp.TimeUnixNano, now), Value: value})
+	return true
+}
+
+// addHistogram - как в Prometheus: name_bucket с кумулятивными счетчиками по тегу le, name_sum и name_count
+func (c *OTLPConverter) addHistogram(deltas *OTLPDeltas, batch *Batch, name string, scopeTags map[string]string, dp OTLPHistogramDataPoint, delta bool, now int64) error {
+	if len(dp.BucketCounts) > 0 && len(dp.BucketCounts) != len(dp.ExplicitBounds)+1 {
+		return fmt.Errorf("%d bucket counts for %d bounds", len(dp.BucketCounts), len(dp.ExplicitBounds))
+	}
+
+	tags := copyTags(scopeTags)
+	flattenOTLPAttributes(tags, "", dp.Attributes)
+	timestamp := otlpTimestamp(dp.TimeUnixNano, now)
+
+	add := func(metric string, extra map[string]string, value float64) {
+		seriesTags := copyTags(tags)
+		for k, v := range extra {
+			seriesTags[k] = v
+		}
+		seriesID := types.SeriesIdentifier{Metric: metric, Tags: seriesTags}
+		if delta {
+			value = c.accumulate(deltas, seriesID, value)
+		}
+		batch.Add(seriesID, types.Point{Timestamp: timestamp, Value: value})
+	}
+
+	cumulative := 0.0
+	for i, count := range dp.BucketCounts {
+		cumulative += float64(count)
+		le := "+Inf"
+		if i < len(dp.ExplicitBounds) {
+			le = strconv.FormatFloat(dp.ExplicitBounds[i], 'g', -1, 64)
+		}
+		add(name+"_bucket", map[string]string{"le": le}, cumulative)
+	}
+
+	if dp.Sum != nil {
+		add(name+"_sum", nil, *dp.Sum)
+	}
+	add(name+"_count", nil, float64(dp.Count))
+
+	return nil
+}
+
+func (c *OTLPConverter) addSummary(batch *Batch, name string, scopeTags map[string]string, dp OTLPSummaryDataPoint, now int64) {
+	tags := copyTags(scopeTags)
+	flattenOTLPAttributes(tags, "", dp.Attributes)
+	timestamp := otlpTimestamp(dp.TimeUnixNano, now)
+
+	for _, qv := range dp.QuantileValues {
+		quantileTags := copyTags(tags)
+		quantileTags["quantile"] = strconv.FormatFloat(qv.Quantile, 'g', -1, 64)
+		batch.Add(types.SeriesIdentifier{Metric: name, Tags: quantileTags}, types.Point{Timestamp: timestamp, Value: qv.Value})
+	}
+
+	batch.Add(types.SeriesIdentifier{Metric: name + "_sum", Tags: copyTags(tags)}, types.Point{Timestamp: timestamp, Value: dp.Sum})
+	batch.Add(types.SeriesIdentifier{Metric: name + "_count", Tags: copyTags(tags)}, types.Point{Timestamp: timestamp, Value: float64(dp.Count)})
+}
+
+// accumulate - итог ряда с учетом delta запроса, в итоги конвертера ничего не пишется
+func (c *OTLPConverter) accumulate(deltas *OTLPDeltas, seriesID types.SeriesIdentifier, delta float64) float64 {
+	key := seriesKey(seriesID)
+
+	base, ok := deltas.base[key]
+	if !ok {
+		c.mutex.Lock()
+		total, known := c.totals[key]
+		c.mutex.Unlock()
+
+		base = total.value
+		if !known {
+			base = c.lastValue(seriesID, key)
+		}
+		deltas.base[key] = base
+	}
+
+	deltas.delta[key] += delta
+	return base + deltas.delta[key]
+}
+
+// lastValue - последняя записанная точка ряда, 0 если ряда еще нет
+func (c *OTLPConverter) lastValue(seriesID types.SeriesIdentifier, key string) float64 {
+	if c.last == nil {
+		return 0
+	}
+	result, err := c.last.LastPoints(types.Query{Metric: seriesID.Metric, Tags: seriesID.Tags})
+	if err != nil {
+		return 0
+	}
+	// по тегам находятся и ряды с дополнительными тегами
+	for _, series := range result.Series {
+		if seriesKey(series.SeriesID) == key && len(series.Points) > 0 {
+			return series.Points[len(series.Points)-1].Value
+		}
+	}
+	return 0
+}
+
+// Commit - переносит delta записанного запроса в итоги
+func (c *OTLPConverter) Commit(deltas *OTLPDeltas) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, delta := range deltas.delta {
+		total, ok := c.totals[key]
+		if !ok {
+			total.value = deltas.base[key]
+		}
+		total.value += delta
+		total.seen = now
+		c.totals[key] = total
+	}
+
+	if now.Sub(c.lastPrune) > time.Minute {
+		c.lastPrune = now
+		for key, total := range c.totals {
+			if now.Sub(total.seen) > otlpTotalTTL {
+				delete(c.totals, key)
+			}
+		}
+	}
+	if len(c.totals) > maxOTLPTotals {
+		c.totals = make(map[string]otlpTotal)
+	}
+}
+
+// flattenOTLPAttributes - вложенные kvlist разворачиваются в ключи через точку, массивы - в JSON
+func flattenOTLPAttributes(tags map[string]string, prefix string, attributes []OTLPKeyValue) {
+	for _, kv := range attributes {
+		key := kv.Key
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if kv.Value.KvlistValue != nil {
+			flattenOTLPAttributes(tags, key, kv.Value.KvlistValue.Values)
+			continue
+		}
+
+		if value := otlpValueString(kv.Value); value != "" {
+			tags[key] = value
+		}
+	}
+}
+
+func otlpValueString(v OTLPAnyValue) string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	case v.ArrayValue != nil:
+		values := make([]string, len(v.ArrayValue.Values))
+		for i, item := range v.ArrayValue.Values {
+			values[i] = otlpValueString(item)
+		}
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(values)
+		return strings.TrimSpace(buf.String())
+	}
+	return ""
+}
+
+func otlpTimestamp(ts OTLPInt64, now int64) int64 {
+	if ts <= 0 {
+		return now
+	}
+	return int64(ts)
+}
+
+func countOTLPPoints(metric OTLPMetric) int {
+	switch {
+	case metric.Gauge != nil:
+		return len(metric.Gauge.DataPoints)
+	case metric.Sum != nil:
+		return len(metric.Sum.DataPoints)
+	case metric.Histogram != nil:
+		return len(metric.Histogram.DataPoints)
+	case metric.Summary != nil:
+		return len(metric.Summary.DataPoints)
+	case metric.ExponentialHistogram != nil:
+		return len(metric.ExponentialHistogram.DataPoints)
+	}
+	return 0
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package ingest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb/types"
+)
+
+// ParsePrometheusText - текстовый формат экспозиции Prometheus (version=0.0.4).
+// Таймстемпы в файле в миллисекундах, у семплов без таймстемпа берется defaultTimestamp (наносекунды).
+// sampleLimit > 0 - разбор прерывается ошибкой, как только семплов становится больше
+func ParsePrometheusText(r io.Reader, defaultTimestamp int64, sampleLimit int) ([]Sample, error) {
+	var samples []Sample
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sample, err := parsePrometheusLine(line, defaultTimestamp)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if sampleLimit > 0 && len(samples) >= sampleLimit {
+			return nil, fmt.Errorf("sample limit %d exceeded", sampleLimit)
+		}
+		samples = append(samples, sample)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+func parsePrometheusLine(line string, defaultTimestamp int64) (Sample, error) {
+	pos := 0
+	for pos < len(line) && line[pos] != '{' && line[pos] != ' ' && line[pos] != '\t' {
+		pos++
+	}
+
+	name := line[:pos]
+	if name == "" {
+		return Sample{}, fmt.Errorf("missing metric name in %q", line)
+	}
+
+	tags := make(map[string]string)
+	if pos < len(line) && line[pos] == '{' {
+		var err error
+		if pos, err = parsePrometheusLabels(line, pos+1, tags); err != nil {
+			return Sample{}, err
+		}
+	}
+
+	fields := strings.Fields(line[pos:])
+	if len(fields) == 0 || len(fields) > 2 {
+		return Sample{}, fmt.Errorf("invalid sample %q", line)
+	}
+
+	value, err := parsePrometheusValue(fields[0])
+	if err != nil {
+		return Sample{}, err
+	}
+
+	timestamp := defaultTimestamp
+	if len(fields) == 2 {
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || ms > math.MaxInt64/int64(time.Millisecond) || ms < math.MinInt64/int64(time.Millisecond) {
+			return Sample{}, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		timestamp = ms * int64(time.Millisecond)
+	}
+
+	return Sample{
+		SeriesID: types.SeriesIdentifier{Metric: name, Tags: tags},
+		Point:    types.Point{Timestamp: timestamp, Value: value},
+	}, nil
+}
+
+// parsePrometheusLabels - разбирает `name="value",...}` начиная с pos, возвращает позицию после '}'
+func parsePrometheusLabels(line string, pos int, tags map[string]string) (int, error) {
+	for {
+		for pos < len(line) && (line[pos] == ' ' || line[pos] == ',') {
+			pos++
+		}
+		if pos >= len(line) {
+			return pos, fmt.Errorf("unterminated label set in %q", line)
+		}
+		if line[pos] == '}' {
+			return pos + 1, nil
+		}
+
+		eq := strings.IndexByte(line[pos:], '=')
+		if eq <= 0 {
+			return pos, fmt.Errorf("invalid label in %q", line)
+		}
+		name := strings.TrimSpace(line[pos : pos+eq])
+		pos += eq + 1
+
+		for pos < len(line) && line[pos] == ' ' {
+			pos++
+		}
+		if pos >= len(line) || line[pos] != '"' {
+			return pos, fmt.Errorf("label %q value is not quoted", name)
+		}
+		pos++
+
+		var sb strings.Builder
+		closed := false
+		for pos < len(line) {
+			c := line[pos]
+			if c == '\\' && pos+1 < len(line) {
+				switch line[pos+1] {
+				case 'n':
+					sb.WriteByte('\n')
+				case '\\', '"':
+					sb.WriteByte(line[pos+1])
+				default:
+					sb.WriteByte('\\')
+					sb.WriteByte(line[pos+1])
+				}
+				pos += 2
+				continue
+			}
+			if c == '"' {
+				closed = true
+				pos++
+				break
+			}
+			sb.WriteByte(c)
+			pos++
+		}
+		if !closed {
+			return pos, fmt.Errorf("unterminated value for label %q", name)
+		}
+
+		// пустое значение метки в Prometheus равносильно ее отсутствию
+		if value := sb.String(); value != "" {
+			tags[name] = value
+		}
+	}
+}
+
+func parsePrometheusValue(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
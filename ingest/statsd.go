@@ -0,0 +1,117 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsDMetric - одно значение из пакета StatsD
+type StatsDMetric struct {
+	Name       string
+	Type       string
+	Value      float64
+	SetMember  string
+	Relative   bool
+	SampleRate float64
+	Tags       map[string]string
+}
+
+// ParseStatsDLine - разбирает "name:value|type[|@rate][|#tag:value,...]" (теги в стиле DogStatsD).
+// Для gauge знак перед значением означает изменение относительно прошлого значения
+func ParseStatsDLine(line string) (*StatsDMetric, error) {
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return nil, fmt.Errorf("invalid statsd line %q", line)
+	}
+
+	metric := &StatsDMetric{
+		Name:       line[:colon],
+		SampleRate: 1,
+		Tags:       make(map[string]string),
+	}
+
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("missing type in %q", line)
+	}
+
+	metric.Type = parts[1]
+	switch metric.Type {
+	case "c", "g", "ms", "h", "d", "s":
+	default:
+		return nil, fmt.Errorf("unknown metric type %q", metric.Type)
+	}
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid sample rate %q", part)
+			}
+			metric.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				if k, v, found := strings.Cut(tag, ":"); found {
+					metric.Tags[k] = v
+				} else {
+					// теги без значения у DogStatsD встречаются часто, храним их как флаг
+					metric.Tags[tag] = "true"
+				}
+			}
+		}
+	}
+
+	raw := parts[0]
+	if raw == "" {
+		return nil, errors.New("missing value")
+	}
+
+	if metric.Type == "s" {
+		metric.SetMember = raw
+		return metric, nil
+	}
+
+	if metric.Type == "g" && (raw[0] == '+' || raw[0] == '-') {
+		metric.Relative = true
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", raw)
+	}
+	metric.Value = value
+
+	return metric, nil
+}
+
+// quantile - линейная интерполяция по отсортированным значениям
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	weight := rank - float64(lower)
+
+	return sorted[lower]*(1-weight) + sorted[upper]*weight
+}
+
+func sortedCopy(values []float64) []float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	return sorted
+}
@@ -0,0 +1,271 @@
+package ingest
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"tsdb/types"
+)
+
+// StatsDConfig - настройки сервера StatsD
+type StatsDConfig struct {
+	Addr          string
+	FlushInterval time.Duration
+}
+
+// StatsDServer - прием StatsD по UDP с агрегацией в памяти на интервал сброса.
+// На каждом сбросе в движок пишутся производные ряды:
+//   - counter: name_count, name_rate
+//   - timer/histogram/distribution: name_count, name_rate, name_sum, name_min, name_max, name_mean, name_p50, name_p90, name_p99
+//   - gauge: name (последнее значение, только если обновлялся за интервал)
+//   - set: name_cardinality
+type StatsDServer struct {
+	config StatsDConfig
+	writer types.Writer
+	conn   net.PacketConn
+
+	mutex    sync.Mutex
+	counters map[string]*statsdCounter
+	timers   map[string]*statsdTimer
+	gauges   map[string]*statsdGauge
+	sets     map[string]*statsdSet
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type statsdCounter struct {
+	seriesID types.SeriesIdentifier
+	value    float64
+}
+
+type statsdTimer struct {
+	seriesID types.SeriesIdentifier
+	values   []float64
+	count    float64
+}
+
+type statsdGauge struct {
+	seriesID types.SeriesIdentifier
+	value    float64
+	updated  bool
+}
+
+type statsdSet struct {
+	seriesID types.SeriesIdentifier
+	members  map[string]struct{}
+}
+
+var statsdPercentiles = []struct {
+	suffix string
+	q      float64
+}{
+	{"_p50", 0.5},
+	{"_p90", 0.9},
+	{"_p99", 0.99},
+}
+
+func NewStatsDServer(config StatsDConfig, writer types.Writer) *StatsDServer {
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 10 * time.Second
+	}
+
+	return &StatsDServer{
+		config:   config,
+		writer:   writer,
+		counters: make(map[string]*statsdCounter),
+		timers:   make(map[string]*statsdTimer),
+		gauges:   make(map[string]*statsdGauge),
+		sets:     make(map[string]*statsdSet),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *StatsDServer) Start() error {
+	conn, err := net.ListenPacket("udp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+
+	log.Printf("StatsD UDP listener on %s, flush interval %s", conn.LocalAddr(), s.config.FlushInterval)
+
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.flushLoop()
+
+	return nil
+}
+
+// Close - останавливает прием и сбрасывает накопленное за неполный интервал
+func (s *StatsDServer) Close() error {
+	close(s.done)
+	err := s.conn.Close()
+	s.wg.Wait()
+	s.Flush(time.Now())
+	return err
+}
+
+func (s *StatsDServer) readLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			metric, err := ParseStatsDLine(line)
+			if err != nil {
+				log.Printf("StatsD: %v", err)
+				continue
+			}
+			s.Add(metric)
+		}
+	}
+}
+
+func (s *StatsDServer) flushLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.Flush(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *StatsDServer) Add(metric *StatsDMetric) {
+	seriesID := types.SeriesIdentifier{Metric: metric.Name, Tags: metric.Tags}
+	key := metric.Type + "\x00" + seriesKey(seriesID)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch metric.Type {
+	case "c":
+		counter, exists := s.counters[key]
+		if !exists {
+			counter = &statsdCounter{seriesID: seriesID}
+			s.counters[key] = counter
+		}
+		counter.value += metric.Value / metric.SampleRate
+
+	case "ms", "h", "d":
+		timer, exists := s.timers[key]
+		if !exists {
+			timer = &statsdTimer{seriesID: seriesID}
+			s.timers[key] = timer
+		}
+		timer.values = append(timer.values, metric.Value)
+		timer.count += 1 / metric.SampleRate
+
+	case "g":
+		gauge, exists := s.gauges[key]
+		if !exists {
+			gauge = &statsdGauge{seriesID: seriesID}
+			s.gauges[key] = gauge
+		}
+		if metric.Relative {
+			gauge.value += metric.Value
+		} else {
+			gauge.value = metric.Value
+		}
+		gauge.updated = true
+
+	case "s":
+		set, exists := s.sets[key]
+		if !exists {
+			set = &statsdSet{seriesID: seriesID, members: make(map[string]struct{})}
+			s.sets[key] = set
+		}
+		set.members[metric.SetMember] = struct{}{}
+	}
+}
+
+// Flush - пишет агрегаты за интервал. Счетчики, таймеры и множества обнуляются,
+// gauge хранит значение для относительных изменений, но пишется только после обновления
+func (s *StatsDServer) Flush(now time.Time) {
+	s.mutex.Lock()
+	counters, timers, sets := s.counters, s.timers, s.sets
+	s.counters = make(map[string]*statsdCounter)
+	s.timers = make(map[string]*statsdTimer)
+	s.sets = make(map[string]*statsdSet)
+
+	batch := NewBatch()
+	timestamp := now.UnixNano()
+	interval := s.config.FlushInterval.Seconds()
+
+	for _, gauge := range s.gauges {
+		if gauge.updated {
+			addStatsDPoint(batch, gauge.seriesID, "", timestamp, gauge.value)
+			gauge.updated = false
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, counter := range counters {
+		addStatsDPoint(batch, counter.seriesID, "_count", timestamp, counter.value)
+		addStatsDPoint(batch, counter.seriesID, "_rate", timestamp, counter.value/interval)
+	}
+
+	for _, timer := range timers {
+		sorted := sortedCopy(timer.values)
+
+		sum := 0.0
+		for _, v := range sorted {
+			sum += v
+		}
+
+		addStatsDPoint(batch, timer.seriesID, "_count", timestamp, timer.count)
+		addStatsDPoint(batch, timer.seriesID, "_rate", timestamp, timer.count/interval)
+		addStatsDPoint(batch, timer.seriesID, "_sum", timestamp, sum)
+		addStatsDPoint(batch, timer.seriesID, "_min", timestamp, sorted[0])
+		addStatsDPoint(batch, timer.seriesID, "_max", timestamp, sorted[len(sorted)-1])
+		addStatsDPoint(batch, timer.seriesID, "_mean", timestamp, sum/float64(len(sorted)))
+		for _, p := range statsdPercentiles {
+			addStatsDPoint(batch, timer.seriesID, p.suffix, timestamp, quantile(sorted, p.q))
+		}
+	}
+
+	for _, set := range sets {
+		addStatsDPoint(batch, set.seriesID, "_cardinality", timestamp, float64(len(set.members)))
+	}
+
+	points := batch.Len()
+	if err := batch.Flush(s.writer); err != nil {
+		log.Printf("StatsD: failed to write %d points: %v", points, err)
+	}
+}
+
+func addStatsDPoint(batch *Batch, seriesID types.SeriesIdentifier, suffix string, timestamp int64, value float64) {
+	if !types.IsFinite(value) {
+		return
+	}
+
+	batch.Add(types.SeriesIdentifier{
+		Metric: seriesID.Metric + suffix,
+		Tags:   copyTags(seriesID.Tags),
+	}, types.Point{
+		Timestamp: timestamp,
+		Value:     value,
+	})
+}
@@ -0,0 +1,94 @@
+package ingest
+
+import (
+	"bufio"
+	"net"
+	"sync"
+)
+
+// tcpLineServer - TCP-сервер построчного протокола. Соединения отслеживаются,
+// чтобы Close мог их закрыть и дождаться обработчиков
+type tcpLineServer struct {
+	listener net.Listener
+	handle   func(conn net.Conn, line string)
+	conns    map[net.Conn]struct{}
+	closed   bool
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+}
+
+func listenTCPLines(addr string, handle func(conn net.Conn, line string)) (*tcpLineServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcpLineServer{
+		listener: listener,
+		handle:   handle,
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+func (s *tcpLineServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *tcpLineServer) Start() {
+	s.wg.Add(1)
+	go s.accept()
+}
+
+func (s *tcpLineServer) Close() {
+	s.listener.Close()
+
+	s.mutex.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *tcpLineServer) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *tcpLineServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.handle(conn, scanner.Text())
+	}
+}
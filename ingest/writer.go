@@ -0,0 +1,97 @@
+package ingest
+
+import (
+	"log"
+	"time"
+	"tsdb/types"
+)
+
+// Sample - одна точка ряда в очереди записи
+type Sample struct {
+	SeriesID types.SeriesIdentifier
+	Point    types.Point
+}
+
+// BatchWriter - очередь точек с фоновой записью батчами.
+// Add блокируется на заполненной очереди: если движок не успевает, читатели сокетов
+// перестают читать и TCP-отправители упираются в окно приема
+type BatchWriter struct {
+	writer        types.Writer
+	queue         chan Sample
+	batchSize     int
+	flushInterval time.Duration
+	stopped       chan struct{}
+}
+
+func NewBatchWriter(writer types.Writer, batchSize, queueSize int, flushInterval time.Duration) *BatchWriter {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if queueSize <= 0 {
+		queueSize = batchSize * 2
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	return &BatchWriter{
+		writer:        writer,
+		queue:         make(chan Sample, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		stopped:       make(chan struct{}),
+	}
+}
+
+func (w *BatchWriter) Start() {
+	go w.run()
+}
+
+// Add - несохраняемое значение (types.IsFinite) движок отклоняет вместе со всем батчем, включая точки
+// других клиентов, поэтому такие точки отбрасываются здесь
+func (w *BatchWriter) Add(sample Sample) {
+	if !types.IsFinite(sample.Point.Value) {
+		log.Printf("Dropping non-finite value %v of %s", sample.Point.Value, sample.SeriesID.Metric)
+		return
+	}
+	w.queue <- sample
+}
+
+// Close - дописывает все, что осталось в очереди. После Close вызывать Add нельзя
+func (w *BatchWriter) Close() {
+	close(w.queue)
+	<-w.stopped
+}
+
+func (w *BatchWriter) run() {
+	defer close(w.stopped)
+
+	batch := NewBatch()
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		points := batch.Len()
+		if err := batch.Flush(w.writer); err != nil {
+			log.Printf("Failed to write batch of %d points: %v", points, err)
+		}
+	}
+
+	for {
+		select {
+		case sample, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch.Add(sample.SeriesID, sample.Point)
+			if batch.Len() >= w.batchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -5,16 +5,36 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 	"tsdb/api"
 	"tsdb/engine"
+	"tsdb/ingest"
+	"tsdb/scrape"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+
 	dataDir := flag.String("data-dir", "./tsdb_data", "Data directory")
 	host := flag.String("host", "localhost", "Server host")
 	port := flag.Int("port", 8080, "Server port")
 	blockSize := flag.Int("block-size", 1000, "Points per block")
+	graphiteTCP := flag.String("graphite-tcp", "", "Graphite plaintext TCP listen address (disabled if empty)")
+	graphiteUDP := flag.String("graphite-udp", "", "Graphite plaintext UDP listen address (disabled if empty)")
+	graphiteTemplates := flag.String("graphite-templates", "", "Graphite templates separated by ';', e.g. \"servers.* .host.measurement* env=prod\"")
+	graphiteSeparator := flag.String("graphite-separator", ".", "Separator for joined measurement parts")
+	statsdAddr := flag.String("statsd-addr", "", "StatsD UDP listen address (disabled if empty)")
+	statsdFlushInterval := flag.Duration("statsd-flush-interval", 10*time.Second, "StatsD aggregation flush interval")
+	opentsdbAddr := flag.String("opentsdb-addr", "", "OpenTSDB telnet listen address (disabled if empty)")
+	scrapeConfig := flag.String("scrape-config", "", "Path to JSON scrape config (scraping disabled if empty)")
+	queryTimeout := flag.Duration("query-timeout", 2*time.Minute, "Maximum duration of a read query (0 - no limit)")
+	maxSeries := flag.Int("max-series", 50000, "Maximum number of series a read query may return (0 - no limit)")
+	maxPoints := flag.Int("max-points", 20000000, "Maximum number of points a read query may load (0 - no limit)")
 	flag.Parse()
 
 	log.Println("Initializing TSDB...")
@@ -23,8 +43,55 @@ func main() {
 		log.Fatalf("Failed to create TSDB: %v", err)
 	}
 	defer tsdb.Close()
+	tsdb.Limits = engine.QueryLimits{MaxSeries: *maxSeries, MaxPoints: *maxPoints}
+
+	if *graphiteTCP != "" || *graphiteUDP != "" {
+		graphite, err := ingest.NewGraphiteListener(ingest.GraphiteConfig{
+			TCPAddr:   *graphiteTCP,
+			UDPAddr:   *graphiteUDP,
+			Templates: strings.Split(*graphiteTemplates, ";"),
+			Separator: *graphiteSeparator,
+		}, tsdb)
+		if err != nil {
+			log.Fatalf("Invalid graphite config: %v", err)
+		}
+		if err := graphite.Start(); err != nil {
+			log.Fatalf("Failed to start graphite listener: %v", err)
+		}
+		defer graphite.Close()
+	}
+
+	if *statsdAddr != "" {
+		statsd := ingest.NewStatsDServer(ingest.StatsDConfig{
+			Addr:          *statsdAddr,
+			FlushInterval: *statsdFlushInterval,
+		}, tsdb)
+		if err := statsd.Start(); err != nil {
+			log.Fatalf("Failed to start statsd server: %v", err)
+		}
+		defer statsd.Close()
+	}
+
+	if *opentsdbAddr != "" {
+		opentsdb := ingest.NewOpenTSDBListener(ingest.OpenTSDBConfig{Addr: *opentsdbAddr}, tsdb)
+		if err := opentsdb.Start(); err != nil {
+			log.Fatalf("Failed to start opentsdb listener: %v", err)
+		}
+		defer opentsdb.Close()
+	}
+
+	if *scrapeConfig != "" {
+		config, err := scrape.LoadConfig(*scrapeConfig)
+		if err != nil {
+			log.Fatalf("Invalid scrape config: %v", err)
+		}
+		scraper := scrape.NewManager(config, tsdb)
+		scraper.Start()
+		defer scraper.Stop()
+	}
 
 	server := api.NewServer(tsdb, *host, *port)
+	server.QueryTimeout = *queryTimeout
 
 	go func() {
 		if err := server.Start(); err != nil {
@@ -35,8 +102,21 @@ func main() {
 	log.Printf("TSDB server running on http://%s:%d", *host, *port)
 	log.Println("Endpoints:")
 	log.Println("  POST /write - Write data")
+	log.Println("  POST /write/ndjson - Streaming NDJSON write")
 	log.Println("  GET  /query - Query data")
+	log.Println("  GET  /query/last - Last point of each series")
+	log.Println("  GET  /query/expr - Arithmetic between series")
 	log.Println("  GET  /health - Health check")
+	log.Println("  GET  /labels, /label/{key}/values, /metrics - Tag names, tag values and metric names")
+	log.Println("  GET  /status/cardinality - Series cardinality")
+	log.Println("  GET  /sql - SQL SELECT queries")
+	log.Println("  POST /api/v1/write - Prometheus remote_write")
+	log.Println("  POST /api/v1/read - Prometheus remote_read")
+	log.Println("  GET  /api/v1/query, /api/v1/query_range - PromQL")
+	log.Println("  POST /api/v2/write, /write?db= - InfluxDB line protocol")
+	log.Println("  POST /api/put - OpenTSDB JSON put")
+	log.Println("  POST /v1/metrics - OTLP/HTTP JSON metrics")
+	log.Println("  POST /import/csv - CSV bulk import")
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
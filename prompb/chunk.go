@@ -0,0 +1,145 @@
+package prompb
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// MaxSamplesPerChunk - столько же семплов кладет в XOR-чанк сам Prometheus
+const MaxSamplesPerChunk = 120
+
+// XORChunkEncoder - кодировщик чанков Prometheus (tsdb/chunkenc XOR): delta-of-delta для времени и XOR для значений
+type XORChunkEncoder struct {
+	stream   bitStream
+	count    uint16
+	t        int64
+	v        float64
+	tDelta   uint64
+	leading  uint8
+	trailing uint8
+}
+
+func NewXORChunkEncoder() *XORChunkEncoder {
+	e := &XORChunkEncoder{leading: 0xff}
+	e.stream.buf = make([]byte, 2, 128)
+	return e
+}
+
+func (e *XORChunkEncoder) NumSamples() int {
+	return int(e.count)
+}
+
+func (e *XORChunkEncoder) Append(t int64, v float64) {
+	switch e.count {
+	case 0:
+		var buf [binary.MaxVarintLen64]byte
+		for _, b := range buf[:binary.PutVarint(buf[:], t)] {
+			e.stream.writeByte(b)
+		}
+		e.stream.writeBits(math.Float64bits(v), 64)
+
+	case 1:
+		tDelta := uint64(t - e.t)
+		var buf [binary.MaxVarintLen64]byte
+		for _, b := range buf[:binary.PutUvarint(buf[:], tDelta)] {
+			e.stream.writeByte(b)
+		}
+		e.writeValue(v)
+		e.tDelta = tDelta
+
+	default:
+		tDelta := uint64(t - e.t)
+		dod := int64(tDelta - e.tDelta)
+
+		switch {
+		case dod == 0:
+			e.stream.writeBit(false)
+		case bitRange(dod, 14):
+			e.stream.writeBits(0b10, 2)
+			e.stream.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			e.stream.writeBits(0b110, 3)
+			e.stream.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			e.stream.writeBits(0b1110, 4)
+			e.stream.writeBits(uint64(dod), 20)
+		default:
+			e.stream.writeBits(0b1111, 4)
+			e.stream.writeBits(uint64(dod), 64)
+		}
+
+		e.writeValue(v)
+		e.tDelta = tDelta
+	}
+
+	e.t = t
+	e.v = v
+	e.count++
+	binary.BigEndian.PutUint16(e.stream.buf, e.count)
+}
+
+func (e *XORChunkEncoder) Bytes() []byte {
+	return e.stream.buf
+}
+
+func (e *XORChunkEncoder) writeValue(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(e.v)
+	if delta == 0 {
+		e.stream.writeBit(false)
+		return
+	}
+	e.stream.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+	if leading >= 32 {
+		leading = 31
+	}
+
+	if e.leading != 0xff && leading >= e.leading && trailing >= e.trailing {
+		e.stream.writeBit(false)
+		e.stream.writeBits(delta>>e.trailing, 64-int(e.leading)-int(e.trailing))
+		return
+	}
+
+	e.leading, e.trailing = leading, trailing
+	sigbits := 64 - leading - trailing
+
+	e.stream.writeBit(true)
+	e.stream.writeBits(uint64(leading), 5)
+	// 64 значащих бита не помещаются в 6 бит и пишутся как 0
+	e.stream.writeBits(uint64(sigbits), 6)
+	e.stream.writeBits(delta>>trailing, int(sigbits))
+}
+
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+// bitStream - запись битов старшими вперед
+type bitStream struct {
+	buf  []byte
+	free uint8
+}
+
+func (s *bitStream) writeBit(bit bool) {
+	if s.free == 0 {
+		s.buf = append(s.buf, 0)
+		s.free = 8
+	}
+	if bit {
+		s.buf[len(s.buf)-1] |= 1 << (s.free - 1)
+	}
+	s.free--
+}
+
+func (s *bitStream) writeByte(b byte) {
+	s.writeBits(uint64(b), 8)
+}
+
+func (s *bitStream) writeBits(u uint64, nbits int) {
+	for i := nbits - 1; i >= 0; i-- {
+		s.writeBit((u>>uint(i))&1 == 1)
+	}
+}
@@ -0,0 +1,314 @@
+package prompb
+
+import "encoding/binary"
+
+// Сообщения из prometheus/prompb/remote.proto
+
+// WriteRequest - тело запроса remote_write
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+func (r *WriteRequest) Unmarshal(data []byte) error {
+	d := newDecoder(data)
+	for !d.done() {
+		field, wireType, err := d.key()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wireType == wireBytes:
+			var b []byte
+			if b, err = d.bytes(); err != nil {
+				return err
+			}
+			var ts TimeSeries
+			if err = ts.Unmarshal(b); err != nil {
+				return err
+			}
+			r.Timeseries = append(r.Timeseries, ts)
+		default:
+			// metadata (поле 3) не храним
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *WriteRequest) Marshal() []byte {
+	var buf []byte
+	for i := range r.Timeseries {
+		buf = appendMessage(buf, 1, r.Timeseries[i].Marshal())
+	}
+	return buf
+}
+
+// ReadRequest_ResponseType - формат ответа, который готов принять клиент
+type ReadRequest_ResponseType int
+
+const (
+	ReadRequest_SAMPLES             ReadRequest_ResponseType = 0
+	ReadRequest_STREAMED_XOR_CHUNKS ReadRequest_ResponseType = 1
+)
+
+// LabelMatcher_Type - тип условия на метку
+type LabelMatcher_Type int
+
+const (
+	LabelMatcher_EQ  LabelMatcher_Type = 0
+	LabelMatcher_NEQ LabelMatcher_Type = 1
+	LabelMatcher_RE  LabelMatcher_Type = 2
+	LabelMatcher_NRE LabelMatcher_Type = 3
+)
+
+// Chunk_Encoding - кодировка данных чанка
+type Chunk_Encoding int
+
+const (
+	Chunk_UNKNOWN Chunk_Encoding = 0
+	Chunk_XOR     Chunk_Encoding = 1
+)
+
+// ReadRequest - тело запроса remote_read
+type ReadRequest struct {
+	Queries               []Query
+	AcceptedResponseTypes []ReadRequest_ResponseType
+}
+
+// Query - один запрос внутри ReadRequest, время в миллисекундах
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+// LabelMatcher - условие на метку
+type LabelMatcher struct {
+	Type  LabelMatcher_Type
+	Name  string
+	Value string
+}
+
+// ReadResponse - ответ remote_read в формате SAMPLES, по результату на каждый Query
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+// QueryResult - ряды, найденные по одному Query
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+// ChunkedReadResponse - один фрейм потокового ответа STREAMED_XOR_CHUNKS
+type ChunkedReadResponse struct {
+	ChunkedSeries []ChunkedSeries
+	QueryIndex    int64
+}
+
+// ChunkedSeries - ряд, закодированный в чанки
+type ChunkedSeries struct {
+	Labels []Label
+	Chunks []Chunk
+}
+
+// Chunk - закодированный отрезок ряда
+type Chunk struct {
+	MinTimeMs int64
+	MaxTimeMs int64
+	Type      Chunk_Encoding
+	Data      []byte
+}
+
+func (r *ReadRequest) Unmarshal(data []byte) error {
+	d := newDecoder(data)
+	for !d.done() {
+		field, wireType, err := d.key()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wireType == wireBytes:
+			var b []byte
+			if b, err = d.bytes(); err != nil {
+				return err
+			}
+			var q Query
+			if err = q.Unmarshal(b); err != nil {
+				return err
+			}
+			r.Queries = append(r.Queries, q)
+		case field == 2 && wireType == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			r.AcceptedResponseTypes = append(r.AcceptedResponseTypes, ReadRequest_ResponseType(v))
+		case field == 2 && wireType == wireBytes:
+			// packed repeated enum
+			var b []byte
+			if b, err = d.bytes(); err != nil {
+				return err
+			}
+			packed := newDecoder(b)
+			for !packed.done() {
+				v, err := packed.varint()
+				if err != nil {
+					return err
+				}
+				r.AcceptedResponseTypes = append(r.AcceptedResponseTypes, ReadRequest_ResponseType(v))
+			}
+		default:
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ReadRequest) Marshal() []byte {
+	var buf []byte
+	for i := range r.Queries {
+		buf = appendMessage(buf, 1, r.Queries[i].Marshal())
+	}
+	if len(r.AcceptedResponseTypes) > 0 {
+		var packed []byte
+		for _, t := range r.AcceptedResponseTypes {
+			packed = binary.AppendUvarint(packed, uint64(t))
+		}
+		buf = appendMessage(buf, 2, packed)
+	}
+	return buf
+}
+
+func (q *Query) Unmarshal(data []byte) error {
+	d := newDecoder(data)
+	for !d.done() {
+		field, wireType, err := d.key()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wireType == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			q.StartTimestampMs = int64(v)
+		case field == 2 && wireType == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			q.EndTimestampMs = int64(v)
+		case field == 3 && wireType == wireBytes:
+			var b []byte
+			if b, err = d.bytes(); err != nil {
+				return err
+			}
+			var m LabelMatcher
+			if err = m.Unmarshal(b); err != nil {
+				return err
+			}
+			q.Matchers = append(q.Matchers, m)
+		default:
+			// hints (поле 4) игнорируем
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Query) Marshal() []byte {
+	var buf []byte
+	buf = appendVarint(buf, 1, uint64(q.StartTimestampMs))
+	buf = appendVarint(buf, 2, uint64(q.EndTimestampMs))
+	for i := range q.Matchers {
+		buf = appendMessage(buf, 3, q.Matchers[i].Marshal())
+	}
+	return buf
+}
+
+func (m *LabelMatcher) Unmarshal(data []byte) error {
+	d := newDecoder(data)
+	for !d.done() {
+		field, wireType, err := d.key()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wireType == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			m.Type = LabelMatcher_Type(v)
+		case field == 2 && wireType == wireBytes:
+			m.Name, err = d.string()
+		case field == 3 && wireType == wireBytes:
+			m.Value, err = d.string()
+		default:
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *LabelMatcher) Marshal() []byte {
+	var buf []byte
+	buf = appendVarint(buf, 1, uint64(m.Type))
+	buf = appendString(buf, 2, m.Name)
+	buf = appendString(buf, 3, m.Value)
+	return buf
+}
+
+func (r *ReadResponse) Marshal() []byte {
+	var buf []byte
+	for i := range r.Results {
+		buf = appendMessage(buf, 1, r.Results[i].Marshal())
+	}
+	return buf
+}
+
+func (r *QueryResult) Marshal() []byte {
+	var buf []byte
+	for i := range r.Timeseries {
+		buf = appendMessage(buf, 1, r.Timeseries[i].Marshal())
+	}
+	return buf
+}
+
+func (r *ChunkedReadResponse) Marshal() []byte {
+	var buf []byte
+	for i := range r.ChunkedSeries {
+		buf = appendMessage(buf, 1, r.ChunkedSeries[i].Marshal())
+	}
+	buf = appendVarint(buf, 2, uint64(r.QueryIndex))
+	return buf
+}
+
+func (s *ChunkedSeries) Marshal() []byte {
+	var buf []byte
+	for i := range s.Labels {
+		buf = appendMessage(buf, 1, s.Labels[i].Marshal())
+	}
+	for i := range s.Chunks {
+		buf = appendMessage(buf, 2, s.Chunks[i].Marshal())
+	}
+	return buf
+}
+
+func (c *Chunk) Marshal() []byte {
+	var buf []byte
+	buf = appendVarint(buf, 1, uint64(c.MinTimeMs))
+	buf = appendVarint(buf, 2, uint64(c.MaxTimeMs))
+	buf = appendVarint(buf, 3, uint64(c.Type))
+	buf = appendBytes(buf, 4, c.Data)
+	return buf
+}
@@ -0,0 +1,134 @@
+package prompb
+
+// Сообщения из prometheus/prompb/types.proto
+
+// Label - пара имя/значение метки
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample - значение с таймстемпом в миллисекундах
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries - ряд с метками и семплами
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+func (l *Label) Unmarshal(data []byte) error {
+	d := newDecoder(data)
+	for !d.done() {
+		field, wireType, err := d.key()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wireType == wireBytes:
+			l.Name, err = d.string()
+		case field == 2 && wireType == wireBytes:
+			l.Value, err = d.string()
+		default:
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Label) Marshal() []byte {
+	var buf []byte
+	buf = appendString(buf, 1, l.Name)
+	buf = appendString(buf, 2, l.Value)
+	return buf
+}
+
+func (s *Sample) Unmarshal(data []byte) error {
+	d := newDecoder(data)
+	for !d.done() {
+		field, wireType, err := d.key()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wireType == wireFixed64:
+			s.Value, err = d.double()
+		case field == 2 && wireType == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			s.Timestamp = int64(v)
+		default:
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sample) Marshal() []byte {
+	var buf []byte
+	buf = appendDouble(buf, 1, s.Value)
+	buf = appendVarint(buf, 2, uint64(s.Timestamp))
+	return buf
+}
+
+func (ts *TimeSeries) Unmarshal(data []byte) error {
+	d := newDecoder(data)
+	for !d.done() {
+		field, wireType, err := d.key()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case field == 1 && wireType == wireBytes:
+			var b []byte
+			if b, err = d.bytes(); err != nil {
+				return err
+			}
+			var label Label
+			if err = label.Unmarshal(b); err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, label)
+		case field == 2 && wireType == wireBytes:
+			var b []byte
+			if b, err = d.bytes(); err != nil {
+				return err
+			}
+			var sample Sample
+			if err = sample.Unmarshal(b); err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, sample)
+		default:
+			// exemplars и native histograms не поддерживаются
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ts *TimeSeries) Marshal() []byte {
+	var buf []byte
+	for i := range ts.Labels {
+		buf = appendMessage(buf, 1, ts.Labels[i].Marshal())
+	}
+	for i := range ts.Samples {
+		buf = appendMessage(buf, 2, ts.Samples[i].Marshal())
+	}
+	return buf
+}
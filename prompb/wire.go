@@ -0,0 +1,149 @@
+package prompb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Минимальная реализация wire-формата protobuf: только то, что нужно
+// для сообщений remote_write/remote_read, без зависимости от golang/protobuf
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var ErrInvalidMessage = errors.New("prompb: invalid protobuf message")
+
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func newDecoder(buf []byte) *decoder {
+	return &decoder{buf: buf}
+}
+
+func (d *decoder) done() bool {
+	return d.pos >= len(d.buf)
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		return 0, ErrInvalidMessage
+	}
+	d.pos += n
+	return v, nil
+}
+
+func (d *decoder) key() (field int, wireType int, err error) {
+	v, err := d.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 0x07), nil
+}
+
+func (d *decoder) fixed64() (uint64, error) {
+	if d.pos+8 > len(d.buf) {
+		return 0, ErrInvalidMessage
+	}
+	v := binary.LittleEndian.Uint64(d.buf[d.pos:])
+	d.pos += 8
+	return v, nil
+}
+
+func (d *decoder) double() (float64, error) {
+	v, err := d.fixed64()
+	return math.Float64frombits(v), err
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	length, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(d.buf)-d.pos) {
+		return nil, ErrInvalidMessage
+	}
+	b := d.buf[d.pos : d.pos+int(length)]
+	d.pos += int(length)
+	return b, nil
+}
+
+func (d *decoder) string() (string, error) {
+	b, err := d.bytes()
+	return string(b), err
+}
+
+func (d *decoder) skip(wireType int) error {
+	switch wireType {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireFixed64:
+		_, err := d.fixed64()
+		return err
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	case wireFixed32:
+		if d.pos+4 > len(d.buf) {
+			return ErrInvalidMessage
+		}
+		d.pos += 4
+		return nil
+	default:
+		return ErrInvalidMessage
+	}
+}
+
+func appendKey(buf []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarint(buf []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendKey(buf, field, wireVarint)
+	return binary.AppendUvarint(buf, v)
+}
+
+func appendDouble(buf []byte, field int, v float64) []byte {
+	if v == 0 && !math.Signbit(v) {
+		return buf
+	}
+	buf = appendKey(buf, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+}
+
+func appendBytes(buf []byte, field int, b []byte) []byte {
+	if len(b) == 0 {
+		return buf
+	}
+	buf = appendKey(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendString(buf []byte, field int, s string) []byte {
+	if s == "" {
+		return buf
+	}
+	buf = appendKey(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// appendMessage пишет вложенное сообщение даже если оно пустое,
+// иначе потеряются элементы repeated-полей
+func appendMessage(buf []byte, field int, msg []byte) []byte {
+	buf = appendKey(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(msg)))
+	return append(buf, msg...)
+}
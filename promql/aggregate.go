@@ -0,0 +1,222 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"tsdb/types"
+)
+
+type aggregateGroup struct {
+	labels  Labels
+	samples []Sample
+}
+
+func (ev *evaluator) evalAggregate(agg *AggregateExpr, t int64) (Value, error) {
+	value, err := ev.eval(agg.Expr, t)
+	if err != nil {
+		return nil, err
+	}
+	vector := value.(Vector)
+
+	var param Value
+	if agg.Param != nil {
+		if param, err = ev.eval(agg.Param, t); err != nil {
+			return nil, err
+		}
+	}
+
+	if agg.Op == "count_values" {
+		return countValues(agg, vector, param.(String).V, t)
+	}
+
+	var groups []*aggregateGroup
+	byKey := make(map[string]*aggregateGroup)
+	for _, s := range vector {
+		labels := groupingLabels(s.Labels, agg.Grouping, agg.Without)
+		key := labels.String()
+		group, ok := byKey[key]
+		if !ok {
+			group = &aggregateGroup{labels: labels}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.samples = append(group.samples, s)
+	}
+
+	var result Vector
+	for _, group := range groups {
+		switch agg.Op {
+		case "topk", "bottomk":
+			result = append(result, topK(group.samples, param.(Scalar).V, agg.Op == "bottomk")...)
+		case "quantile":
+			values := sampleValues(group.samples)
+			result = append(result, Sample{Labels: group.labels, T: t, V: quantile(param.(Scalar).V, values)})
+		default:
+			v, err := aggregateValues(agg.Op, sampleValues(group.samples))
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, Sample{Labels: group.labels, T: t, V: v})
+		}
+	}
+
+	return result, nil
+}
+
+// groupingLabels - by оставляет только перечисленные теги, without убирает их и __name__
+func groupingLabels(labels Labels, grouping []string, without bool) Labels {
+	if without {
+		result := labels.withoutName()
+		for _, name := range grouping {
+			delete(result, name)
+		}
+		return result
+	}
+
+	result := make(Labels, len(grouping))
+	for _, name := range grouping {
+		if v, ok := labels[name]; ok && v != "" {
+			result[name] = v
+		}
+	}
+	return result
+}
+
+func sampleValues(samples []Sample) []float64 {
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = s.V
+	}
+	return values
+}
+
+// aggregateValues - общая часть для агрегаций и функций *_over_time
+func aggregateValues(op string, values []float64) (float64, error) {
+	switch op {
+	case "sum":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum, nil
+	case "avg":
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values)), nil
+	case "count":
+		return float64(len(values)), nil
+	case "group":
+		return 1, nil
+	case "min":
+		// NaN проигрывает любому числу
+		result := values[0]
+		for _, v := range values[1:] {
+			if v < result || math.IsNaN(result) {
+				result = v
+			}
+		}
+		return result, nil
+	case "max":
+		result := values[0]
+		for _, v := range values[1:] {
+			if v > result || math.IsNaN(result) {
+				result = v
+			}
+		}
+		return result, nil
+	case "stddev", "stdvar":
+		mean, sumSq := 0.0, 0.0
+		for i, v := range values {
+			delta := v - mean
+			mean += delta / float64(i+1)
+			sumSq += delta * (v - mean)
+		}
+		variance := sumSq / float64(len(values))
+		if op == "stddev" {
+			return math.Sqrt(variance), nil
+		}
+		return variance, nil
+	}
+	return 0, fmt.Errorf("unknown aggregation %q", op)
+}
+
+// topK - k рядов с наибольшими (bottom - наименьшими) значениями, NaN всегда в конце
+func topK(samples []Sample, k float64, bottom bool) []Sample {
+	if k < 1 || math.IsNaN(k) {
+		return nil
+	}
+
+	sorted := append([]Sample(nil), samples...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].V, sorted[j].V
+		if math.IsNaN(a) {
+			return false
+		}
+		if math.IsNaN(b) {
+			return true
+		}
+		if bottom {
+			return a < b
+		}
+		return a > b
+	})
+
+	if k < float64(len(sorted)) {
+		sorted = sorted[:int(k)]
+	}
+	return sorted
+}
+
+// quantile - φ-квантиль с линейной интерполяцией между соседними значениями, как в Prometheus
+func quantile(q float64, values []float64) float64 {
+	if len(values) == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := q * float64(len(sorted)-1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(float64(len(sorted)-1), lower+1)
+	weight := rank - math.Floor(rank)
+
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
+
+func countValues(agg *AggregateExpr, vector Vector, label string, t int64) (Vector, error) {
+	if label == "" || label == types.MetricNameLabel {
+		return nil, fmt.Errorf("invalid label name %q", label)
+	}
+
+	var order []string
+	counts := make(map[string]*Sample)
+	for _, s := range vector {
+		labels := groupingLabels(s.Labels, agg.Grouping, agg.Without)
+		labels[label] = strconv.FormatFloat(s.V, 'f', -1, 64)
+
+		key := labels.String()
+		if sample, ok := counts[key]; ok {
+			sample.V++
+			continue
+		}
+		counts[key] = &Sample{Labels: labels, T: t, V: 1}
+		order = append(order, key)
+	}
+
+	result := make(Vector, 0, len(order))
+	for _, key := range order {
+		result = append(result, *counts[key])
+	}
+	return result, nil
+}
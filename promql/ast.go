@@ -0,0 +1,108 @@
+package promql
+
+import (
+	"time"
+	"tsdb/types"
+)
+
+// Expr - узел дерева запроса
+type Expr interface {
+	Type() ValueType
+}
+
+type NumberLiteral struct {
+	Val float64
+}
+
+type StringLiteral struct {
+	Val string
+}
+
+type ParenExpr struct {
+	Expr Expr
+}
+
+// UnaryExpr - унарный минус (унарный плюс отбрасывается при разборе)
+type UnaryExpr struct {
+	Expr Expr
+}
+
+// VectorSelector - metric{tag="value"} offset 5m. Имя метрики лежит в Matchers как __name__
+type VectorSelector struct {
+	Name     string
+	Matchers []types.LabelMatcher
+	Offset   time.Duration
+}
+
+// MatrixSelector - metric{...}[5m]
+type MatrixSelector struct {
+	Selector *VectorSelector
+	Range    time.Duration
+}
+
+type Call struct {
+	Func *Function
+	Args []Expr
+}
+
+// AggregateExpr - sum by (host) (...), topk(5, ...) и т.д.
+type AggregateExpr struct {
+	Op       string
+	Expr     Expr
+	Param    Expr
+	Grouping []string
+	Without  bool
+}
+
+// VectorMatchCardinality - кардинальность сопоставления рядов в бинарной операции
+type VectorMatchCardinality int
+
+const (
+	CardOneToOne VectorMatchCardinality = iota
+	CardManyToOne
+	CardOneToMany
+	CardManyToMany
+)
+
+// VectorMatching - on(...)/ignoring(...) и group_left/group_right
+type VectorMatching struct {
+	Card           VectorMatchCardinality
+	MatchingLabels []string
+	On             bool
+	Include        []string
+}
+
+type BinaryExpr struct {
+	Op         tokenType
+	LHS, RHS   Expr
+	Matching   *VectorMatching
+	ReturnBool bool
+}
+
+func (e *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (e *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (e *ParenExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *UnaryExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (e *Call) Type() ValueType           { return e.Func.ReturnType }
+func (e *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+func isComparisonOp(op tokenType) bool {
+	switch op {
+	case tokEQL, tokNEQ, tokLSS, tokLTE, tokGTR, tokGTE:
+		return true
+	}
+	return false
+}
+
+func isSetOp(op tokenType) bool {
+	return op == tokAnd || op == tokOr || op == tokUnless
+}
@@ -0,0 +1,644 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+	"tsdb/types"
+)
+
+const (
+	// DefaultLookbackDelta - насколько далеко назад мгновенный селектор ищет последнюю точку
+	DefaultLookbackDelta = 5 * time.Minute
+	// MaxRangeSteps - как и в Prometheus, не больше 11000 точек на ряд в range-запросе
+	MaxRangeSteps = 11000
+)
+
+// Engine - вычисляет запросы PromQL поверх types.Reader
+type Engine struct {
+	reader        types.Reader
+	LookbackDelta time.Duration
+}
+
+func NewEngine(reader types.Reader) *Engine {
+	return &Engine{
+		reader:        reader,
+		LookbackDelta: DefaultLookbackDelta,
+	}
+}
+
+// evaluator - состояние одного запроса. Все селекторы читаются из хранилища один раз
+// на весь диапазон, дальше каждый шаг работает с уже загруженными точками
+type evaluator struct {
+	engine     *Engine
+	start, end int64
+	series     map[*VectorSelector]Matrix
+}
+
+// InstantQuery - значение выражения в момент ts (наносекунды)
+func (e *Engine) InstantQuery(ctx context.Context, expr Expr, ts int64) (Value, error) {
+	ev, err := e.newEvaluator(ctx, expr, ts, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ev.eval(expr, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	if vector, ok := result.(Vector); ok {
+		if err := checkDuplicates(vector); err != nil {
+			return nil, err
+		}
+		if !keepsOrder(expr) {
+			sortVector(vector)
+		}
+	}
+	return result, nil
+}
+
+// RangeQuery - значения выражения на сетке start, start+step, ..., end
+func (e *Engine) RangeQuery(ctx context.Context, expr Expr, start, end int64, step time.Duration) (Matrix, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("zero or negative query resolution step widths are not accepted")
+	}
+	if end < start {
+		return nil, fmt.Errorf("end timestamp must not be before start time")
+	}
+	if (end-start)/int64(step) >= MaxRangeSteps {
+		return nil, fmt.Errorf("exceeded maximum resolution of %d points per timeseries", MaxRangeSteps)
+	}
+
+	if t := expr.Type(); t != ValueTypeVector && t != ValueTypeScalar {
+		return nil, fmt.Errorf("invalid expression type %q for range query, must be scalar or instant vector", t)
+	}
+
+	ev, err := e.newEvaluator(ctx, expr, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	bySeries := make(map[string]*Series)
+	for t := start; t <= end; t += int64(step) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result, err := ev.eval(expr, t)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := appendStep(bySeries, result, t); err != nil {
+			return nil, err
+		}
+	}
+
+	return sortedMatrix(bySeries), nil
+}
+
+// appendStep - дописывает значение выражения в момент t к рядам range-запроса
+func appendStep(bySeries map[string]*Series, result Value, t int64) error {
+	var vector Vector
+	switch v := result.(type) {
+	case Vector:
+		vector = v
+	case Scalar:
+		vector = Vector{{Labels: Labels{}, T: t, V: v.V}}
+	}
+
+	for _, sample := range vector {
+		key := sample.Labels.String()
+		series, ok := bySeries[key]
+		if !ok {
+			series = &Series{Labels: sample.Labels}
+			bySeries[key] = series
+		} else if last := series.Points[len(series.Points)-1]; last.Timestamp == t {
+			return fmt.Errorf("vector cannot contain metrics with the same labelset %s", key)
+		}
+		series.Points = append(series.Points, types.Point{Timestamp: t, Value: sample.V})
+	}
+	return nil
+}
+
+func sortedMatrix(bySeries map[string]*Series) Matrix {
+	matrix := make(Matrix, 0, len(bySeries))
+	for _, series := range bySeries {
+		matrix = append(matrix, *series)
+	}
+	sort.Slice(matrix, func(i, j int) bool {
+		return matrix[i].Labels.String() < matrix[j].Labels.String()
+	})
+	return matrix
+}
+
+func (e *Engine) newEvaluator(ctx context.Context, expr Expr, start, end int64) (*evaluator, error) {
+	ev := &evaluator{
+		engine: e,
+		start:  start,
+		end:    end,
+		series: make(map[*VectorSelector]Matrix),
+	}
+
+	var err error
+	walk(expr, func(node Expr) {
+		if err != nil {
+			return
+		}
+		switch n := node.(type) {
+		case *MatrixSelector:
+			err = ev.load(ctx, n.Selector, n.Range)
+		case *VectorSelector:
+			if _, loaded := ev.series[n]; !loaded {
+				err = ev.load(ctx, n, e.LookbackDelta)
+			}
+		}
+	})
+
+	return ev, err
+}
+
+// walk - обход дерева, MatrixSelector посещается раньше своего VectorSelector
+func walk(expr Expr, fn func(Expr)) {
+	fn(expr)
+
+	switch e := expr.(type) {
+	case *ParenExpr:
+		walk(e.Expr, fn)
+	case *UnaryExpr:
+		walk(e.Expr, fn)
+	case *MatrixSelector:
+		walk(e.Selector, fn)
+	case *Call:
+		for _, arg := range e.Args {
+			walk(arg, fn)
+		}
+	case *AggregateExpr:
+		if e.Param != nil {
+			walk(e.Param, fn)
+		}
+		walk(e.Expr, fn)
+	case *BinaryExpr:
+		walk(e.LHS, fn)
+		walk(e.RHS, fn)
+	}
+}
+
+// load - читает точки селектора на весь диапазон запроса с запасом window назад
+func (ev *evaluator) load(ctx context.Context, selector *VectorSelector, window time.Duration) error {
+	offset := int64(selector.Offset)
+	result, err := ev.engine.reader.Read(ctx, types.Query{
+		Matchers: selector.Matchers,
+		TimeRange: types.TimeRange{
+			Start: ev.start - offset - int64(window),
+			End:   ev.end - offset,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	matrix := make(Matrix, 0, len(result.Series))
+	for _, data := range result.Series {
+		matrix = append(matrix, Series{
+			Labels: labelsFromSeriesID(data.SeriesID),
+			Points: sortPoints(data.Points),
+		})
+	}
+	ev.series[selector] = matrix
+
+	return nil
+}
+
+// sortPoints - блоки в файле не обязаны идти по времени, при совпадении таймстемпов остается последняя точка
+func sortPoints(points []types.Point) []types.Point {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Timestamp < points[j].Timestamp
+	})
+
+	result := points[:0]
+	for _, p := range points {
+		if n := len(result); n > 0 && result[n-1].Timestamp == p.Timestamp {
+			result[n-1] = p
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+func (ev *evaluator) eval(expr Expr, t int64) (Value, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return Scalar{T: t, V: e.Val}, nil
+
+	case *StringLiteral:
+		return String{T: t, V: e.Val}, nil
+
+	case *ParenExpr:
+		return ev.eval(e.Expr, t)
+
+	case *UnaryExpr:
+		value, err := ev.eval(e.Expr, t)
+		if err != nil {
+			return nil, err
+		}
+		return negate(value, t), nil
+
+	case *VectorSelector:
+		return ev.vectorAt(e, t), nil
+
+	case *MatrixSelector:
+		matrix, _, _ := ev.matrixAt(e, t)
+		return matrix, nil
+
+	case *Call:
+		return ev.evalCall(e, t)
+
+	case *AggregateExpr:
+		return ev.evalAggregate(e, t)
+
+	case *BinaryExpr:
+		return ev.evalBinary(e, t)
+	}
+
+	return nil, fmt.Errorf("unhandled expression of type %T", expr)
+}
+
+// vectorAt - последняя точка каждого ряда в окне (t-offset-lookback, t-offset]
+func (ev *evaluator) vectorAt(selector *VectorSelector, t int64) Vector {
+	ref := t - int64(selector.Offset)
+	minT := ref - int64(ev.engine.LookbackDelta)
+
+	var vector Vector
+	for _, series := range ev.series[selector] {
+		i := sort.Search(len(series.Points), func(i int) bool {
+			return series.Points[i].Timestamp > ref
+		}) - 1
+		if i < 0 || series.Points[i].Timestamp <= minT {
+			continue
+		}
+		vector = append(vector, Sample{Labels: series.Labels, T: t, V: series.Points[i].Value})
+	}
+	return vector
+}
+
+// matrixAt - точки каждого ряда в окне (t-offset-range, t-offset]. Возвращает и границы окна,
+// они нужны rate/increase для экстраполяции
+func (ev *evaluator) matrixAt(selector *MatrixSelector, t int64) (Matrix, int64, int64) {
+	rangeEnd := t - int64(selector.Selector.Offset)
+	rangeStart := rangeEnd - int64(selector.Range)
+
+	var matrix Matrix
+	for _, series := range ev.series[selector.Selector] {
+		from := sort.Search(len(series.Points), func(i int) bool {
+			return series.Points[i].Timestamp > rangeStart
+		})
+		to := sort.Search(len(series.Points), func(i int) bool {
+			return series.Points[i].Timestamp > rangeEnd
+		})
+		if from >= to {
+			continue
+		}
+		matrix = append(matrix, Series{Labels: series.Labels, Points: series.Points[from:to]})
+	}
+	return matrix, rangeStart, rangeEnd
+}
+
+func (ev *evaluator) evalCall(call *Call, t int64) (Value, error) {
+	args := &funcArgs{t: t, exprs: call.Args, values: make([]Value, len(call.Args))}
+
+	for i, arg := range call.Args {
+		if selector, ok := unwrapParens(arg).(*MatrixSelector); ok {
+			args.values[i], args.rangeStart, args.rangeEnd = ev.matrixAt(selector, t)
+			continue
+		}
+
+		value, err := ev.eval(arg, t)
+		if err != nil {
+			return nil, err
+		}
+		args.values[i] = value
+	}
+
+	return call.Func.call(args)
+}
+
+func unwrapParens(expr Expr) Expr {
+	for {
+		paren, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.Expr
+	}
+}
+
+// keepsOrder - sort(), sort_desc() и topk/bottomk задают порядок результата сами
+func keepsOrder(expr Expr) bool {
+	switch e := unwrapParens(expr).(type) {
+	case *Call:
+		return e.Func.Name == "sort" || e.Func.Name == "sort_desc"
+	case *AggregateExpr:
+		return e.Op == "topk" || e.Op == "bottomk"
+	}
+	return false
+}
+
+func sortVector(vector Vector) {
+	sort.SliceStable(vector, func(i, j int) bool {
+		return vector[i].Labels.String() < vector[j].Labels.String()
+	})
+}
+
+func checkDuplicates(vector Vector) error {
+	seen := make(map[string]bool, len(vector))
+	for _, s := range vector {
+		key := s.Labels.String()
+		if seen[key] {
+			return fmt.Errorf("vector cannot contain metrics with the same labelset %s", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// negate - унарный минус для скаляра или вектора
+func negate(value Value, t int64) Value {
+	if scalar, ok := value.(Scalar); ok {
+		return Scalar{T: t, V: -scalar.V}
+	}
+	vector := value.(Vector)
+	result := make(Vector, len(vector))
+	for i, s := range vector {
+		result[i] = Sample{Labels: s.Labels.withoutName(), T: t, V: -s.V}
+	}
+	return result
+}
+
+func (ev *evaluator) evalBinary(e *BinaryExpr, t int64) (Value, error) {
+	lhs, err := ev.eval(e.LHS, t)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(e.RHS, t)
+	if err != nil {
+		return nil, err
+	}
+	return binaryValues(e, lhs, rhs, t)
+}
+
+// binaryValues - операция e над уже посчитанными операндами
+func binaryValues(e *BinaryExpr, lhs, rhs Value, t int64) (Value, error) {
+	switch l := lhs.(type) {
+	case Scalar:
+		if r, ok := rhs.(Scalar); ok {
+			v, keep := binop(e.Op, l.V, r.V)
+			if e.ReturnBool {
+				v = boolValue(keep)
+			}
+			return Scalar{T: t, V: v}, nil
+		}
+		return vectorScalarBinop(e.Op, rhs.(Vector), l.V, true, e.ReturnBool, t), nil
+
+	case Vector:
+		if r, ok := rhs.(Scalar); ok {
+			return vectorScalarBinop(e.Op, l, r.V, false, e.ReturnBool, t), nil
+		}
+		r := rhs.(Vector)
+
+		switch e.Op {
+		case tokAnd:
+			return vectorAnd(l, r, e.Matching), nil
+		case tokOr:
+			return vectorOr(l, r, e.Matching), nil
+		case tokUnless:
+			return vectorUnless(l, r, e.Matching), nil
+		}
+		return vectorBinop(e.Op, l, r, e.Matching, e.ReturnBool, t)
+	}
+
+	return nil, fmt.Errorf("invalid binary operand of type %s", lhs.Type())
+}
+
+// binop - результат операции; для сравнений возвращается левое значение и признак истинности
+func binop(op tokenType, l, r float64) (float64, bool) {
+	switch op {
+	case tokAdd:
+		return l + r, true
+	case tokSub:
+		return l - r, true
+	case tokMul:
+		return l * r, true
+	case tokDiv:
+		return l / r, true
+	case tokMod:
+		return math.Mod(l, r), true
+	case tokPow:
+		return math.Pow(l, r), true
+	case tokEQL:
+		return l, l == r
+	case tokNEQ:
+		return l, l != r
+	case tokLSS:
+		return l, l < r
+	case tokLTE:
+		return l, l <= r
+	case tokGTR:
+		return l, l > r
+	case tokGTE:
+		return l, l >= r
+	}
+	return 0, false
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// vectorScalarBinop - swap означает, что скаляр стоит слева. При сравнении без bool
+// в результат всегда идет значение вектора, с какой бы стороны он ни стоял
+func vectorScalarBinop(op tokenType, vector Vector, scalar float64, swap, returnBool bool, t int64) Vector {
+	result := make(Vector, 0, len(vector))
+
+	for _, s := range vector {
+		l, r := s.V, scalar
+		if swap {
+			l, r = r, l
+		}
+
+		value, keep := binop(op, l, r)
+		if isComparisonOp(op) && swap {
+			value = s.V
+		}
+		if returnBool {
+			value = boolValue(keep)
+			keep = true
+		}
+		if !keep {
+			continue
+		}
+
+		labels := s.Labels
+		if !isComparisonOp(op) || returnBool {
+			labels = labels.withoutName()
+		}
+		result = append(result, Sample{Labels: labels, T: t, V: value})
+	}
+
+	return result
+}
+
+// vectorBinop - сопоставление рядов по on/ignoring, group_left/group_right разрешают
+// многим рядам одной стороны сопоставиться с одним рядом другой
+func vectorBinop(op tokenType, lhs, rhs Vector, matching *VectorMatching, returnBool bool, t int64) (Vector, error) {
+	if matching.Card == CardManyToMany {
+		return nil, fmt.Errorf("many-to-many matching only allowed for set operators")
+	}
+
+	// сторона "one" всегда справа
+	swapped := matching.Card == CardOneToMany
+	if swapped {
+		lhs, rhs = rhs, lhs
+	}
+
+	oneSide := make(map[string]Sample, len(rhs))
+	for _, s := range rhs {
+		sig := s.Labels.signature(matching.On, matching.MatchingLabels)
+		if _, dup := oneSide[sig]; dup {
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the %s hand-side of the operation; many-to-many matching not allowed: matching labels must be unique on one side", sig, sideName(swapped))
+		}
+		oneSide[sig] = s
+	}
+
+	matched := make(map[string]bool)
+	resultKeys := make(map[string]bool)
+	var result Vector
+
+	for _, ls := range lhs {
+		sig := ls.Labels.signature(matching.On, matching.MatchingLabels)
+		rs, ok := oneSide[sig]
+		if !ok {
+			continue
+		}
+
+		if matching.Card == CardOneToOne {
+			if matched[sig] {
+				return nil, fmt.Errorf("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+			}
+			matched[sig] = true
+		}
+
+		l, r := ls.V, rs.V
+		if swapped {
+			l, r = r, l
+		}
+		value, keep := binop(op, l, r)
+		if returnBool {
+			value = boolValue(keep)
+			keep = true
+		}
+		if !keep {
+			continue
+		}
+
+		labels := resultLabels(ls.Labels, rs.Labels, op, matching, returnBool)
+		if matching.Card != CardOneToOne {
+			key := labels.String()
+			if resultKeys[key] {
+				return nil, fmt.Errorf("multiple matches for labels: grouping labels must ensure unique matches")
+			}
+			resultKeys[key] = true
+		}
+
+		result = append(result, Sample{Labels: labels, T: t, V: value})
+	}
+
+	return result, nil
+}
+
+func sideName(swapped bool) string {
+	if swapped {
+		return "left"
+	}
+	return "right"
+}
+
+func resultLabels(many, one Labels, op tokenType, matching *VectorMatching, returnBool bool) Labels {
+	result := many.copy()
+	if !isComparisonOp(op) || returnBool {
+		delete(result, types.MetricNameLabel)
+	}
+
+	if matching.Card == CardOneToOne {
+		if matching.On {
+			keep := make(Labels, len(matching.MatchingLabels))
+			for _, name := range matching.MatchingLabels {
+				if v, ok := result[name]; ok {
+					keep[name] = v
+				}
+			}
+			result = keep
+		} else {
+			for _, name := range matching.MatchingLabels {
+				delete(result, name)
+			}
+		}
+	}
+
+	for _, name := range matching.Include {
+		if v, ok := one[name]; ok && v != "" {
+			result[name] = v
+		} else {
+			delete(result, name)
+		}
+	}
+
+	return result
+}
+
+func signatures(vector Vector, matching *VectorMatching) map[string]bool {
+	sigs := make(map[string]bool, len(vector))
+	for _, s := range vector {
+		sigs[s.Labels.signature(matching.On, matching.MatchingLabels)] = true
+	}
+	return sigs
+}
+
+func vectorAnd(lhs, rhs Vector, matching *VectorMatching) Vector {
+	right := signatures(rhs, matching)
+	var result Vector
+	for _, s := range lhs {
+		if right[s.Labels.signature(matching.On, matching.MatchingLabels)] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func vectorOr(lhs, rhs Vector, matching *VectorMatching) Vector {
+	left := signatures(lhs, matching)
+	result := append(Vector{}, lhs...)
+	for _, s := range rhs {
+		if !left[s.Labels.signature(matching.On, matching.MatchingLabels)] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func vectorUnless(lhs, rhs Vector, matching *VectorMatching) Vector {
+	right := signatures(rhs, matching)
+	var result Vector
+	for _, s := range lhs {
+		if !right[s.Labels.signature(matching.On, matching.MatchingLabels)] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,454 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"tsdb/types"
+)
+
+// funcArgs - вычисленные аргументы функции. Для аргумента-матрицы rangeStart/rangeEnd -
+// границы окна с учетом offset
+type funcArgs struct {
+	t                    int64
+	values               []Value
+	exprs                []Expr
+	rangeStart, rangeEnd int64
+}
+
+type funcImpl func(args *funcArgs) (Value, error)
+
+// Function - описание функции PromQL. Optional - сколько последних аргументов можно опустить
+type Function struct {
+	Name       string
+	ArgTypes   []ValueType
+	Optional   int
+	ReturnType ValueType
+	call       funcImpl
+}
+
+var functions = map[string]*Function{}
+
+func init() {
+	scalar, vector, matrix := ValueTypeScalar, ValueTypeVector, ValueTypeMatrix
+
+	register := func(name string, argTypes []ValueType, optional int, returnType ValueType, call funcImpl) {
+		functions[name] = &Function{Name: name, ArgTypes: argTypes, Optional: optional, ReturnType: returnType, call: call}
+	}
+
+	register("rate", []ValueType{matrix}, 0, vector, extrapolatedRateFunc(true, true))
+	register("increase", []ValueType{matrix}, 0, vector, extrapolatedRateFunc(true, false))
+	register("delta", []ValueType{matrix}, 0, vector, extrapolatedRateFunc(false, false))
+	register("irate", []ValueType{matrix}, 0, vector, instantValueFunc(true))
+	register("idelta", []ValueType{matrix}, 0, vector, instantValueFunc(false))
+	register("changes", []ValueType{matrix}, 0, vector, overTimeFunc(changes))
+	register("resets", []ValueType{matrix}, 0, vector, overTimeFunc(resets))
+
+	for _, op := range []string{"avg", "sum", "min", "max", "count", "stddev", "stdvar"} {
+		register(op+"_over_time", []ValueType{matrix}, 0, vector, overTimeFunc(func(points []types.Point) float64 {
+			v, _ := aggregateValues(op, pointValues(points))
+			return v
+		}))
+	}
+	register("last_over_time", []ValueType{matrix}, 0, vector, overTimeFunc(func(points []types.Point) float64 {
+		return points[len(points)-1].Value
+	}))
+	register("present_over_time", []ValueType{matrix}, 0, vector, overTimeFunc(func([]types.Point) float64 {
+		return 1
+	}))
+	register("quantile_over_time", []ValueType{scalar, matrix}, 0, vector, funcQuantileOverTime)
+
+	register("histogram_quantile", []ValueType{scalar, vector}, 0, vector, funcHistogramQuantile)
+
+	register("abs", []ValueType{vector}, 0, vector, mathFunc(math.Abs))
+	register("ceil", []ValueType{vector}, 0, vector, mathFunc(math.Ceil))
+	register("floor", []ValueType{vector}, 0, vector, mathFunc(math.Floor))
+	register("exp", []ValueType{vector}, 0, vector, mathFunc(math.Exp))
+	register("sqrt", []ValueType{vector}, 0, vector, mathFunc(math.Sqrt))
+	register("ln", []ValueType{vector}, 0, vector, mathFunc(math.Log))
+	register("log2", []ValueType{vector}, 0, vector, mathFunc(math.Log2))
+	register("log10", []ValueType{vector}, 0, vector, mathFunc(math.Log10))
+	register("round", []ValueType{vector, scalar}, 1, vector, funcRound)
+	register("clamp", []ValueType{vector, scalar, scalar}, 0, vector, funcClamp)
+	register("clamp_min", []ValueType{vector, scalar}, 0, vector, funcClampMin)
+	register("clamp_max", []ValueType{vector, scalar}, 0, vector, funcClampMax)
+
+	register("time", nil, 0, scalar, func(args *funcArgs) (Value, error) {
+		return Scalar{T: args.t, V: float64(args.t) / 1e9}, nil
+	})
+	register("vector", []ValueType{scalar}, 0, vector, func(args *funcArgs) (Value, error) {
+		return Vector{{Labels: Labels{}, T: args.t, V: args.values[0].(Scalar).V}}, nil
+	})
+	register("scalar", []ValueType{vector}, 0, scalar, func(args *funcArgs) (Value, error) {
+		vector := args.values[0].(Vector)
+		if len(vector) != 1 {
+			return Scalar{T: args.t, V: math.NaN()}, nil
+		}
+		return Scalar{T: args.t, V: vector[0].V}, nil
+	})
+	register("sort", []ValueType{vector}, 0, vector, sortFunc(false))
+	register("sort_desc", []ValueType{vector}, 0, vector, sortFunc(true))
+	register("absent", []ValueType{vector}, 0, vector, absentFunc)
+	register("absent_over_time", []ValueType{matrix}, 0, vector, absentFunc)
+}
+
+func pointValues(points []types.Point) []float64 {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.Value
+	}
+	return values
+}
+
+// overTimeFunc - функция от точек окна каждого ряда, имя метрики отбрасывается
+func overTimeFunc(fn func(points []types.Point) float64) funcImpl {
+	return func(args *funcArgs) (Value, error) {
+		matrix := args.values[len(args.values)-1].(Matrix)
+		result := make(Vector, 0, len(matrix))
+		for _, series := range matrix {
+			result = append(result, Sample{Labels: series.Labels.withoutName(), T: args.t, V: fn(series.Points)})
+		}
+		return result, nil
+	}
+}
+
+func funcQuantileOverTime(args *funcArgs) (Value, error) {
+	q := args.values[0].(Scalar).V
+	return overTimeFunc(func(points []types.Point) float64 {
+		return quantile(q, pointValues(points))
+	})(args)
+}
+
+func changes(points []types.Point) float64 {
+	count := 0
+	for i := 1; i < len(points); i++ {
+		cur, prev := points[i].Value, points[i-1].Value
+		if cur != prev && !(math.IsNaN(cur) && math.IsNaN(prev)) {
+			count++
+		}
+	}
+	return float64(count)
+}
+
+func resets(points []types.Point) float64 {
+	count := 0
+	for i := 1; i < len(points); i++ {
+		if points[i].Value < points[i-1].Value {
+			count++
+		}
+	}
+	return float64(count)
+}
+
+func extrapolatedRateFunc(isCounter, isRate bool) funcImpl {
+	return func(args *funcArgs) (Value, error) {
+		matrix := args.values[0].(Matrix)
+		result := make(Vector, 0, len(matrix))
+		for _, series := range matrix {
+			v, ok := ExtrapolatedRate(series.Points, args.rangeStart, args.rangeEnd, isCounter, isRate)
+			if !ok {
+				continue
+			}
+			result = append(result, Sample{Labels: series.Labels.withoutName(), T: args.t, V: v})
+		}
+		return result, nil
+	}
+}
+
+// ExtrapolatedRate - rate/increase/delta по алгоритму Prometheus: сбросы счетчика
+// компенсируются, а результат экстраполируется к границам окна, если первая и последняя
+// точки лежат от них ближе, чем 1.1 среднего интервала между точками. Нужно хотя бы две точки
+func ExtrapolatedRate(points []types.Point, rangeStart, rangeEnd int64, isCounter, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	first, last := points[0], points[len(points)-1]
+	resultValue := last.Value - first.Value
+	if isCounter {
+		for i := 1; i < len(points); i++ {
+			if points[i].Value < points[i-1].Value {
+				resultValue += points[i-1].Value
+			}
+		}
+	}
+
+	durationToStart := float64(first.Timestamp-rangeStart) / 1e9
+	durationToEnd := float64(rangeEnd-last.Timestamp) / 1e9
+	sampledInterval := float64(last.Timestamp-first.Timestamp) / 1e9
+	averageDurationBetweenSamples := sampledInterval / float64(len(points)-1)
+
+	// счетчик не может быть отрицательным, дальше нуля назад не экстраполируем
+	if isCounter && resultValue > 0 && first.Value >= 0 {
+		durationToZero := sampledInterval * (first.Value / resultValue)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	extrapolationThreshold := averageDurationBetweenSamples * 1.1
+	extrapolateToInterval := sampledInterval
+	if durationToStart < extrapolationThreshold {
+		extrapolateToInterval += durationToStart
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+	if durationToEnd < extrapolationThreshold {
+		extrapolateToInterval += durationToEnd
+	} else {
+		extrapolateToInterval += averageDurationBetweenSamples / 2
+	}
+
+	resultValue *= extrapolateToInterval / sampledInterval
+	if isRate {
+		resultValue /= float64(rangeEnd-rangeStart) / 1e9
+	}
+
+	return resultValue, true
+}
+
+// instantValueFunc - irate/idelta по двум последним точкам окна
+func instantValueFunc(isRate bool) funcImpl {
+	return func(args *funcArgs) (Value, error) {
+		matrix := args.values[0].(Matrix)
+		result := make(Vector, 0, len(matrix))
+		for _, series := range matrix {
+			v, ok := InstantValue(series.Points, isRate)
+			if !ok {
+				continue
+			}
+			result = append(result, Sample{Labels: series.Labels.withoutName(), T: args.t, V: v})
+		}
+		return result, nil
+	}
+}
+
+// InstantValue - irate (isRate) или idelta по двум последним точкам
+func InstantValue(points []types.Point, isRate bool) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+	last, prev := points[len(points)-1], points[len(points)-2]
+
+	v := last.Value - prev.Value
+	if isRate {
+		if last.Value < prev.Value {
+			// сброс счетчика
+			v = last.Value
+		}
+		v /= float64(last.Timestamp-prev.Timestamp) / 1e9
+	}
+	return v, true
+}
+
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// funcHistogramQuantile - бакеты группируются по всем тегам, кроме le
+func funcHistogramQuantile(args *funcArgs) (Value, error) {
+	q := args.values[0].(Scalar).V
+	vector := args.values[1].(Vector)
+
+	type histogram struct {
+		labels  Labels
+		buckets []bucket
+	}
+	var order []string
+	histograms := make(map[string]*histogram)
+
+	for _, s := range vector {
+		le, ok := s.Labels["le"]
+		if !ok {
+			continue
+		}
+		upperBound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			continue
+		}
+
+		labels := s.Labels.withoutName()
+		delete(labels, "le")
+		key := labels.String()
+
+		h, ok := histograms[key]
+		if !ok {
+			h = &histogram{labels: labels}
+			histograms[key] = h
+			order = append(order, key)
+		}
+		h.buckets = append(h.buckets, bucket{upperBound: upperBound, count: s.V})
+	}
+
+	result := make(Vector, 0, len(order))
+	for _, key := range order {
+		h := histograms[key]
+		result = append(result, Sample{Labels: h.labels, T: args.t, V: bucketQuantile(q, h.buckets)})
+	}
+	return result, nil
+}
+
+// bucketQuantile - линейная интерполяция внутри бакета, в который попадает ранг q*count
+func bucketQuantile(q float64, buckets []bucket) float64 {
+	if math.IsNaN(q) {
+		return math.NaN()
+	}
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(1)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+	if len(buckets) < 2 || !math.IsInf(buckets[len(buckets)-1].upperBound, 1) {
+		return math.NaN()
+	}
+
+	// счетчики бакетов собираются не атомарно и могут быть немонотонны
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i].count < buckets[i-1].count {
+			buckets[i].count = buckets[i-1].count
+		}
+	}
+
+	observations := buckets[len(buckets)-1].count
+	if observations == 0 {
+		return math.NaN()
+	}
+
+	rank := q * observations
+	b := sort.Search(len(buckets)-1, func(i int) bool { return buckets[i].count >= rank })
+
+	if b == len(buckets)-1 {
+		return buckets[len(buckets)-2].upperBound
+	}
+	if b == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	bucketStart := 0.0
+	bucketEnd := buckets[b].upperBound
+	count := buckets[b].count
+	if b > 0 {
+		bucketStart = buckets[b-1].upperBound
+		count -= buckets[b-1].count
+		rank -= buckets[b-1].count
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
+
+func mapVector(vector Vector, t int64, fn func(float64) float64) Vector {
+	result := make(Vector, len(vector))
+	for i, s := range vector {
+		result[i] = Sample{Labels: s.Labels.withoutName(), T: t, V: fn(s.V)}
+	}
+	return result
+}
+
+func mathFunc(fn func(float64) float64) funcImpl {
+	return func(args *funcArgs) (Value, error) {
+		return mapVector(args.values[0].(Vector), args.t, fn), nil
+	}
+}
+
+func funcRound(args *funcArgs) (Value, error) {
+	toNearest := 1.0
+	if len(args.values) > 1 {
+		toNearest = args.values[1].(Scalar).V
+	}
+	// как в Prometheus, деление на обратную величину точнее для дробных шагов
+	inverse := 1 / toNearest
+	return mapVector(args.values[0].(Vector), args.t, func(v float64) float64 {
+		return math.Floor(v*inverse+0.5) / inverse
+	}), nil
+}
+
+func funcClamp(args *funcArgs) (Value, error) {
+	low, high := args.values[1].(Scalar).V, args.values[2].(Scalar).V
+	if high < low {
+		return Vector{}, nil
+	}
+	return mapVector(args.values[0].(Vector), args.t, func(v float64) float64 {
+		return math.Max(low, math.Min(high, v))
+	}), nil
+}
+
+func funcClampMin(args *funcArgs) (Value, error) {
+	low := args.values[1].(Scalar).V
+	return mapVector(args.values[0].(Vector), args.t, func(v float64) float64 {
+		return math.Max(low, v)
+	}), nil
+}
+
+func funcClampMax(args *funcArgs) (Value, error) {
+	high := args.values[1].(Scalar).V
+	return mapVector(args.values[0].(Vector), args.t, func(v float64) float64 {
+		return math.Min(high, v)
+	}), nil
+}
+
+func sortFunc(desc bool) funcImpl {
+	return func(args *funcArgs) (Value, error) {
+		vector := append(Vector(nil), args.values[0].(Vector)...)
+		sort.SliceStable(vector, func(i, j int) bool {
+			a, b := vector[i].V, vector[j].V
+			if math.IsNaN(a) {
+				return false
+			}
+			if math.IsNaN(b) {
+				return true
+			}
+			if desc {
+				return a > b
+			}
+			return a < b
+		})
+		return vector, nil
+	}
+}
+
+// absentFunc - 1 с тегами из условий равенства селектора, если рядов нет
+func absentFunc(args *funcArgs) (Value, error) {
+	switch v := args.values[0].(type) {
+	case Vector:
+		if len(v) > 0 {
+			return Vector{}, nil
+		}
+	case Matrix:
+		if len(v) > 0 {
+			return Vector{}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unexpected argument of type %s", v.Type())
+	}
+
+	labels := Labels{}
+	var selector *VectorSelector
+	switch e := unwrapParens(args.exprs[0]).(type) {
+	case *VectorSelector:
+		selector = e
+	case *MatrixSelector:
+		selector = e.Selector
+	}
+
+	if selector != nil {
+		seen := make(map[string]bool)
+		for _, m := range selector.Matchers {
+			if m.Name == types.MetricNameLabel || m.Type != types.MatchEqual {
+				continue
+			}
+			if seen[m.Name] {
+				// противоречивые условия на один тег - тег не выводим
+				delete(labels, m.Name)
+				continue
+			}
+			seen[m.Name] = true
+			labels[m.Name] = m.Value
+		}
+	}
+
+	return Vector{{Labels: labels, T: args.t, V: 1}}, nil
+}
@@ -0,0 +1,274 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdent
+	tokNumber
+	tokDuration
+	tokString
+	tokLBrace
+	tokRBrace
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokAssign // = в матчерах
+	tokEQL
+	tokNEQ
+	tokLSS
+	tokLTE
+	tokGTR
+	tokGTE
+	tokRegexMatch
+	tokRegexNoMatch
+	tokAdd
+	tokSub
+	tokMul
+	tokDiv
+	tokMod
+	tokPow
+	tokAnd
+	tokOr
+	tokUnless
+)
+
+var tokenNames = map[tokenType]string{
+	tokEOF: "end of input", tokIdent: "identifier", tokNumber: "number", tokDuration: "duration",
+	tokString: "string", tokLBrace: "{", tokRBrace: "}", tokLParen: "(", tokRParen: ")",
+	tokLBracket: "[", tokRBracket: "]", tokComma: ",", tokAssign: "=", tokEQL: "==", tokNEQ: "!=",
+	tokLSS: "<", tokLTE: "<=", tokGTR: ">", tokGTE: ">=", tokRegexMatch: "=~", tokRegexNoMatch: "!~",
+	tokAdd: "+", tokSub: "-", tokMul: "*", tokDiv: "/", tokMod: "%", tokPow: "^",
+	tokAnd: "and", tokOr: "or", tokUnless: "unless",
+}
+
+func (t tokenType) String() string {
+	return tokenNames[t]
+}
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+// lex - разбивает запрос на токены целиком, запросы короткие, потоковый лексер не нужен
+func lex(input string) ([]token, error) {
+	var tokens []token
+	pos := 0
+
+	for {
+		for pos < len(input) && strings.IndexByte(" \t\r\n", input[pos]) >= 0 {
+			pos++
+		}
+		if pos < len(input) && input[pos] == '#' {
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		}
+		if pos >= len(input) {
+			return append(tokens, token{typ: tokEOF, pos: pos}), nil
+		}
+
+		start := pos
+		c := input[pos]
+
+		switch {
+		case isAlpha(c) || c == ':':
+			for pos < len(input) && (isAlpha(input[pos]) || isDigit(input[pos]) || input[pos] == ':') {
+				pos++
+			}
+			typ := tokIdent
+			switch strings.ToLower(input[start:pos]) {
+			case "and":
+				typ = tokAnd
+			case "or":
+				typ = tokOr
+			case "unless":
+				typ = tokUnless
+			}
+			tokens = append(tokens, token{typ: typ, val: input[start:pos], pos: start})
+			continue
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			typ, end := lexNumberOrDuration(input, pos)
+			tokens = append(tokens, token{typ: typ, val: input[start:end], pos: start})
+			pos = end
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			s, end, err := lexString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{typ: tokString, val: s, pos: start})
+			pos = end
+			continue
+		}
+
+		two := ""
+		if pos+1 < len(input) {
+			two = input[pos : pos+2]
+		}
+		typ := tokEOF
+		switch two {
+		case "==":
+			typ = tokEQL
+		case "!=":
+			typ = tokNEQ
+		case "<=":
+			typ = tokLTE
+		case ">=":
+			typ = tokGTE
+		case "=~":
+			typ = tokRegexMatch
+		case "!~":
+			typ = tokRegexNoMatch
+		}
+		if typ != tokEOF {
+			tokens = append(tokens, token{typ: typ, val: two, pos: start})
+			pos += 2
+			continue
+		}
+
+		switch c {
+		case '{':
+			typ = tokLBrace
+		case '}':
+			typ = tokRBrace
+		case '(':
+			typ = tokLParen
+		case ')':
+			typ = tokRParen
+		case '[':
+			typ = tokLBracket
+		case ']':
+			typ = tokRBracket
+		case ',':
+			typ = tokComma
+		case '=':
+			typ = tokAssign
+		case '<':
+			typ = tokLSS
+		case '>':
+			typ = tokGTR
+		case '+':
+			typ = tokAdd
+		case '-':
+			typ = tokSub
+		case '*':
+			typ = tokMul
+		case '/':
+			typ = tokDiv
+		case '%':
+			typ = tokMod
+		case '^':
+			typ = tokPow
+		default:
+			r, _ := utf8.DecodeRuneInString(input[pos:])
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, pos)
+		}
+		tokens = append(tokens, token{typ: typ, val: string(c), pos: start})
+		pos++
+	}
+}
+
+// lexNumberOrDuration - 5m, 1h30m и 500ms - длительности, остальное - числа (1.5, 1e3, 0x1f)
+func lexNumberOrDuration(input string, pos int) (tokenType, int) {
+	start := pos
+	if strings.HasPrefix(input[pos:], "0x") || strings.HasPrefix(input[pos:], "0X") {
+		pos += 2
+		for pos < len(input) && strings.IndexByte("0123456789abcdefABCDEF", input[pos]) >= 0 {
+			pos++
+		}
+		return tokNumber, pos
+	}
+
+	for pos < len(input) && isDigit(input[pos]) {
+		pos++
+	}
+
+	if pos < len(input) && isDurationUnit(input[pos]) {
+		for pos < len(input) && (isDigit(input[pos]) || isDurationUnit(input[pos])) {
+			pos++
+		}
+		return tokDuration, pos
+	}
+
+	if pos < len(input) && input[pos] == '.' {
+		pos++
+		for pos < len(input) && isDigit(input[pos]) {
+			pos++
+		}
+	}
+	if pos < len(input) && (input[pos] == 'e' || input[pos] == 'E') {
+		next := pos + 1
+		if next < len(input) && (input[next] == '+' || input[next] == '-') {
+			next++
+		}
+		if next < len(input) && isDigit(input[next]) {
+			pos = next
+			for pos < len(input) && isDigit(input[pos]) {
+				pos++
+			}
+		}
+	}
+
+	if pos == start {
+		pos++
+	}
+	return tokNumber, pos
+}
+
+func lexString(input string, pos int) (string, int, error) {
+	quote := input[pos]
+	start := pos
+	pos++
+
+	var sb strings.Builder
+	for pos < len(input) {
+		c := input[pos]
+		if c == quote {
+			return sb.String(), pos + 1, nil
+		}
+		if c == '\\' && quote != '`' && pos+1 < len(input) {
+			switch input[pos+1] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case '\\', '"', '\'':
+				sb.WriteByte(input[pos+1])
+			default:
+				// \. и подобное в регулярках передается как есть
+				sb.WriteByte('\\')
+				sb.WriteByte(input[pos+1])
+			}
+			pos += 2
+			continue
+		}
+		sb.WriteByte(c)
+		pos++
+	}
+
+	return "", pos, fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isDurationUnit(c byte) bool {
+	return strings.IndexByte("smhdwy", c) >= 0
+}
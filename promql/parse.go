@@ -0,0 +1,660 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb/types"
+)
+
+var aggregators = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true, "group": true,
+	"stddev": true, "stdvar": true, "topk": true, "bottomk": true, "quantile": true, "count_values": true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// ParseExpr - разбирает запрос PromQL в дерево и проверяет типы аргументов
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr(1)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.typ != tokEOF {
+		return nil, p.unexpected(tok, "end of input")
+	}
+
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.typ != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) peekIdent(names ...string) bool {
+	tok := p.peek()
+	if tok.typ != tokIdent {
+		return false
+	}
+	for _, name := range names {
+		if strings.EqualFold(tok.val, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	tok := p.next()
+	if tok.typ != typ {
+		return tok, p.unexpected(tok, fmt.Sprintf("%s in %s", typ, context))
+	}
+	return tok, nil
+}
+
+func (p *parser) unexpected(tok token, expected string) error {
+	found := tok.typ.String()
+	if tok.typ != tokEOF {
+		found = fmt.Sprintf("%q", tok.val)
+	}
+	return fmt.Errorf("parse error at position %d: unexpected %s, expected %s", tok.pos, found, expected)
+}
+
+func precedence(op tokenType) int {
+	switch op {
+	case tokOr:
+		return 1
+	case tokAnd, tokUnless:
+		return 2
+	case tokEQL, tokNEQ, tokLSS, tokLTE, tokGTR, tokGTE:
+		return 3
+	case tokAdd, tokSub:
+		return 4
+	case tokMul, tokDiv, tokMod:
+		return 5
+	case tokPow:
+		return 6
+	}
+	return 0
+}
+
+// parseExpr - разбор бинарных операций по приоритетам, ^ правоассоциативен
+func (p *parser) parseExpr(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek().typ
+		prec := precedence(op)
+		if prec == 0 || prec < minPrec {
+			return lhs, nil
+		}
+		p.next()
+
+		returnBool := false
+		if p.peekIdent("bool") {
+			if !isComparisonOp(op) {
+				return nil, fmt.Errorf("bool modifier can only be used on comparison operators")
+			}
+			p.next()
+			returnBool = true
+		}
+
+		matching, err := p.parseVectorMatching(op)
+		if err != nil {
+			return nil, err
+		}
+
+		nextPrec := prec + 1
+		if op == tokPow {
+			nextPrec = prec
+		}
+		rhs, err := p.parseExpr(nextPrec)
+		if err != nil {
+			return nil, err
+		}
+
+		if lhs, err = newBinaryExpr(op, lhs, rhs, matching, returnBool); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parseVectorMatching(op tokenType) (*VectorMatching, error) {
+	matching := &VectorMatching{Card: CardOneToOne}
+	if isSetOp(op) {
+		matching.Card = CardManyToMany
+	}
+
+	if !p.peekIdent("on", "ignoring") {
+		if p.peekIdent("group_left", "group_right") {
+			return nil, fmt.Errorf("%s must be preceded by on or ignoring", p.peek().val)
+		}
+		return matching, nil
+	}
+
+	matching.On = strings.EqualFold(p.next().val, "on")
+	labels, err := p.parseLabelList()
+	if err != nil {
+		return nil, err
+	}
+	matching.MatchingLabels = labels
+
+	if p.peekIdent("group_left", "group_right") {
+		if isSetOp(op) {
+			return nil, fmt.Errorf("no grouping allowed for %s operation", op)
+		}
+		if strings.EqualFold(p.next().val, "group_left") {
+			matching.Card = CardManyToOne
+		} else {
+			matching.Card = CardOneToMany
+		}
+
+		if p.peek().typ == tokLParen {
+			if matching.Include, err = p.parseLabelList(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if matching.On {
+		for _, include := range matching.Include {
+			for _, label := range matching.MatchingLabels {
+				if include == label {
+					return nil, fmt.Errorf("label %q must not occur in on and group clause at once", label)
+				}
+			}
+		}
+	}
+
+	return matching, nil
+}
+
+func newBinaryExpr(op tokenType, lhs, rhs Expr, matching *VectorMatching, returnBool bool) (Expr, error) {
+	lt, rt := lhs.Type(), rhs.Type()
+	if lt != ValueTypeScalar && lt != ValueTypeVector || rt != ValueTypeScalar && rt != ValueTypeVector {
+		return nil, fmt.Errorf("binary expression must contain only scalar and instant vector types")
+	}
+
+	vectors := lt == ValueTypeVector && rt == ValueTypeVector
+	if isSetOp(op) && !vectors {
+		return nil, fmt.Errorf("set operator %s not allowed in binary scalar expression", op)
+	}
+	if lt == ValueTypeScalar && rt == ValueTypeScalar && isComparisonOp(op) && !returnBool {
+		return nil, fmt.Errorf("comparisons between scalars must use BOOL modifier")
+	}
+	if !vectors && (matching.On || len(matching.MatchingLabels) > 0) {
+		return nil, fmt.Errorf("vector matching only allowed between instant vectors")
+	}
+
+	expr := &BinaryExpr{Op: op, LHS: lhs, RHS: rhs, ReturnBool: returnBool}
+	if vectors {
+		expr.Matching = matching
+	}
+	return expr, nil
+}
+
+// parseUnary - унарный минус связывает слабее, чем ^: -2^2 == -4
+func (p *parser) parseUnary() (Expr, error) {
+	tok := p.peek()
+	if tok.typ != tokSub && tok.typ != tokAdd {
+		return p.parsePostfix()
+	}
+	p.next()
+
+	expr, err := p.parseExpr(precedence(tokPow))
+	if err != nil {
+		return nil, err
+	}
+	if t := expr.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+		return nil, fmt.Errorf("unary expression only allowed on expressions of type scalar or instant vector")
+	}
+
+	if tok.typ == tokAdd {
+		return expr, nil
+	}
+	if number, ok := expr.(*NumberLiteral); ok {
+		number.Val = -number.Val
+		return number, nil
+	}
+	return &UnaryExpr{Expr: expr}, nil
+}
+
+// parsePostfix - первичное выражение с [range] и offset
+func (p *parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.peek().typ == tokLBracket:
+			p.next()
+			selector, ok := expr.(*VectorSelector)
+			if !ok {
+				return nil, fmt.Errorf("ranges only allowed for vector selectors")
+			}
+			tok, err := p.expect(tokDuration, "range selector")
+			if err != nil {
+				return nil, err
+			}
+			rng, err := ParseDuration(tok.val)
+			if err != nil {
+				return nil, err
+			}
+			if rng <= 0 {
+				return nil, fmt.Errorf("range must be positive")
+			}
+			if _, err := p.expect(tokRBracket, "range selector"); err != nil {
+				return nil, err
+			}
+			expr = &MatrixSelector{Selector: selector, Range: rng}
+
+		case p.peekIdent("offset"):
+			p.next()
+			negative := false
+			if p.peek().typ == tokSub {
+				p.next()
+				negative = true
+			}
+			tok, err := p.expect(tokDuration, "offset")
+			if err != nil {
+				return nil, err
+			}
+			offset, err := ParseDuration(tok.val)
+			if err != nil {
+				return nil, err
+			}
+			if negative {
+				offset = -offset
+			}
+
+			var selector *VectorSelector
+			switch e := expr.(type) {
+			case *VectorSelector:
+				selector = e
+			case *MatrixSelector:
+				selector = e.Selector
+			default:
+				return nil, fmt.Errorf("offset modifier must be preceded by a vector or range selector")
+			}
+			if selector.Offset != 0 {
+				return nil, fmt.Errorf("offset may not be set multiple times")
+			}
+			selector.Offset = offset
+
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.next()
+
+	switch tok.typ {
+	case tokNumber:
+		v, err := parseNumber(tok.val)
+		if err != nil {
+			return nil, err
+		}
+		return &NumberLiteral{Val: v}, nil
+
+	case tokString:
+		return &StringLiteral{Val: tok.val}, nil
+
+	case tokLParen:
+		expr, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "parenthesized expression"); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+
+	case tokLBrace:
+		p.pos--
+		return p.parseVectorSelector("")
+
+	case tokIdent:
+		name := tok.val
+		lower := strings.ToLower(name)
+
+		switch {
+		case lower == "inf" || lower == "nan":
+			v, _ := parseNumber(lower)
+			return &NumberLiteral{Val: v}, nil
+		case aggregators[lower] && (p.peek().typ == tokLParen || p.peekIdent("by", "without")):
+			return p.parseAggregate(lower)
+		case p.peek().typ == tokLParen:
+			return p.parseCall(name)
+		}
+		return p.parseVectorSelector(name)
+	}
+
+	return nil, p.unexpected(tok, "expression")
+}
+
+func parseNumber(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "inf":
+		return math.Inf(1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		v, err := strconv.ParseInt(s[2:], 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", s)
+		}
+		return float64(v), nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return v, nil
+}
+
+func (p *parser) parseVectorSelector(name string) (Expr, error) {
+	selector := &VectorSelector{Name: name}
+	if name != "" {
+		selector.Matchers = append(selector.Matchers, types.LabelMatcher{Type: types.MatchEqual, Name: types.MetricNameLabel, Value: name})
+	}
+
+	if p.peek().typ == tokLBrace {
+		p.next()
+		for p.peek().typ != tokRBrace {
+			labelTok := p.next()
+			if labelTok.typ != tokIdent && labelTok.typ != tokAnd && labelTok.typ != tokOr && labelTok.typ != tokUnless {
+				return nil, p.unexpected(labelTok, "label name in label matching")
+			}
+
+			opTok := p.next()
+			var matchType types.MatchType
+			switch opTok.typ {
+			case tokAssign:
+				matchType = types.MatchEqual
+			case tokNEQ:
+				matchType = types.MatchNotEqual
+			case tokRegexMatch:
+				matchType = types.MatchRegexp
+			case tokRegexNoMatch:
+				matchType = types.MatchNotRegexp
+			default:
+				return nil, p.unexpected(opTok, "label matching operator")
+			}
+
+			valueTok, err := p.expect(tokString, "label matching")
+			if err != nil {
+				return nil, err
+			}
+
+			if labelTok.val == types.MetricNameLabel && name != "" {
+				return nil, fmt.Errorf("metric name must not be set twice: %q", name)
+			}
+			selector.Matchers = append(selector.Matchers, types.LabelMatcher{Type: matchType, Name: labelTok.val, Value: valueTok.val})
+
+			if p.peek().typ == tokComma {
+				p.next()
+				continue
+			}
+			if p.peek().typ != tokRBrace {
+				return nil, p.unexpected(p.peek(), "\",\" or \"}\" in label matching")
+			}
+		}
+		p.next()
+	}
+
+	if err := validateSelector(selector); err != nil {
+		return nil, err
+	}
+	return selector, nil
+}
+
+// validateSelector - как в Prometheus, селектор должен отсекать хоть что-то, иначе это "все ряды"
+func validateSelector(selector *VectorSelector) error {
+	for _, m := range selector.Matchers {
+		if m.Type == types.MatchRegexp || m.Type == types.MatchNotRegexp {
+			if _, err := regexp.Compile("^(?:" + m.Value + ")$"); err != nil {
+				return fmt.Errorf("invalid regular expression %q: %v", m.Value, err)
+			}
+		}
+	}
+
+	for _, m := range selector.Matchers {
+		if !matchesEmpty(m) {
+			return nil
+		}
+	}
+	return fmt.Errorf("vector selector must contain at least one non-empty matcher")
+}
+
+func matchesEmpty(m types.LabelMatcher) bool {
+	switch m.Type {
+	case types.MatchEqual:
+		return m.Value == ""
+	case types.MatchNotEqual:
+		return m.Value != ""
+	case types.MatchRegexp:
+		return regexp.MustCompile("^(?:" + m.Value + ")$").MatchString("")
+	case types.MatchNotRegexp:
+		return !regexp.MustCompile("^(?:" + m.Value + ")$").MatchString("")
+	}
+	return true
+}
+
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokLParen, "grouping"); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for p.peek().typ != tokRParen {
+		tok := p.next()
+		if tok.typ != tokIdent && tok.typ != tokAnd && tok.typ != tokOr && tok.typ != tokUnless {
+			return nil, p.unexpected(tok, "label name in grouping")
+		}
+		labels = append(labels, tok.val)
+
+		if p.peek().typ == tokComma {
+			p.next()
+		} else if p.peek().typ != tokRParen {
+			return nil, p.unexpected(p.peek(), "\",\" or \")\" in grouping")
+		}
+	}
+	p.next()
+
+	return labels, nil
+}
+
+func (p *parser) parseGrouping(agg *AggregateExpr) error {
+	agg.Without = strings.EqualFold(p.next().val, "without")
+	labels, err := p.parseLabelList()
+	if err != nil {
+		return err
+	}
+	agg.Grouping = labels
+	return nil
+}
+
+// parseAggregate - sum by (a) (x) и sum(x) by (a) равнозначны
+func (p *parser) parseAggregate(op string) (Expr, error) {
+	agg := &AggregateExpr{Op: op}
+	grouped := false
+
+	if p.peekIdent("by", "without") {
+		if err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+		grouped = true
+	}
+
+	if _, err := p.expect(tokLParen, "aggregation"); err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "topk", "bottomk", "quantile", "count_values":
+		param, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokComma, "aggregation"); err != nil {
+			return nil, err
+		}
+		agg.Param = param
+	}
+
+	expr, err := p.parseExpr(1)
+	if err != nil {
+		return nil, err
+	}
+	agg.Expr = expr
+
+	if _, err := p.expect(tokRParen, "aggregation"); err != nil {
+		return nil, err
+	}
+
+	if !grouped && p.peekIdent("by", "without") {
+		if err := p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+	}
+
+	if agg.Expr.Type() != ValueTypeVector {
+		return nil, fmt.Errorf("expected type instant vector in aggregation expression, got %s", agg.Expr.Type())
+	}
+	if agg.Param != nil {
+		expected := ValueTypeScalar
+		if op == "count_values" {
+			expected = ValueTypeString
+		}
+		if agg.Param.Type() != expected {
+			return nil, fmt.Errorf("expected type %s in aggregation parameter, got %s", expected, agg.Param.Type())
+		}
+	}
+
+	return agg, nil
+}
+
+func (p *parser) parseCall(name string) (Expr, error) {
+	fn, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function with name %q", name)
+	}
+
+	p.next() // (
+	var args []Expr
+	for p.peek().typ != tokRParen {
+		arg, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if p.peek().typ == tokComma {
+			p.next()
+		} else if p.peek().typ != tokRParen {
+			return nil, p.unexpected(p.peek(), "\",\" or \")\" in function call")
+		}
+	}
+	p.next()
+
+	minArgs := len(fn.ArgTypes) - fn.Optional
+	if len(args) < minArgs || len(args) > len(fn.ArgTypes) {
+		if fn.Optional == 0 {
+			return nil, fmt.Errorf("expected %d argument(s) in call to %q, got %d", len(fn.ArgTypes), name, len(args))
+		}
+		return nil, fmt.Errorf("expected %d to %d arguments in call to %q, got %d", minArgs, len(fn.ArgTypes), name, len(args))
+	}
+
+	for i, arg := range args {
+		if arg.Type() != fn.ArgTypes[i] {
+			return nil, fmt.Errorf("expected type %s in call to function %q, got %s", fn.ArgTypes[i], name, arg.Type())
+		}
+	}
+
+	return &Call{Func: fn, Args: args}, nil
+}
+
+// ParseDuration - длительность в формате Prometheus: 30s, 5m, 1h30m, 500ms, 1d, 1w, 1y
+func ParseDuration(s string) (time.Duration, error) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"ms", time.Millisecond},
+		{"s", time.Second},
+		{"m", time.Minute},
+		{"h", time.Hour},
+		{"d", 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"y", 365 * 24 * time.Hour},
+	}
+
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && isDigit(rest[i]) {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[i:]
+
+		matched := false
+		for _, u := range units {
+			if strings.HasPrefix(rest, u.suffix) {
+				if n > int64(math.MaxInt64/u.unit) {
+					return 0, fmt.Errorf("duration %q out of range", s)
+				}
+				total += time.Duration(n) * u.unit
+				rest = rest[len(u.suffix):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+
+	return total, nil
+}
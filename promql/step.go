@@ -0,0 +1,152 @@
+package promql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"tsdb/types"
+)
+
+// stepEvaluator - выражение над рядами, которые хранилище уже свернуло на сетку step.
+// Каждый селектор читается одним Read, дальше операции применяются к точкам
+// с одинаковым таймстемпом, без lookback
+type stepEvaluator struct {
+	vectors    map[*VectorSelector]map[int64]Vector
+	timestamps map[int64]bool
+}
+
+// StepQuery - арифметика и сравнения между селекторами и числами. Селекторы читаются
+// с опциями base (диапазон, step, window_agg, fn, window, fill, max_gap), так что все ряды
+// выровнены по одной сетке. Ряды сопоставляются по одинаковым тегам или по on/ignoring
+func (e *Engine) StepQuery(ctx context.Context, expr Expr, base types.Query) (Matrix, error) {
+	if base.Step <= 0 {
+		return nil, fmt.Errorf("%w: expression requires step", types.ErrInvalidQuery)
+	}
+	if expr.Type() != ValueTypeVector {
+		return nil, fmt.Errorf("%w: expression must contain at least one selector", types.ErrInvalidQuery)
+	}
+
+	ev := &stepEvaluator{
+		vectors:    make(map[*VectorSelector]map[int64]Vector),
+		timestamps: make(map[int64]bool),
+	}
+
+	var err error
+	walk(expr, func(node Expr) {
+		if err != nil {
+			return
+		}
+		switch n := node.(type) {
+		case *NumberLiteral, *ParenExpr, *UnaryExpr, *BinaryExpr:
+		case *VectorSelector:
+			if n.Offset != 0 {
+				err = fmt.Errorf("%w: offset is not supported in expressions", types.ErrInvalidQuery)
+				return
+			}
+			err = ev.load(ctx, e.reader, n, base)
+		default:
+			err = fmt.Errorf("%w: %s is not supported in expressions, only selectors, numbers and binary operators", types.ErrInvalidQuery, unsupportedNode(node))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timestamps := make([]int64, 0, len(ev.timestamps))
+	for t := range ev.timestamps {
+		timestamps = append(timestamps, t)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+
+	bySeries := make(map[string]*Series)
+	for _, t := range timestamps {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result, err := ev.eval(expr, t)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", types.ErrInvalidQuery, err)
+		}
+		if err := appendStep(bySeries, result, t); err != nil {
+			return nil, fmt.Errorf("%w: %v", types.ErrInvalidQuery, err)
+		}
+	}
+
+	return sortedMatrix(bySeries), nil
+}
+
+func (ev *stepEvaluator) load(ctx context.Context, reader types.Reader, selector *VectorSelector, base types.Query) error {
+	if _, loaded := ev.vectors[selector]; loaded {
+		return nil
+	}
+
+	query := base
+	query.Metric = ""
+	query.Tags = nil
+	query.Matchers = selector.Matchers
+	result, err := reader.Read(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	byTime := make(map[int64]Vector)
+	for _, data := range result.Series {
+		labels := labelsFromSeriesID(data.SeriesID)
+		for _, p := range sortPoints(data.Points) {
+			byTime[p.Timestamp] = append(byTime[p.Timestamp], Sample{Labels: labels, T: p.Timestamp, V: p.Value})
+			ev.timestamps[p.Timestamp] = true
+		}
+	}
+	ev.vectors[selector] = byTime
+
+	return nil
+}
+
+func (ev *stepEvaluator) eval(expr Expr, t int64) (Value, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return Scalar{T: t, V: e.Val}, nil
+
+	case *ParenExpr:
+		return ev.eval(e.Expr, t)
+
+	case *UnaryExpr:
+		value, err := ev.eval(e.Expr, t)
+		if err != nil {
+			return nil, err
+		}
+		return negate(value, t), nil
+
+	case *VectorSelector:
+		return ev.vectors[e][t], nil
+
+	case *BinaryExpr:
+		lhs, err := ev.eval(e.LHS, t)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.eval(e.RHS, t)
+		if err != nil {
+			return nil, err
+		}
+		return binaryValues(e, lhs, rhs, t)
+	}
+
+	return nil, fmt.Errorf("unhandled expression of type %T", expr)
+}
+
+func unsupportedNode(node Expr) string {
+	switch n := node.(type) {
+	case *Call:
+		return fmt.Sprintf("function %s()", n.Func.Name)
+	case *AggregateExpr:
+		return fmt.Sprintf("aggregation %s", n.Op)
+	case *MatrixSelector:
+		return "range selector"
+	case *StringLiteral:
+		return "string literal"
+	}
+	return fmt.Sprintf("%T", node)
+}
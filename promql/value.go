@@ -0,0 +1,133 @@
+package promql
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"tsdb/types"
+)
+
+// ValueType - тип результата выражения, названия как в HTTP API Prometheus
+type ValueType string
+
+const (
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeString ValueType = "string"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+)
+
+// Value - Scalar, String, Vector или Matrix
+type Value interface {
+	Type() ValueType
+}
+
+// Labels - теги ряда вместе с именем метрики в __name__
+type Labels map[string]string
+
+type Scalar struct {
+	T int64
+	V float64
+}
+
+type String struct {
+	T int64
+	V string
+}
+
+// Sample - значение одного ряда в момент T
+type Sample struct {
+	Labels Labels
+	T      int64
+	V      float64
+}
+
+type Vector []Sample
+
+// Series - ряд с точками (таймстемпы в наносекундах, как в хранилище)
+type Series struct {
+	Labels Labels
+	Points []types.Point
+}
+
+type Matrix []Series
+
+func (Scalar) Type() ValueType { return ValueTypeScalar }
+func (String) Type() ValueType { return ValueTypeString }
+func (Vector) Type() ValueType { return ValueTypeVector }
+func (Matrix) Type() ValueType { return ValueTypeMatrix }
+
+func labelsFromSeriesID(seriesID types.SeriesIdentifier) Labels {
+	labels := make(Labels, len(seriesID.Tags)+1)
+	for k, v := range seriesID.Tags {
+		labels[k] = v
+	}
+	labels[types.MetricNameLabel] = seriesID.Metric
+	return labels
+}
+
+func (l Labels) copy() Labels {
+	result := make(Labels, len(l))
+	for k, v := range l {
+		result[k] = v
+	}
+	return result
+}
+
+func (l Labels) withoutName() Labels {
+	result := make(Labels, len(l))
+	for k, v := range l {
+		if k != types.MetricNameLabel {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func (l Labels) sortedNames() []string {
+	names := make([]string, 0, len(l))
+	for k := range l {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String - каноническая форма {a="1", b="2"}, используется и как ключ в map
+func (l Labels) String() string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range l.sortedNames() {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(l[name]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// signature - ключ сопоставления рядов: при on - только перечисленные теги,
+// иначе все, кроме перечисленных и __name__
+func (l Labels) signature(on bool, names []string) string {
+	subset := make(Labels, len(l))
+	if on {
+		for _, name := range names {
+			if v, ok := l[name]; ok {
+				subset[name] = v
+			}
+		}
+		return subset.String()
+	}
+
+	for k, v := range l {
+		subset[k] = v
+	}
+	delete(subset, types.MetricNameLabel)
+	for _, name := range names {
+		delete(subset, name)
+	}
+	return subset.String()
+}
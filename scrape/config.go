@@ -0,0 +1,113 @@
+package scrape
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInterval    = 15 * time.Second
+	defaultTimeout     = 10 * time.Second
+	defaultMetricsPath = "/metrics"
+)
+
+// Config - JSON-конфиг скрейпера, по структуре повторяет scrape_configs из Prometheus
+type Config struct {
+	ScrapeConfigs []JobConfig `json:"scrape_configs"`
+}
+
+// JobConfig - группа целей с общими интервалом и метками.
+// Цель - либо host:port (тогда используются scheme и metrics_path), либо полный URL
+type JobConfig struct {
+	JobName        string            `json:"job_name"`
+	ScrapeInterval Duration          `json:"scrape_interval"`
+	ScrapeTimeout  Duration          `json:"scrape_timeout"`
+	Scheme         string            `json:"scheme"`
+	MetricsPath    string            `json:"metrics_path"`
+	Targets        []string          `json:"targets"`
+	Labels         map[string]string `json:"labels"`
+	// SampleLimit - если семплов в ответе больше, опрос считается неудачным (up=0), 0 - без ограничения
+	SampleLimit int `json:"sample_limit"`
+}
+
+// Duration - длительность в формате time.ParseDuration ("15s", "1m")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	for i := range config.ScrapeConfigs {
+		if err := config.ScrapeConfigs[i].applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+func (jc *JobConfig) applyDefaults() error {
+	if jc.JobName == "" {
+		return fmt.Errorf("scrape config without job_name")
+	}
+	if jc.ScrapeInterval <= 0 {
+		jc.ScrapeInterval = Duration(defaultInterval)
+	}
+	if jc.ScrapeTimeout <= 0 {
+		jc.ScrapeTimeout = Duration(defaultTimeout)
+	}
+	if jc.ScrapeTimeout > jc.ScrapeInterval {
+		jc.ScrapeTimeout = jc.ScrapeInterval
+	}
+	if jc.Scheme == "" {
+		jc.Scheme = "http"
+	}
+	if jc.MetricsPath == "" {
+		jc.MetricsPath = defaultMetricsPath
+	}
+	if jc.SampleLimit < 0 {
+		return fmt.Errorf("job %s: negative sample_limit", jc.JobName)
+	}
+
+	for _, target := range jc.Targets {
+		if _, err := jc.targetURL(target); err != nil {
+			return fmt.Errorf("job %s: %w", jc.JobName, err)
+		}
+	}
+
+	return nil
+}
+
+func (jc *JobConfig) targetURL(target string) (*url.URL, error) {
+	raw := target
+	if !strings.Contains(target, "://") {
+		raw = jc.Scheme + "://" + target + jc.MetricsPath
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid target %q", target)
+	}
+	return u, nil
+}
@@ -0,0 +1,196 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"tsdb/ingest"
+	"tsdb/types"
+)
+
+const acceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+// maxScrapeBodySize - ответ цели больше этого считается ошибкой опроса, а не читается в память
+const maxScrapeBodySize = 64 << 20
+
+// Manager - запускает по циклу опроса на каждую цель и пишет результат в движок
+type Manager struct {
+	config *Config
+	writer types.Writer
+	client *http.Client
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// target - одна цель: URL и метки, добавляемые к каждому семплу
+type target struct {
+	url         *url.URL
+	labels      map[string]string
+	interval    time.Duration
+	timeout     time.Duration
+	sampleLimit int
+}
+
+func NewManager(config *Config, writer types.Writer) *Manager {
+	return &Manager{
+		config: config,
+		writer: writer,
+		client: &http.Client{},
+	}
+}
+
+func (m *Manager) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	for _, job := range m.config.ScrapeConfigs {
+		for _, raw := range job.Targets {
+			u, err := job.targetURL(raw)
+			if err != nil {
+				log.Printf("Scrape: %v", err)
+				continue
+			}
+
+			labels := make(map[string]string, len(job.Labels)+2)
+			for k, v := range job.Labels {
+				labels[k] = v
+			}
+			labels["job"] = job.JobName
+			labels["instance"] = u.Host
+
+			t := &target{
+				url:         u,
+				labels:      labels,
+				interval:    time.Duration(job.ScrapeInterval),
+				timeout:     time.Duration(job.ScrapeTimeout),
+				sampleLimit: job.SampleLimit,
+			}
+
+			log.Printf("Scraping %s every %s (job=%s)", u, t.interval, job.JobName)
+			m.wg.Add(1)
+			go m.run(ctx, t)
+		}
+	}
+}
+
+func (m *Manager) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wg.Wait()
+}
+
+func (m *Manager) run(ctx context.Context, t *target) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		m.scrapeOnce(ctx, t)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scrapeOnce - один опрос цели. Кроме семплов пишутся up, scrape_duration_seconds и scrape_samples_scraped
+func (m *Manager) scrapeOnce(ctx context.Context, t *target) {
+	start := time.Now()
+	timestamp := start.UnixNano()
+
+	samples, err := m.fetch(ctx, t, timestamp)
+	duration := time.Since(start)
+
+	batch := ingest.NewBatch()
+	up := 1.0
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Scrape of %s failed: %v", t.url, err)
+		up = 0
+	}
+
+	for _, sample := range samples {
+		if !types.IsFinite(sample.Point.Value) {
+			continue
+		}
+		batch.Add(types.SeriesIdentifier{
+			Metric: sample.SeriesID.Metric,
+			Tags:   applyTargetLabels(sample.SeriesID.Tags, t.labels),
+		}, sample.Point)
+	}
+
+	addReportSample(batch, "up", t.labels, timestamp, up)
+	addReportSample(batch, "scrape_duration_seconds", t.labels, timestamp, duration.Seconds())
+	addReportSample(batch, "scrape_samples_scraped", t.labels, timestamp, float64(len(samples)))
+
+	if err := batch.Flush(m.writer); err != nil {
+		log.Printf("Failed to write scrape of %s: %v", t.url, err)
+	}
+}
+
+func (m *Manager) fetch(ctx context.Context, t *target, timestamp int64) ([]ingest.Sample, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", t.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%g", t.timeout.Seconds()))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+
+	body := &io.LimitedReader{R: resp.Body, N: maxScrapeBodySize + 1}
+	samples, err := ingest.ParsePrometheusText(body, timestamp, t.sampleLimit)
+	if body.N <= 0 {
+		return nil, fmt.Errorf("response body exceeds %d bytes", maxScrapeBodySize)
+	}
+	return samples, err
+}
+
+// applyTargetLabels - метки цели важнее меток семпла, конфликтующие метки
+// семпла сохраняются с префиксом exported_, как при honor_labels: false в Prometheus
+func applyTargetLabels(sampleTags, targetLabels map[string]string) map[string]string {
+	tags := make(map[string]string, len(sampleTags)+len(targetLabels))
+	for k, v := range sampleTags {
+		tags[k] = v
+	}
+
+	for k, v := range targetLabels {
+		if existing, ok := tags[k]; ok && existing != v {
+			tags["exported_"+k] = existing
+		}
+		tags[k] = v
+	}
+
+	return tags
+}
+
+func addReportSample(batch *ingest.Batch, metric string, labels map[string]string, timestamp int64, value float64) {
+	tags := make(map[string]string, len(labels))
+	for k, v := range labels {
+		tags[k] = v
+	}
+
+	batch.Add(types.SeriesIdentifier{Metric: metric, Tags: tags}, types.Point{Timestamp: timestamp, Value: value})
+}
@@ -0,0 +1,69 @@
+package sql
+
+// Select - SELECT fields FROM metric WHERE ... GROUP BY ... ORDER BY ... LIMIT ... OFFSET ...
+type Select struct {
+	Fields  []Field
+	Metric  string
+	Where   []Condition
+	GroupBy GroupBy
+	OrderBy []OrderKey
+	Limit   int // 0 - без ограничения
+	Offset  int
+}
+
+// Field - столбец в SELECT: *, time, value, тег или агрегат func(value) [AS alias]
+type Field struct {
+	Wildcard bool
+	Column   string
+	Func     string
+	Alias    string
+}
+
+// Name - имя столбца в результате
+func (f Field) Name() string {
+	switch {
+	case f.Alias != "":
+		return f.Alias
+	case f.Func != "":
+		return f.Func
+	}
+	return f.Column
+}
+
+// Condition - column op operand. Условия в WHERE соединяются только через AND
+type Condition struct {
+	Column  string
+	Op      string // =, !=, <, <=, >, >=, =~, !~, IN, NOT IN, LIKE, NOT LIKE
+	Operand Operand
+}
+
+type OperandKind int
+
+const (
+	OperandString OperandKind = iota
+	OperandNumber
+	OperandRegex
+	OperandList
+	OperandNow
+)
+
+// Operand - правая часть условия. Shift - прибавленная длительность: now() - 1h,
+// '2021-01-01T00:00:00Z' + 30m
+type Operand struct {
+	Kind   OperandKind
+	Str    string
+	Number float64
+	List   []string
+	Shift  int64
+}
+
+// GroupBy - time(step) и теги. Step 0 - без окон по времени
+type GroupBy struct {
+	Step int64
+	Tags []string
+}
+
+type OrderKey struct {
+	Column string
+	Desc   bool
+}
@@ -0,0 +1,635 @@
+package sql
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"tsdb/engine"
+	"tsdb/types"
+)
+
+// Engine - выполняет запросы SELECT поверх types.Reader. WHERE превращается в types.Query:
+// равенства тегов ищутся по индексу через FindSeries, остальные условия на теги - матчерами,
+// time - диапазоном чтения блоков, value - фильтром, который отбрасывает блоки по min/max
+type Engine struct {
+	reader types.Reader
+}
+
+func NewEngine(reader types.Reader) *Engine {
+	return &Engine{reader: reader}
+}
+
+// Result - строки в порядке Columns: time - int64 (наносекунды), теги - string (nil, если
+// у ряда нет тега), value и агрегаты - float64
+type Result struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// Exec - now подставляется в now() (наносекунды)
+func (e *Engine) Exec(ctx context.Context, stmt *Select, now int64) (Result, error) {
+	query, err := compile(stmt, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	aggregate, err := checkFields(stmt)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	if aggregate {
+		result, err = e.aggregateRows(ctx, stmt, query)
+	} else {
+		var series []types.SeriesData
+		if series, err = e.readPoints(ctx, query); err == nil {
+			result = rawRows(stmt, series)
+		}
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	if err := orderRows(&result, stmt.OrderBy); err != nil {
+		return Result{}, err
+	}
+	result.Rows = limitRows(result.Rows, stmt.Offset, stmt.Limit)
+	return result, nil
+}
+
+// compile - условия WHERE в запрос к хранилищу
+func compile(stmt *Select, now int64) (types.Query, error) {
+	query := types.Query{
+		Metric:    stmt.Metric,
+		Tags:      make(map[string]string),
+		TimeRange: types.TimeRange{Start: math.MinInt64, End: math.MaxInt64},
+	}
+	var filter types.ValueFilter
+
+	for _, cond := range stmt.Where {
+		var err error
+		switch cond.Column {
+		case "time":
+			err = compileTime(&query.TimeRange, cond, now)
+		case "value":
+			err = compileValue(&filter, cond)
+			query.ValueFilter = &filter
+		default:
+			err = compileTag(&query, cond)
+		}
+		if err != nil {
+			return query, fmt.Errorf("%w: %v", types.ErrInvalidQuery, err)
+		}
+	}
+
+	return query, nil
+}
+
+func compileTime(timeRange *types.TimeRange, cond Condition, now int64) error {
+	var ts int64
+	switch cond.Operand.Kind {
+	case OperandNow:
+		ts = now
+	case OperandNumber:
+		if cond.Operand.Number != math.Trunc(cond.Operand.Number) {
+			return fmt.Errorf("time must be an integer number of nanoseconds, got %s", cond.Operand.Str)
+		}
+		// целый литерал берется из текста точно: float64 у границ int64 округляется
+		if n, err := strconv.ParseInt(cond.Operand.Str, 10, 64); err == nil {
+			ts = n
+		} else if cond.Operand.Number < math.MinInt64 || cond.Operand.Number >= math.MaxInt64 {
+			return fmt.Errorf("time %s is out of range", cond.Operand.Str)
+		} else {
+			ts = int64(cond.Operand.Number)
+		}
+	case OperandString:
+		t, err := time.Parse(time.RFC3339Nano, cond.Operand.Str)
+		if err != nil {
+			return fmt.Errorf("invalid time %q, expected RFC3339", cond.Operand.Str)
+		}
+		ts = t.UnixNano()
+	default:
+		return fmt.Errorf("time must be compared with now(), a timestamp or an RFC3339 string")
+	}
+	ts = shiftTime(ts, cond.Operand.Shift)
+
+	switch cond.Op {
+	case ">":
+		timeRange.Start = max(timeRange.Start, shiftTime(ts, 1))
+	case ">=":
+		timeRange.Start = max(timeRange.Start, ts)
+	case "<":
+		timeRange.End = min(timeRange.End, shiftTime(ts, -1))
+	case "<=":
+		timeRange.End = min(timeRange.End, ts)
+	case "=":
+		timeRange.Start = max(timeRange.Start, ts)
+		timeRange.End = min(timeRange.End, ts)
+	default:
+		return fmt.Errorf("operator %s is not supported for time", cond.Op)
+	}
+	return nil
+}
+
+// shiftTime - ts+shift, упирающееся в границы int64 вместо переполнения
+func shiftTime(ts, shift int64) int64 {
+	switch {
+	case shift > 0 && ts > math.MaxInt64-shift:
+		return math.MaxInt64
+	case shift < 0 && ts < math.MinInt64-shift:
+		return math.MinInt64
+	}
+	return ts + shift
+}
+
+// compileValue - несколько условий на value сужают диапазон
+func compileValue(filter *types.ValueFilter, cond Condition) error {
+	if cond.Operand.Kind != OperandNumber || cond.Operand.Shift != 0 {
+		return fmt.Errorf("value must be compared with a number")
+	}
+	v := cond.Operand.Number
+
+	raiseMin := func(inclusive bool) {
+		if filter.Min == nil || v > *filter.Min || (v == *filter.Min && !inclusive) {
+			filter.Min, filter.MinInclusive = &v, inclusive
+		}
+	}
+	lowerMax := func(inclusive bool) {
+		if filter.Max == nil || v < *filter.Max || (v == *filter.Max && !inclusive) {
+			filter.Max, filter.MaxInclusive = &v, inclusive
+		}
+	}
+
+	switch cond.Op {
+	case ">":
+		raiseMin(false)
+	case ">=":
+		raiseMin(true)
+	case "<":
+		lowerMax(false)
+	case "<=":
+		lowerMax(true)
+	case "=":
+		raiseMin(true)
+		lowerMax(true)
+	default:
+		return fmt.Errorf("operator %s is not supported for value", cond.Op)
+	}
+	return nil
+}
+
+// compileTag - непустое равенство идет в Tags (поиск через FindSeries), остальное - в Matchers.
+// Регулярки, как и в /query, должны совпадать со всем значением тега
+func compileTag(query *types.Query, cond Condition) error {
+	operand := cond.Operand
+	if operand.Shift != 0 || (operand.Kind != OperandString && operand.Kind != OperandRegex && operand.Kind != OperandList) {
+		return fmt.Errorf("tag %s must be compared with a string", cond.Column)
+	}
+
+	matcher := types.LabelMatcher{Name: cond.Column, Value: operand.Str}
+	switch cond.Op {
+	case "=", "!=":
+		if operand.Kind != OperandString {
+			return fmt.Errorf("tag %s must be compared with a string", cond.Column)
+		}
+		if _, used := query.Tags[cond.Column]; cond.Op == "=" && operand.Str != "" && operand.Str != "*" && !used {
+			query.Tags[cond.Column] = operand.Str
+			return nil
+		}
+		matcher.Type = types.MatchEqual
+		if cond.Op == "!=" {
+			matcher.Type = types.MatchNotEqual
+		}
+	case "=~":
+		matcher.Type = types.MatchRegexp
+	case "!~":
+		matcher.Type = types.MatchNotRegexp
+	case "IN", "NOT IN":
+		quoted := make([]string, len(operand.List))
+		for i, value := range operand.List {
+			quoted[i] = regexp.QuoteMeta(value)
+		}
+		matcher.Value = strings.Join(quoted, "|")
+		matcher.Type = types.MatchRegexp
+		if cond.Op == "NOT IN" {
+			matcher.Type = types.MatchNotRegexp
+		}
+	case "LIKE", "NOT LIKE":
+		matcher.Value = likePattern(operand.Str)
+		matcher.Type = types.MatchRegexp
+		if cond.Op == "NOT LIKE" {
+			matcher.Type = types.MatchNotRegexp
+		}
+	default:
+		return fmt.Errorf("operator %s is not supported for tag %s", cond.Op, cond.Column)
+	}
+
+	query.Matchers = append(query.Matchers, matcher)
+	return nil
+}
+
+// likePattern - % - любая подстрока, _ - любой символ
+func likePattern(like string) string {
+	var sb strings.Builder
+	for _, r := range like {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteByte('.')
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
+
+// checkFields - в запросе с агрегатами остальные столбцы могут быть только ключами GROUP BY,
+// они и так идут в результат первыми
+func checkFields(stmt *Select) (bool, error) {
+	aggregate := stmt.GroupBy.Step > 0 || len(stmt.GroupBy.Tags) > 0
+	hasFunc := false
+	for _, field := range stmt.Fields {
+		if field.Func != "" {
+			aggregate, hasFunc = true, true
+		}
+	}
+	if !aggregate {
+		return false, nil
+	}
+	if !hasFunc {
+		return true, fmt.Errorf("%w: GROUP BY requires an aggregate function in SELECT", types.ErrInvalidQuery)
+	}
+
+	for _, field := range stmt.Fields {
+		switch {
+		case field.Func != "":
+		case field.Wildcard:
+			return true, fmt.Errorf("%w: * cannot be combined with aggregate functions", types.ErrInvalidQuery)
+		case field.Column == "time" && stmt.GroupBy.Step > 0:
+		case !slices.Contains(stmt.GroupBy.Tags, field.Column):
+			return true, fmt.Errorf("%w: column %q must appear in GROUP BY or be used in an aggregate function", types.ErrInvalidQuery, field.Column)
+		}
+	}
+	return true, nil
+}
+
+// rawRows - по строке на точку. Без ORDER BY строки идут по рядам, внутри ряда по времени,
+// поэтому с LIMIT чтение строк останавливается, как только их набралось достаточно
+func rawRows(stmt *Select, series []types.SeriesData) Result {
+	// sources - откуда берется значение столбца, с псевдонимом имя в columns другое
+	var columns, sources []string
+	for _, field := range stmt.Fields {
+		if !field.Wildcard {
+			columns = append(columns, field.Name())
+			sources = append(sources, field.Column)
+			continue
+		}
+		tags := make(map[string]bool)
+		for _, data := range series {
+			for name := range data.SeriesID.Tags {
+				tags[name] = true
+			}
+		}
+		expanded := append(append([]string{"time"}, slices.Sorted(maps.Keys(tags))...), "value")
+		columns = append(columns, expanded...)
+		sources = append(sources, expanded...)
+	}
+
+	maxRows := -1
+	if len(stmt.OrderBy) == 0 && stmt.Limit > 0 {
+		maxRows = stmt.Offset + stmt.Limit
+	}
+
+	result := Result{Columns: columns, Rows: [][]interface{}{}}
+	for _, data := range series {
+		for _, point := range data.Points {
+			if len(result.Rows) == maxRows {
+				return result
+			}
+			row := make([]interface{}, len(sources))
+			for i, column := range sources {
+				switch column {
+				case "time":
+					row[i] = point.Timestamp
+				case "value":
+					row[i] = point.Value
+				default:
+					if v, ok := data.SeriesID.Tags[column]; ok {
+						row[i] = v
+					}
+				}
+			}
+			result.Rows = append(result.Rows, row)
+		}
+	}
+	return result
+}
+
+// windowOps - функции окна engine, из которых собирается агрегат SQL. count нужен всем:
+// без него окна разных рядов не слить через engine.Aggregator
+var windowOps = map[string][]string{
+	"count":  {"count"},
+	"sum":    {"count", "sum"},
+	"avg":    {"count", "sum"},
+	"min":    {"count", "min"},
+	"max":    {"count", "max"},
+	"stddev": {"count", "sum", "stddev"},
+}
+
+// windowOpOrder - stddev читается после count и sum, по ним восстанавливается сумма квадратов
+var windowOpOrder = []string{"count", "sum", "min", "max", "stddev"}
+
+// cell - агрегаты одной клетки (группа тегов, окно). first и last - по времени точки,
+// а не по порядку чтения рядов
+type cell struct {
+	acc         engine.Aggregator
+	points      int
+	first, last types.Point
+}
+
+func (c *cell) addPoint(p types.Point) {
+	if c.points == 0 || p.Timestamp < c.first.Timestamp {
+		c.first = p
+	}
+	if c.points == 0 || p.Timestamp >= c.last.Timestamp {
+		c.last = p
+	}
+	c.points++
+}
+
+func (c *cell) value(fn string) float64 {
+	switch fn {
+	case "first":
+		return c.first.Value
+	case "last":
+		return c.last.Value
+	}
+	return c.acc.Value(fn)
+}
+
+// aggregateRows - по строке на группу тегов GROUP BY и окно time(). Окна каждого ряда считает
+// engine через Step/WindowAgg (по заголовкам блоков, где можно), здесь окна рядов только сливаются
+// в группы. first и last по окнам рядов не слить, для них читаются точки.
+// Столбцы: time (начало окна), теги GROUP BY, затем агрегаты из SELECT. Без ORDER BY строки идут
+// по группам, внутри по времени
+func (e *Engine) aggregateRows(ctx context.Context, stmt *Select, query types.Query) (Result, error) {
+	type group struct {
+		tags    []interface{}
+		windows map[int64]*cell
+	}
+	groups := make(map[string]*group)
+	var order []string
+
+	cellAt := func(seriesTags map[string]string, ts int64) *cell {
+		tags := make([]interface{}, len(stmt.GroupBy.Tags))
+		var key strings.Builder
+		for i, name := range stmt.GroupBy.Tags {
+			if v, ok := seriesTags[name]; ok {
+				tags[i] = v
+				key.WriteString(v)
+			}
+			key.WriteByte(0)
+		}
+
+		g, ok := groups[key.String()]
+		if !ok {
+			g = &group{tags: tags, windows: make(map[int64]*cell)}
+			groups[key.String()] = g
+			order = append(order, key.String())
+		}
+
+		var window int64
+		if stmt.GroupBy.Step > 0 {
+			window = engine.WindowStart(ts, stmt.GroupBy.Step)
+		}
+		c, ok := g.windows[window]
+		if !ok {
+			c = &cell{}
+			g.windows[window] = c
+		}
+		return c
+	}
+
+	needed := make(map[string]bool)
+	needPoints := false
+	for _, field := range stmt.Fields {
+		for _, op := range windowOps[field.Func] {
+			needed[op] = true
+		}
+		if field.Func == "first" || field.Func == "last" {
+			needPoints = true
+		}
+	}
+
+	windowQuery := query
+	windowQuery.Step = stmt.GroupBy.Step
+	if windowQuery.Step == 0 {
+		// без time() все точки ряда попадают в одно окно
+		windowQuery.Step = math.MaxInt64
+	}
+
+	// windows - окна рядов по seriesKey, ключ окна - начало окна от engine
+	type seriesWindows struct {
+		tags    map[string]string
+		windows map[int64]*engine.Aggregator
+	}
+	windows := make(map[string]*seriesWindows)
+	for _, op := range windowOpOrder {
+		if !needed[op] {
+			continue
+		}
+		windowQuery.WindowAgg = op
+		data, err := e.reader.Read(ctx, windowQuery)
+		if err != nil {
+			return Result{}, err
+		}
+
+		for _, series := range data.Series {
+			key := seriesKey(series.SeriesID.Tags)
+			sw, ok := windows[key]
+			if !ok {
+				sw = &seriesWindows{tags: series.SeriesID.Tags, windows: make(map[int64]*engine.Aggregator)}
+				windows[key] = sw
+			}
+			for _, point := range series.Points {
+				acc, ok := sw.windows[point.Timestamp]
+				if !ok {
+					acc = &engine.Aggregator{}
+					sw.windows[point.Timestamp] = acc
+				}
+				switch op {
+				case "count":
+					acc.Count = int64(point.Value)
+				case "sum":
+					acc.Sum = point.Value
+				case "min":
+					acc.Min = point.Value
+				case "max":
+					acc.Max = point.Value
+				case "stddev":
+					mean := acc.Sum / float64(acc.Count)
+					acc.SumSq = float64(acc.Count) * (point.Value*point.Value + mean*mean)
+				}
+			}
+		}
+	}
+	for _, sw := range windows {
+		for ts, acc := range sw.windows {
+			cellAt(sw.tags, ts).acc.Merge(*acc)
+		}
+	}
+
+	if needPoints {
+		series, err := e.readPoints(ctx, query)
+		if err != nil {
+			return Result{}, err
+		}
+		for _, data := range series {
+			for _, point := range data.Points {
+				cellAt(data.SeriesID.Tags, point.Timestamp).addPoint(point)
+			}
+		}
+	}
+
+	var result Result
+	if stmt.GroupBy.Step > 0 {
+		result.Columns = append(result.Columns, "time")
+	}
+	result.Columns = append(result.Columns, stmt.GroupBy.Tags...)
+	var funcs []string
+	for _, field := range stmt.Fields {
+		if field.Func != "" {
+			result.Columns = append(result.Columns, field.Name())
+			funcs = append(funcs, field.Func)
+		}
+	}
+
+	sort.Strings(order)
+	result.Rows = [][]interface{}{}
+	for _, key := range order {
+		g := groups[key]
+		windows := make([]int64, 0, len(g.windows))
+		for window := range g.windows {
+			windows = append(windows, window)
+		}
+		sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+
+		for _, window := range windows {
+			row := make([]interface{}, 0, len(result.Columns))
+			if stmt.GroupBy.Step > 0 {
+				row = append(row, window)
+			}
+			row = append(row, g.tags...)
+			for _, fn := range funcs {
+				row = append(row, g.windows[window].value(fn))
+			}
+			result.Rows = append(result.Rows, row)
+		}
+	}
+	return result, nil
+}
+
+// readPoints - точки рядов без повторов таймстемпов, ряды по тегам
+func (e *Engine) readPoints(ctx context.Context, query types.Query) ([]types.SeriesData, error) {
+	data, err := e.reader.Read(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for i := range data.Series {
+		data.Series[i].Points = engine.DedupPoints(data.Series[i].Points)
+	}
+	sort.Slice(data.Series, func(i, j int) bool {
+		return seriesKey(data.Series[i].SeriesID.Tags) < seriesKey(data.Series[j].SeriesID.Tags)
+	})
+	return data.Series, nil
+}
+
+// orderRows - ORDER BY по именам столбцов результата, nil идет первым
+func orderRows(result *Result, keys []OrderKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = -1
+		for j, column := range result.Columns {
+			if column == key.Column {
+				indexes[i] = j
+				break
+			}
+		}
+		if indexes[i] < 0 {
+			return fmt.Errorf("%w: unknown column %q in ORDER BY", types.ErrInvalidQuery, key.Column)
+		}
+	}
+
+	sort.SliceStable(result.Rows, func(i, j int) bool {
+		for k, key := range keys {
+			c := compareValues(result.Rows[i][indexes[k]], result.Rows[j][indexes[k]])
+			if c == 0 {
+				continue
+			}
+			if key.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+	return nil
+}
+
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			return cmp.Compare(a, b)
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			return cmp.Compare(a, b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	}
+	// в одном столбце разные типы бывают только из-за nil
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	}
+	return 1
+}
+
+func limitRows(rows [][]interface{}, offset, limit int) [][]interface{} {
+	rows = rows[min(offset, len(rows)):]
+	if limit > 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+func seriesKey(tags map[string]string) string {
+	var sb strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(tags)) {
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(tags[name])
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
@@ -0,0 +1,248 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdent
+	tokQuotedIdent
+	tokNumber
+	tokDuration
+	tokString
+	tokRegex
+	tokLParen
+	tokRParen
+	tokComma
+	tokSemicolon
+	tokStar
+	tokAdd
+	tokSub
+	tokEQ
+	tokNEQ
+	tokLSS
+	tokLTE
+	tokGTR
+	tokGTE
+	tokRegexMatch
+	tokRegexNoMatch
+)
+
+var tokenNames = map[tokenType]string{
+	tokEOF: "end of input", tokIdent: "identifier", tokQuotedIdent: "identifier", tokNumber: "number",
+	tokDuration: "duration", tokString: "string", tokRegex: "regex", tokLParen: "(", tokRParen: ")",
+	tokComma: ",", tokSemicolon: ";", tokStar: "*", tokAdd: "+", tokSub: "-", tokEQ: "=", tokNEQ: "!=",
+	tokLSS: "<", tokLTE: "<=", tokGTR: ">", tokGTE: ">=", tokRegexMatch: "=~", tokRegexNoMatch: "!~",
+}
+
+func (t tokenType) String() string {
+	return tokenNames[t]
+}
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+// lex - строки в одинарных кавычках, идентификаторы в двойных, регулярки в /.../
+func lex(input string) ([]token, error) {
+	var tokens []token
+	pos := 0
+
+	for {
+		for pos < len(input) && strings.IndexByte(" \t\r\n", input[pos]) >= 0 {
+			pos++
+		}
+		if strings.HasPrefix(input[pos:], "--") {
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		}
+		if pos >= len(input) {
+			return append(tokens, token{typ: tokEOF, pos: pos}), nil
+		}
+
+		start := pos
+		c := input[pos]
+
+		switch {
+		case isAlpha(c):
+			for pos < len(input) && (isAlpha(input[pos]) || isDigit(input[pos])) {
+				pos++
+			}
+			tokens = append(tokens, token{typ: tokIdent, val: input[start:pos], pos: start})
+			continue
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			typ, end := lexNumberOrDuration(input, pos)
+			tokens = append(tokens, token{typ: typ, val: input[start:end], pos: start})
+			pos = end
+			continue
+		case c == '\'' || c == '"':
+			s, end, err := lexQuoted(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			typ := tokString
+			if c == '"' {
+				typ = tokQuotedIdent
+			}
+			tokens = append(tokens, token{typ: typ, val: s, pos: start})
+			pos = end
+			continue
+		case c == '/':
+			s, end, err := lexRegex(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{typ: tokRegex, val: s, pos: start})
+			pos = end
+			continue
+		}
+
+		two := ""
+		if pos+1 < len(input) {
+			two = input[pos : pos+2]
+		}
+		typ := tokEOF
+		switch two {
+		case "!=", "<>":
+			typ = tokNEQ
+		case "<=":
+			typ = tokLTE
+		case ">=":
+			typ = tokGTE
+		case "=~":
+			typ = tokRegexMatch
+		case "!~":
+			typ = tokRegexNoMatch
+		}
+		if typ != tokEOF {
+			tokens = append(tokens, token{typ: typ, val: two, pos: start})
+			pos += 2
+			continue
+		}
+
+		switch c {
+		case '(':
+			typ = tokLParen
+		case ')':
+			typ = tokRParen
+		case ',':
+			typ = tokComma
+		case ';':
+			typ = tokSemicolon
+		case '*':
+			typ = tokStar
+		case '+':
+			typ = tokAdd
+		case '-':
+			typ = tokSub
+		case '=':
+			typ = tokEQ
+		case '<':
+			typ = tokLSS
+		case '>':
+			typ = tokGTR
+		default:
+			r, _ := utf8.DecodeRuneInString(input[pos:])
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, pos)
+		}
+		tokens = append(tokens, token{typ: typ, val: string(c), pos: start})
+		pos++
+	}
+}
+
+// lexNumberOrDuration - число с буквами после него (1h, 30s, 1h30m, 7d) - длительность
+func lexNumberOrDuration(input string, pos int) (tokenType, int) {
+	for pos < len(input) && isDigit(input[pos]) {
+		pos++
+	}
+	if pos < len(input) && isAlpha(input[pos]) && input[pos] != 'e' && input[pos] != 'E' {
+		for pos < len(input) && (isAlpha(input[pos]) || isDigit(input[pos])) {
+			pos++
+		}
+		return tokDuration, pos
+	}
+
+	if pos < len(input) && input[pos] == '.' {
+		pos++
+		for pos < len(input) && isDigit(input[pos]) {
+			pos++
+		}
+	}
+	if pos < len(input) && (input[pos] == 'e' || input[pos] == 'E') {
+		next := pos + 1
+		if next < len(input) && (input[next] == '+' || input[next] == '-') {
+			next++
+		}
+		if next < len(input) && isDigit(input[next]) {
+			pos = next
+			for pos < len(input) && isDigit(input[pos]) {
+				pos++
+			}
+		}
+	}
+	return tokNumber, pos
+}
+
+// lexQuoted - как в SQL, кавычка внутри строки удваивается
+func lexQuoted(input string, pos int) (string, int, error) {
+	quote := input[pos]
+	start := pos
+	pos++
+
+	var sb strings.Builder
+	for pos < len(input) {
+		c := input[pos]
+		if c == quote {
+			if pos+1 < len(input) && input[pos+1] == quote {
+				sb.WriteByte(quote)
+				pos += 2
+				continue
+			}
+			return sb.String(), pos + 1, nil
+		}
+		sb.WriteByte(c)
+		pos++
+	}
+
+	return "", pos, fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+// lexRegex - /.../, \/ внутри - косая черта, остальные экранирования передаются как есть
+func lexRegex(input string, pos int) (string, int, error) {
+	start := pos
+	pos++
+
+	var sb strings.Builder
+	for pos < len(input) {
+		c := input[pos]
+		if c == '/' {
+			return sb.String(), pos + 1, nil
+		}
+		if c == '\\' && pos+1 < len(input) && input[pos+1] == '/' {
+			sb.WriteByte('/')
+			pos += 2
+			continue
+		}
+		sb.WriteByte(c)
+		pos++
+	}
+
+	return "", pos, fmt.Errorf("unterminated regex starting at position %d", start)
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,455 @@
+package sql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aggregateFuncs - агрегаты в SELECT, считаются по всем точкам группы
+var aggregateFuncs = map[string]bool{
+	"avg": true, "min": true, "max": true, "sum": true, "count": true, "first": true, "last": true, "stddev": true,
+}
+
+// keywords - без кавычек не могут быть именами тегов и метрик
+var keywords = map[string]bool{
+	"select": true, "from": true, "where": true, "and": true, "or": true, "group": true, "by": true,
+	"order": true, "asc": true, "desc": true, "limit": true, "offset": true, "as": true, "in": true,
+	"not": true, "like": true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse - разбирает запрос SELECT
+func Parse(input string) (*Select, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	stmt, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().typ == tokSemicolon {
+		p.next()
+	}
+	if tok := p.peek(); tok.typ != tokEOF {
+		return nil, p.unexpected(tok, "end of query")
+	}
+
+	return stmt, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.typ != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) peekKeyword(names ...string) bool {
+	tok := p.peek()
+	if tok.typ != tokIdent {
+		return false
+	}
+	for _, name := range names {
+		if strings.EqualFold(tok.val, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(name string) error {
+	if !p.peekKeyword(name) {
+		return p.unexpected(p.peek(), strings.ToUpper(name))
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	tok := p.next()
+	if tok.typ != typ {
+		return tok, p.unexpected(tok, fmt.Sprintf("%s in %s", typ, context))
+	}
+	return tok, nil
+}
+
+func (p *parser) unexpected(tok token, expected string) error {
+	found := tok.typ.String()
+	if tok.typ != tokEOF {
+		found = fmt.Sprintf("%q", tok.val)
+	}
+	return fmt.Errorf("parse error at position %d: unexpected %s, expected %s", tok.pos, found, expected)
+}
+
+// parseIdent - имя тега, метрики или псевдоним: без кавычек или в "..."
+func (p *parser) parseIdent(context string) (string, error) {
+	tok := p.next()
+	switch {
+	case tok.typ == tokQuotedIdent:
+		return tok.val, nil
+	case tok.typ == tokIdent && !keywords[strings.ToLower(tok.val)]:
+		return tok.val, nil
+	}
+	return "", p.unexpected(tok, "identifier in "+context)
+}
+
+func (p *parser) parseSelect() (*Select, error) {
+	if err := p.expectKeyword("select"); err != nil {
+		return nil, err
+	}
+
+	stmt := &Select{}
+	for {
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Fields = append(stmt.Fields, field)
+		if p.peek().typ != tokComma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	metric, err := p.parseIdent("FROM")
+	if err != nil {
+		return nil, err
+	}
+	stmt.Metric = metric
+
+	if p.peekKeyword("where") {
+		p.next()
+		if stmt.Where, err = p.parseWhere(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peekKeyword("group") {
+		p.next()
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if stmt.GroupBy, err = p.parseGroupBy(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peekKeyword("order") {
+		p.next()
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		if stmt.OrderBy, err = p.parseOrderBy(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peekKeyword("limit") {
+		p.next()
+		if stmt.Limit, err = p.parseCount("LIMIT"); err != nil {
+			return nil, err
+		}
+	}
+	if p.peekKeyword("offset") {
+		p.next()
+		if stmt.Offset, err = p.parseCount("OFFSET"); err != nil {
+			return nil, err
+		}
+	}
+
+	return stmt, nil
+}
+
+// parseField - *, столбец или агрегат: avg(value), count(*)
+func (p *parser) parseField() (Field, error) {
+	if p.peek().typ == tokStar {
+		p.next()
+		return Field{Wildcard: true}, nil
+	}
+
+	var field Field
+	if tok := p.peek(); tok.typ == tokIdent && p.tokens[p.pos+1].typ == tokLParen {
+		p.next()
+		p.next()
+		name := strings.ToLower(tok.val)
+		if !aggregateFuncs[name] {
+			return field, fmt.Errorf("unknown function %s()", tok.val)
+		}
+		field.Func = name
+
+		arg := p.next()
+		switch {
+		case arg.typ == tokStar && name == "count":
+		case arg.typ == tokIdent && strings.EqualFold(arg.val, "value"):
+		default:
+			return field, p.unexpected(arg, fmt.Sprintf("value in %s()", name))
+		}
+		field.Column = "value"
+
+		if _, err := p.expect(tokRParen, name+"()"); err != nil {
+			return field, err
+		}
+	} else {
+		column, err := p.parseIdent("SELECT")
+		if err != nil {
+			return field, err
+		}
+		field.Column = column
+	}
+
+	if p.peekKeyword("as") {
+		p.next()
+		alias, err := p.parseIdent("AS")
+		if err != nil {
+			return field, err
+		}
+		field.Alias = alias
+	}
+	return field, nil
+}
+
+func (p *parser) parseWhere() ([]Condition, error) {
+	var conditions []Condition
+	for {
+		condition, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+
+		if p.peekKeyword("or") {
+			return nil, fmt.Errorf("OR is not supported, use IN (...) or a regex")
+		}
+		if !p.peekKeyword("and") {
+			return conditions, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseCondition() (Condition, error) {
+	column, err := p.parseIdent("WHERE")
+	if err != nil {
+		return Condition{}, err
+	}
+	condition := Condition{Column: column}
+
+	tok := p.next()
+	switch tok.typ {
+	case tokEQ, tokNEQ, tokLSS, tokLTE, tokGTR, tokGTE:
+		condition.Op = tok.typ.String()
+		condition.Operand, err = p.parseOperand()
+		return condition, err
+
+	case tokRegexMatch, tokRegexNoMatch:
+		condition.Op = tok.typ.String()
+		operand := p.next()
+		if operand.typ != tokRegex && operand.typ != tokString {
+			return condition, p.unexpected(operand, "regex after "+condition.Op)
+		}
+		condition.Operand = Operand{Kind: OperandRegex, Str: operand.val}
+		return condition, nil
+
+	case tokIdent:
+		op := strings.ToUpper(tok.val)
+		if op == "NOT" && p.peekKeyword("in", "like") {
+			op += " " + strings.ToUpper(p.next().val)
+		}
+		switch op {
+		case "IN", "NOT IN":
+			condition.Op = op
+			condition.Operand, err = p.parseList()
+			return condition, err
+		case "LIKE", "NOT LIKE":
+			condition.Op = op
+			operand, err := p.expect(tokString, op)
+			condition.Operand = Operand{Kind: OperandString, Str: operand.val}
+			return condition, err
+		}
+	}
+
+	return condition, p.unexpected(tok, "comparison operator")
+}
+
+// parseOperand - строка, число, регулярка или now(), к времени можно прибавить длительность
+func (p *parser) parseOperand() (Operand, error) {
+	var operand Operand
+
+	tok := p.next()
+	switch {
+	case tok.typ == tokString:
+		operand = Operand{Kind: OperandString, Str: tok.val}
+	case tok.typ == tokRegex:
+		return Operand{Kind: OperandRegex, Str: tok.val}, nil
+	case tok.typ == tokNumber, tok.typ == tokSub && p.peek().typ == tokNumber:
+		text := tok.val
+		if tok.typ == tokSub {
+			text = "-" + p.next().val
+		}
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return operand, fmt.Errorf("invalid number %q", text)
+		}
+		operand = Operand{Kind: OperandNumber, Str: text, Number: v}
+	case tok.typ == tokIdent && strings.EqualFold(tok.val, "now"):
+		if _, err := p.expect(tokLParen, "now()"); err != nil {
+			return operand, err
+		}
+		if _, err := p.expect(tokRParen, "now()"); err != nil {
+			return operand, err
+		}
+		operand = Operand{Kind: OperandNow}
+	default:
+		return operand, p.unexpected(tok, "string, number or now()")
+	}
+
+	for p.peek().typ == tokAdd || p.peek().typ == tokSub {
+		sign := int64(1)
+		if p.next().typ == tokSub {
+			sign = -1
+		}
+		tok, err := p.expect(tokDuration, "time expression")
+		if err != nil {
+			return operand, err
+		}
+		d, err := parseDuration(tok.val)
+		if err != nil {
+			return operand, err
+		}
+		d *= sign
+		if d > 0 && operand.Shift > math.MaxInt64-d || d < 0 && operand.Shift < math.MinInt64-d {
+			return operand, fmt.Errorf("time shift out of range at %s", tok.val)
+		}
+		operand.Shift += d
+	}
+	return operand, nil
+}
+
+func (p *parser) parseList() (Operand, error) {
+	operand := Operand{Kind: OperandList}
+	if _, err := p.expect(tokLParen, "IN"); err != nil {
+		return operand, err
+	}
+	for {
+		tok, err := p.expect(tokString, "IN")
+		if err != nil {
+			return operand, err
+		}
+		operand.List = append(operand.List, tok.val)
+		if p.peek().typ != tokComma {
+			break
+		}
+		p.next()
+	}
+	_, err := p.expect(tokRParen, "IN")
+	return operand, err
+}
+
+// parseGroupBy - time(1m) и теги в любом порядке
+func (p *parser) parseGroupBy() (GroupBy, error) {
+	var groupBy GroupBy
+	for {
+		if p.peekKeyword("time") {
+			tok := p.next()
+			if _, err := p.expect(tokLParen, "GROUP BY time()"); err != nil {
+				return groupBy, err
+			}
+			if groupBy.Step != 0 {
+				return groupBy, fmt.Errorf("parse error at position %d: time() is used twice in GROUP BY", tok.pos)
+			}
+			interval, err := p.expect(tokDuration, "GROUP BY time()")
+			if err != nil {
+				return groupBy, err
+			}
+			if groupBy.Step, err = parseDuration(interval.val); err != nil {
+				return groupBy, err
+			}
+			if groupBy.Step <= 0 {
+				return groupBy, fmt.Errorf("GROUP BY time() interval must be positive")
+			}
+			if _, err := p.expect(tokRParen, "GROUP BY time()"); err != nil {
+				return groupBy, err
+			}
+		} else {
+			tag, err := p.parseIdent("GROUP BY")
+			if err != nil {
+				return groupBy, err
+			}
+			groupBy.Tags = append(groupBy.Tags, tag)
+		}
+
+		if p.peek().typ != tokComma {
+			return groupBy, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseOrderBy() ([]OrderKey, error) {
+	var keys []OrderKey
+	for {
+		column, err := p.parseIdent("ORDER BY")
+		if err != nil {
+			return nil, err
+		}
+		key := OrderKey{Column: column}
+		if p.peekKeyword("asc", "desc") {
+			key.Desc = strings.EqualFold(p.next().val, "desc")
+		}
+		keys = append(keys, key)
+
+		if p.peek().typ != tokComma {
+			return keys, nil
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseCount(context string) (int, error) {
+	tok, err := p.expect(tokNumber, context)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(tok.val)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", context, tok.val)
+	}
+	return n, nil
+}
+
+// parseDuration - как в Go (1h30m, 500ms), плюс дни и недели: 7d, 2w
+func parseDuration(s string) (int64, error) {
+	units := map[byte]time.Duration{'d': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if unit, ok := units[s[len(s)-1]]; ok {
+		if n, err := strconv.ParseInt(s[:len(s)-1], 10, 64); err == nil {
+			if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+				return 0, fmt.Errorf("duration %q out of range", s)
+			}
+			return n * int64(unit), nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return int64(d), nil
+}
@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"fmt"
+	"math"
 	"tsdb/encoding"
 	"tsdb/types"
 )
 
+// MaxBlockPoints - PointCount в заголовке блока - int16, больше точек в блок не помещается
+const MaxBlockPoints = math.MaxInt16
+
 type BlockManager struct {
 	blockSize int
 }
@@ -19,9 +24,17 @@ func (bm *BlockManager) CreateBlock(points []types.Point) (*types.DataBlock, err
 	if len(points) == 0 {
 		return nil, nil
 	}
+	if len(points) > MaxBlockPoints {
+		return nil, fmt.Errorf("block of %d points exceeds the limit of %d", len(points), MaxBlockPoints)
+	}
 
 	minValue := points[0].Value
 	maxValue := points[0].Value
+	// точки одной записи могут прийти не по порядку, а по границам блока решается,
+	// целиком ли он попадает в запрос
+	startTime := points[0].Timestamp
+	endTime := points[0].Timestamp
+	var sum, sumSq float64
 
 	for _, p := range points {
 		if p.Value < minValue {
@@ -30,6 +43,10 @@ func (bm *BlockManager) CreateBlock(points []types.Point) (*types.DataBlock, err
 		if p.Value > maxValue {
 			maxValue = p.Value
 		}
+		startTime = min(startTime, p.Timestamp)
+		endTime = max(endTime, p.Timestamp)
+		sum += p.Value
+		sumSq += p.Value * p.Value
 	}
 
 	compressedTimestamps, compressedValues, err := encoding.CompressPoints(points)
@@ -38,11 +55,13 @@ func (bm *BlockManager) CreateBlock(points []types.Point) (*types.DataBlock, err
 	}
 
 	return &types.DataBlock{
-		StartTime:  points[0].Timestamp,
-		EndTime:    points[len(points)-1].Timestamp,
+		StartTime:  startTime,
+		EndTime:    endTime,
 		PointCount: int16(len(points)),
 		MinValue:   minValue,
 		MaxValue:   maxValue,
+		Sum:        sum,
+		SumSq:      sumSq,
 		Timestamps: compressedTimestamps,
 		Values:     compressedValues,
 	}, nil
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"encoding/binary"
 	"io"
 	"log"
@@ -31,7 +32,7 @@ func (fm *FileManager) CreateSeriesFile(metric string, tags map[string]string) (
 	filename := fm.generateFilename(tags)
 	filePath := filepath.Join(metricDir, filename)
 
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := openForAppend(filePath)
 	if err != nil {
 		return "", nil, err
 	}
@@ -48,7 +49,7 @@ func (fm *FileManager) GetOrCreateSeriesFile(metric string, tags map[string]stri
 	filename := fm.generateFilename(tags)
 	filePath := filepath.Join(metricDir, filename)
 
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := openForAppend(filePath)
 	if err != nil {
 		return "", nil, err
 	}
@@ -80,11 +81,31 @@ func (fm *FileManager) WriteBlock(file *os.File, block *types.DataBlock) error {
 		PointCount: block.PointCount,
 		MinValue:   block.MinValue,
 		MaxValue:   block.MaxValue,
+		Sum:        block.Sum,
+		SumSq:      block.SumSq,
 		TsSize:     int32(len(block.Timestamps)),
 		ValueSize:  int32(len(block.Values)),
 	}
 
-	if err := binary.Write(file, binary.LittleEndian, header); err != nil {
+	legacy, err := isLegacyFile(file)
+	if err != nil {
+		return err
+	}
+
+	if legacy {
+		err = binary.Write(file, binary.LittleEndian, legacyBlockHeader{
+			StartTime:  header.StartTime,
+			EndTime:    header.EndTime,
+			PointCount: header.PointCount,
+			MinValue:   header.MinValue,
+			MaxValue:   header.MaxValue,
+			TsSize:     header.TsSize,
+			ValueSize:  header.ValueSize,
+		})
+	} else {
+		err = binary.Write(file, binary.LittleEndian, header)
+	}
+	if err != nil {
 		return err
 	}
 
@@ -99,23 +120,49 @@ func (fm *FileManager) WriteBlock(file *os.File, block *types.DataBlock) error {
 	return file.Sync()
 }
 
+// ReadBlock - следующий блок файла, открытого на чтение
 func (fm *FileManager) ReadBlock(file *os.File) (*types.DataBlock, error) {
-	var header types.BlockHeader
-
-	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
-		if err == io.EOF {
-			return nil, io.EOF
+	legacy, err := isLegacyFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !legacy {
+		if offset, err := file.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		} else if offset == 0 {
+			if _, err := file.Seek(int64(len(blockFileMagic)), io.SeekStart); err != nil {
+				return nil, err
+			}
 		}
+	}
+
+	header, err := fm.readBlockHeader(file, legacy)
+	if err != nil {
 		return nil, err
 	}
+	return fm.readBlockData(file, header)
+}
+
+func (fm *FileManager) readBlockHeader(file *os.File, legacy bool) (types.BlockHeader, error) {
+	if legacy {
+		var header legacyBlockHeader
+		err := binary.Read(file, binary.LittleEndian, &header)
+		return header.header(), err
+	}
+
+	var header types.BlockHeader
+	err := binary.Read(file, binary.LittleEndian, &header)
+	return header, err
+}
 
+func (fm *FileManager) readBlockData(file *os.File, header types.BlockHeader) (*types.DataBlock, error) {
 	timestamps := make([]byte, header.TsSize)
-	if _, err := file.Read(timestamps); err != nil {
+	if _, err := io.ReadFull(file, timestamps); err != nil {
 		return nil, err
 	}
 
 	values := make([]byte, header.ValueSize)
-	if _, err := file.Read(values); err != nil {
+	if _, err := io.ReadFull(file, values); err != nil {
 		return nil, err
 	}
 
@@ -125,64 +172,265 @@ func (fm *FileManager) ReadBlock(file *os.File) (*types.DataBlock, error) {
 		PointCount: header.PointCount,
 		MinValue:   header.MinValue,
 		MaxValue:   header.MaxValue,
+		Sum:        header.Sum,
+		SumSq:      header.SumSq,
 		Timestamps: timestamps,
 		Values:     values,
 	}, nil
 }
 
-func (fm *FileManager) ReadPointsFromFile(filePath string, startTime, endTime int64) ([]types.Point, error) {
-	log.Printf("Reading points from file: %s, time range: [%d, %d]", filePath, startTime, endTime)
+// skipBlockData - данные блока, отброшенного по заголовку, не читаются с диска
+func (fm *FileManager) skipBlockData(file *os.File, header types.BlockHeader) error {
+	_, err := file.Seek(int64(header.TsSize)+int64(header.ValueSize), io.SeekCurrent)
+	return err
+}
 
-	file, err := fm.OpenSeriesFile(filePath)
+// ReadStats - сколько блоков распаковано, сколько отброшено по MinValue/MaxValue заголовка
+// и сколько учтено по одному заголовку без распаковки
+type ReadStats struct {
+	BlocksRead       int
+	BlocksSkipped    int
+	BlocksFromHeader int
+}
+
+// BlockScan - обход блоков файла с точками из [StartTime, EndTime], подходящими под Filter
+type BlockScan struct {
+	StartTime int64
+	EndTime   int64
+	Filter    *types.ValueFilter
+	// UseHeader - хватит ли заголовка вместо точек блока. Вызывается только для блоков
+	// с Sum/SumSq, которые целиком лежат в диапазоне и целиком подходят под Filter
+	UseHeader func(header types.BlockHeader) bool
+	// Points - точки распакованного блока, уже отфильтрованные по времени и Filter.
+	// Ошибка прерывает обход и возвращается из ScanBlocks
+	Points func(points []types.Point) error
+}
+
+func (fm *FileManager) ReadPointsFromFile(ctx context.Context, filePath string, startTime, endTime int64) ([]types.Point, error) {
+	points, _, err := fm.ReadPointsWithFilter(ctx, filePath, startTime, endTime, nil)
+	return points, err
+}
+
+// ReadPointsWithFilter - как ReadPointsFromFile, но возвращает только точки, подходящие под filter.
+// Блоки, в диапазон значений которых filter не попадает, пропускаются без распаковки
+func (fm *FileManager) ReadPointsWithFilter(ctx context.Context, filePath string, startTime, endTime int64, filter *types.ValueFilter) ([]types.Point, ReadStats, error) {
+	var allPoints []types.Point
+	stats, err := fm.ScanBlocks(ctx, filePath, BlockScan{
+		StartTime: startTime,
+		EndTime:   endTime,
+		Filter:    filter,
+		Points: func(points []types.Point) error {
+			allPoints = append(allPoints, points...)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+
+	log.Printf("Total points read from file %s: %d", filePath, len(allPoints))
+	return allPoints, stats, nil
+}
+
+// ScanBlocks - перед каждым блоком проверяет ctx, так что отмененный запрос бросает файл на середине
+func (fm *FileManager) ScanBlocks(ctx context.Context, filePath string, scan BlockScan) (ReadStats, error) {
+	log.Printf("Reading points from file: %s, time range: [%d, %d]", filePath, scan.StartTime, scan.EndTime)
+
+	var stats ReadStats
+
+	file, legacy, err := fm.openBlocks(filePath)
 	if err != nil {
 		log.Printf("Error opening file %s: %v", filePath, err)
-		return nil, err
+		return stats, err
 	}
 	defer file.Close()
 
-	var allPoints []types.Point
 	blockCount := 0
-
 	for {
-		block, err := fm.ReadBlock(file)
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		header, err := fm.readBlockHeader(file, legacy)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			log.Printf("Error reading block from file %s: %v", filePath, err)
-			return nil, err
+			return stats, err
 		}
 
 		blockCount++
 		log.Printf("Read block %d: start=%d, end=%d, points=%d",
-			blockCount, block.StartTime, block.EndTime, block.PointCount)
+			blockCount, header.StartTime, header.EndTime, header.PointCount)
 
-		if block.EndTime < startTime || block.StartTime > endTime {
+		if header.EndTime < scan.StartTime || header.StartTime > scan.EndTime {
 			log.Printf("Block %d outside time range, skipping", blockCount)
+			if err := fm.skipBlockData(file, header); err != nil {
+				return stats, err
+			}
+			continue
+		}
+
+		if scan.Filter != nil && !scan.Filter.MayMatch(header.MinValue, header.MaxValue) {
+			log.Printf("Block %d outside value range [%v, %v], skipping", blockCount, header.MinValue, header.MaxValue)
+			stats.BlocksSkipped++
+			if err := fm.skipBlockData(file, header); err != nil {
+				return stats, err
+			}
 			continue
 		}
 
+		covered := header.StartTime >= scan.StartTime && header.EndTime <= scan.EndTime &&
+			(scan.Filter == nil || scan.Filter.Match(header.MinValue) && scan.Filter.Match(header.MaxValue))
+		if !legacy && covered && scan.UseHeader != nil && scan.UseHeader(header) {
+			stats.BlocksFromHeader++
+			if err := fm.skipBlockData(file, header); err != nil {
+				return stats, err
+			}
+			continue
+		}
+
+		block, err := fm.readBlockData(file, header)
+		if err != nil {
+			log.Printf("Error reading block from file %s: %v", filePath, err)
+			return stats, err
+		}
+
 		points, err := encoding.DecompressPoints(block.Timestamps, block.Values, int(block.PointCount))
 		if err != nil {
 			log.Printf("Error decompressing points in block %d: %v", blockCount, err)
-			return nil, err
+			return stats, err
 		}
+		stats.BlocksRead++
 
 		log.Printf("Decompressed %d points from block %d", len(points), blockCount)
 
+		matched := points[:0]
 		for _, point := range points {
-			if point.Timestamp >= startTime && point.Timestamp <= endTime {
-				allPoints = append(allPoints, point)
+			if point.Timestamp >= scan.StartTime && point.Timestamp <= scan.EndTime && (scan.Filter == nil || scan.Filter.Match(point.Value)) {
+				matched = append(matched, point)
+			}
+		}
+		if len(matched) > 0 {
+			if err := scan.Points(matched); err != nil {
+				return stats, err
 			}
 		}
 	}
 
-	log.Printf("Total points read from file %s: %d", filePath, len(allPoints))
-	return allPoints, nil
+	return stats, nil
+}
+
+// ReadLastPoint - точка с наибольшим таймстемпом. Распаковывается только блок с наибольшим
+// EndTime, остальные пропускаются по заголовкам. false - в файле нет точек
+func (fm *FileManager) ReadLastPoint(filePath string) (types.Point, bool, error) {
+	file, legacy, err := fm.openBlocks(filePath)
+	if err != nil {
+		return types.Point{}, false, err
+	}
+	defer file.Close()
+
+	var (
+		lastHeader types.BlockHeader
+		lastOffset int64 = -1
+	)
+	for {
+		header, err := fm.readBlockHeader(file, legacy)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return types.Point{}, false, err
+		}
+
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return types.Point{}, false, err
+		}
+		if header.PointCount > 0 && (lastOffset < 0 || header.EndTime >= lastHeader.EndTime) {
+			lastHeader, lastOffset = header, offset
+		}
+
+		if err := fm.skipBlockData(file, header); err != nil {
+			return types.Point{}, false, err
+		}
+	}
+
+	if lastOffset < 0 {
+		return types.Point{}, false, nil
+	}
+
+	if _, err := file.Seek(lastOffset, io.SeekStart); err != nil {
+		return types.Point{}, false, err
+	}
+	block, err := fm.readBlockData(file, lastHeader)
+	if err != nil {
+		return types.Point{}, false, err
+	}
+	points, err := encoding.DecompressPoints(block.Timestamps, block.Values, int(block.PointCount))
+	if err != nil {
+		return types.Point{}, false, err
+	}
+
+	last := points[0]
+	for _, p := range points[1:] {
+		if p.Timestamp >= last.Timestamp {
+			last = p
+		}
+	}
+	return last, true, nil
+}
+
+// ReadBlockHeaders - заголовки всех блоков файла без чтения данных. false - файл старого
+// формата, Sum и SumSq в заголовках нулевые
+func (fm *FileManager) ReadBlockHeaders(filePath string) ([]types.BlockHeader, bool, error) {
+	file, legacy, err := fm.openBlocks(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	var headers []types.BlockHeader
+	for {
+		header, err := fm.readBlockHeader(file, legacy)
+		if err == io.EOF {
+			return headers, !legacy, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		headers = append(headers, header)
+
+		if err := fm.skipBlockData(file, header); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// openBlocks - файл, установленный на первый заголовок блока, и признак старого формата
+func (fm *FileManager) openBlocks(filePath string) (*os.File, bool, error) {
+	file, err := fm.OpenSeriesFile(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	legacy, err := isLegacyFile(file)
+	if err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	if !legacy {
+		if _, err := file.Seek(int64(len(blockFileMagic)), io.SeekStart); err != nil {
+			file.Close()
+			return nil, false, err
+		}
+	}
+	return file, legacy, nil
 }
 
-func (fm *FileManager) ReadAllPointsFromFile(filePath string) ([]types.Point, error) {
-	return fm.ReadPointsFromFile(filePath, 0, 1<<62)
+func (fm *FileManager) ReadAllPointsFromFile(ctx context.Context, filePath string) ([]types.Point, error) {
+	return fm.ReadPointsFromFile(ctx, filePath, 0, 1<<62)
 }
 
 func (fm *FileManager) generateFilename(tags map[string]string) string {
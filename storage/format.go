@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"tsdb/types"
+)
+
+// blockFileMagic - начало файла ряда с заголовками блоков types.BlockHeader. Файлы без него
+// записаны до появления Sum/SumSq: в них заголовки legacyBlockHeader, и дописываются они
+// в том же формате, чтобы в одном файле не смешивались два формата
+const blockFileMagic = "TSDBBLK2"
+
+// legacyBlockHeader - заголовок блока без Sum и SumSq
+type legacyBlockHeader struct {
+	StartTime  int64
+	EndTime    int64
+	PointCount int16
+	MinValue   float64
+	MaxValue   float64
+	TsSize     int32
+	ValueSize  int32
+}
+
+func (h legacyBlockHeader) header() types.BlockHeader {
+	return types.BlockHeader{
+		StartTime:  h.StartTime,
+		EndTime:    h.EndTime,
+		PointCount: h.PointCount,
+		MinValue:   h.MinValue,
+		MaxValue:   h.MaxValue,
+		TsSize:     h.TsSize,
+		ValueSize:  h.ValueSize,
+	}
+}
+
+// openForAppend - новый (пустой) файл сразу получает blockFileMagic
+func openForAppend(filePath string) (*os.File, error) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		if _, err := file.Write([]byte(blockFileMagic)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+// isLegacyFile - файл без blockFileMagic. Позиция чтения не меняется
+func isLegacyFile(file *os.File) (bool, error) {
+	magic := make([]byte, len(blockFileMagic))
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return n < len(magic) || string(magic) != blockFileMagic, nil
+}
@@ -23,3 +23,40 @@ curl -X POST http://localhost:8080/write   -H "Content-Type: application/json"
 curl "http://localhost:8080/series"
 # получить конкретную метрику
 curl "http://localhost:8080/query?metric=GPU&start=0&end=1700000000000000000&server=ND-1234"
+# все серверы, кроме ND-1234, в prod и staging
+curl -g "http://localhost:8080/query?metric=GPU&start=0&end=1700000000000000000&server!=ND-1234&env=~prod|staging"
+# текущее значение каждого ряда
+curl "http://localhost:8080/query/last?metric=GPU"
+# среднее по всем рядам метрики с разбивкой по env
+curl "http://localhost:8080/query?metric=GPU&start=0&end=1700000000000000000&agg=avg&group_by=env"
+# когда GPU был загружен больше чем на 95%
+curl -g "http://localhost:8080/query?metric=GPU&start=0&end=1700000000000000000&value>95"
+# максимум за каждые 5 минут
+curl "http://localhost:8080/query?metric=GPU&start=0&end=1700000000000000000&step=5m&window_agg=max"
+# доля ошибок по хостам, поминутно
+curl -G "http://localhost:8080/query/expr" --data-urlencode 'expr=errors / on(host) requests' -d step=1m -d start=1609459200000000000 -d end=1609462800000000000
+# 10 хостов с наибольшим максимумом GPU за час
+curl "http://localhost:8080/query?metric=GPU&start=1609459200000000000&end=1609462800000000000&topk=10&rank_by=max"
+# SQL: среднее по хостам поминутно за последний час
+curl -G "http://localhost:8080/sql" --data-urlencode "q=SELECT avg(value) FROM cpu WHERE env='prod' AND time > now()-1h GROUP BY time(1m), host ORDER BY time LIMIT 100"
+# по точке в минуту, пропуски до 5 минут заполняются линейной интерполяцией
+curl "http://localhost:8080/query?metric=GPU&start=1609459200000000000&end=1609462800000000000&step=1m&fill=linear&max_gap=5m"
+# скорость роста счетчика в секунду по окну 5 минут, раз в минуту
+curl "http://localhost:8080/query?metric=GPU&start=0&end=1700000000000000000&fn=rate&window=5m&step=1m"
+# InfluxDB line protocol (поля становятся рядами cpu_usage_user, cpu_usage_system)
+curl -X POST "http://localhost:8080/api/v2/write?precision=s" --data-binary 'cpu,host=ND-1234,env=prod usage_user=12.5,usage_system=3i 1609459200'
+# OpenTSDB /api/put (таймстемп в секундах или миллисекундах)
+curl -X POST "http://localhost:8080/api/put?details" -d '[{"metric": "sys.cpu.user", "timestamp": 1609459200, "value": 42.5, "tags": {"host": "ND-1234"}}]'
+# импорт CSV (ряды node_cpu и node_mem с тегом host)
+curl -X POST "http://localhost:8080/import/csv?timestamp=time&precision=s&tags=host&values=cpu,mem&metric=node" --data-binary $'time,host,cpu,mem\n1609459200,ND-1234,12.5,40\n1609459260,ND-1234,13.1,41'
+# потоковая запись NDJSON: строка - ряд или одна точка
+curl -X POST http://localhost:8080/write/ndjson --data-binary $'{"metric": "GPU", "tags": {"server": "ND-1234"}, "points": [{"timestamp": 1609459380000000000, "value": 15.1}]}\n{"metric": "GPU", "tags": {"server": "ND-1234"}, "timestamp": 1609459440000000000, "value": 15.9}'
+# справочники для автодополнения
+curl "http://localhost:8080/metrics?prefix=G"
+curl "http://localhost:8080/labels?metric=GPU"
+curl "http://localhost:8080/label/server/values?metric=GPU&limit=10"
+# кардинальность: топ-5 и рост числа рядов за последний час
+curl "http://localhost:8080/status/cardinality?limit=5&since=1h"
+# PromQL (время в секундах)
+curl -G "http://localhost:8080/api/v1/query" --data-urlencode 'query=sum by (server) (rate(GPU[5m]))' --data-urlencode 'time=1609459320'
+curl -G "http://localhost:8080/api/v1/query_range" --data-urlencode 'query=avg_over_time(GPU{server="ND-1234"}[2m])' -d start=1609459200 -d end=1609459440 -d step=60
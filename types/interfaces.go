@@ -1,12 +1,14 @@
 package types
 
+import "context"
+
 type Writer interface {
 	Write(request WriteRequest) error
 	Flush() error
 }
 
 type Reader interface {
-	Read(query Query) (QueryResult, error)
+	Read(ctx context.Context, query Query) (QueryResult, error)
 	FindSeries(metric string, tags map[string]string) []SeriesIdentifier
 }
 
@@ -1,5 +1,25 @@
 package types
 
+import (
+	"errors"
+	"math"
+)
+
+// ErrInvalidQuery - ошибка в самом запросе (а не в хранилище), API отвечает на нее 400
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ErrLimitExceeded - запрос затрагивает больше рядов или точек, чем разрешено, API отвечает на нее 422
+var ErrLimitExceeded = errors.New("query limit exceeded")
+
+// ErrInvalidWrite - точки, которые нельзя сохранить (см. IsFinite), API отвечает на нее 400
+var ErrInvalidWrite = errors.New("invalid write")
+
+// IsFinite - можно ли сохранить значение. NaN и ±Inf не принимаются ни одним протоколом записи:
+// WAL хранит точки в JSON, который их не кодирует
+func IsFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
 // Point - точка данных (семпл)
 type Point struct {
 	Timestamp int64   `json:"timestamp"`
@@ -18,11 +38,81 @@ type TimeRange struct {
 	End   int64 `json:"end"`
 }
 
-// Query - запрос на чтение
+// MetricNameLabel - псевдо-тег с именем метрики, как в Prometheus
+const MetricNameLabel = "__name__"
+
+// MatchType - способ сравнения значения тега
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+// LabelMatcher - условие на значение тега (или имени метрики через MetricNameLabel)
+type LabelMatcher struct {
+	Type  MatchType `json:"type"`
+	Name  string    `json:"name"`
+	Value string    `json:"value"`
+}
+
+// ValueFilter - условие на значения точек. Границы nil не ограничивают, Inclusive - нестрогое сравнение
+type ValueFilter struct {
+	Min          *float64 `json:"min,omitempty"`
+	MinInclusive bool     `json:"min_inclusive,omitempty"`
+	Max          *float64 `json:"max,omitempty"`
+	MaxInclusive bool     `json:"max_inclusive,omitempty"`
+}
+
+func (f *ValueFilter) Match(v float64) bool {
+	if f.Min != nil && (v < *f.Min || v == *f.Min && !f.MinInclusive) {
+		return false
+	}
+	if f.Max != nil && (v > *f.Max || v == *f.Max && !f.MaxInclusive) {
+		return false
+	}
+	return true
+}
+
+// MayMatch - может ли среди значений из [min, max] найтись подходящее
+func (f *ValueFilter) MayMatch(min, max float64) bool {
+	if f.Min != nil && (max < *f.Min || max == *f.Min && !f.MinInclusive) {
+		return false
+	}
+	if f.Max != nil && (min > *f.Max || min == *f.Max && !f.MaxInclusive) {
+		return false
+	}
+	return true
+}
+
+// Query - запрос на чтение. Длительности в наносекундах
 type Query struct {
 	Metric    string            `json:"metric"`
 	Tags      map[string]string `json:"tags"`
+	Matchers  []LabelMatcher    `json:"matchers,omitempty"`
 	TimeRange TimeRange         `json:"time_range"`
+	// ValueFilter - отбрасывает точки до всех вычислений
+	ValueFilter *ValueFilter `json:"value_filter,omitempty"`
+	// Step - длина окон, в которые сворачиваются точки каждого ряда, с Function - шаг сетки
+	Step int64 `json:"step,omitempty"`
+	// WindowAgg - функция свертки окна Step
+	WindowAgg string `json:"window_agg,omitempty"`
+	// Function - функция по окну Window (rate и т.п.), возвращается вместо точек ряда
+	Function string `json:"fn,omitempty"`
+	Window   int64  `json:"window,omitempty"`
+	// Fill - чем заполнять окна Step без точек (пустое значение - NaN)
+	Fill string `json:"fill,omitempty"`
+	// MaxGap - через какой пропуск previous и linear уже не тянут значение
+	MaxGap int64 `json:"max_gap,omitempty"`
+	// Aggregation - сливает ряды в один на каждую комбинацию значений тегов из GroupBy
+	Aggregation string   `json:"agg,omitempty"`
+	GroupBy     []string `json:"group_by,omitempty"`
+	// TopK (BottomK) - k рядов с наибольшим (наименьшим) RankBy по точкам диапазона, по месту в рейтинге
+	TopK    int    `json:"topk,omitempty"`
+	BottomK int    `json:"bottomk,omitempty"`
+	RankBy  string `json:"rank_by,omitempty"`
 }
 
 // WriteRequest - запрос на запись
@@ -36,9 +126,10 @@ type SeriesData struct {
 	Points   []Point          `json:"points"`
 }
 
-// QueryResult - результат запроса
+// QueryResult - результат запроса. BlocksSkipped - блоки, отброшенные по ValueFilter без распаковки
 type QueryResult struct {
-	Series []SeriesData `json:"series"`
+	Series        []SeriesData `json:"series"`
+	BlocksSkipped int          `json:"blocks_skipped,omitempty"`
 }
 
 // SeriesMetadata - метаданные ряда
@@ -52,6 +143,9 @@ type SeriesMetadata struct {
 	MinValue    float64          `json:"min_value"`
 	MaxValue    float64          `json:"max_value"`
 	CreatedAt   int64            `json:"created_at"`
+	// UniqueTimestamps - таймстемпы в ряду не повторяются, так что окна можно считать по заголовкам
+	// блоков. Снимается, как только блок пересекся по времени с уже записанными или повторы есть в нем самом
+	UniqueTimestamps bool `json:"unique_timestamps"`
 }
 
 // DataBlock - блок сжатых данных
@@ -61,17 +155,22 @@ type DataBlock struct {
 	PointCount int16   `json:"point_count"`
 	MinValue   float64 `json:"min_value"`
 	MaxValue   float64 `json:"max_value"`
+	Sum        float64 `json:"sum"`
+	SumSq      float64 `json:"sum_sq"`
 	Timestamps []byte  `json:"timestamps"`
 	Values     []byte  `json:"values"`
 }
 
-// BlockHeader - заголовок блока данных
+// BlockHeader - заголовок блока данных. По PointCount, MinValue, MaxValue, Sum и SumSq
+// агрегаты по блоку считаются без распаковки
 type BlockHeader struct {
 	StartTime  int64
 	EndTime    int64
 	PointCount int16
 	MinValue   float64
 	MaxValue   float64
+	Sum        float64
+	SumSq      float64
 	TsSize     int32
 	ValueSize  int32
 }
@@ -8,14 +8,21 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// checkpointFile - номер записи, до которой все записи WAL уже применены
+const checkpointFile = "checkpoint"
+
 type WALRecord struct {
 	Type      string    `json:"type"` // "write", "delete"
 	Timestamp time.Time `json:"timestamp"`
 	Data      []byte    `json:"data"`
+	// LSN - номер записи, у записей старых версий его нет
+	LSN uint64 `json:"lsn,omitempty"`
 }
 
 type WAL struct {
@@ -25,18 +32,28 @@ type WAL struct {
 	maxFileSize  int64
 	segmentIndex int
 	mutex        sync.RWMutex
+	// lastLSN - номер последней записи, checkpointLSN - до какого номера записи уже применены
+	lastLSN       uint64
+	checkpointLSN uint64
+	// segmentLSN - номер последней записи каждого сегмента
+	segmentLSN map[int]uint64
 }
 
 func NewWAL(dataDir string, maxFileSize int64) (*WAL, error) {
 	wal := &WAL{
 		dataDir:     dataDir,
 		maxFileSize: maxFileSize,
+		segmentLSN:  make(map[int]uint64),
 	}
 
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, err
 	}
 
+	if err := wal.readCheckpoint(); err != nil {
+		return nil, err
+	}
+
 	if err := wal.openOrCreateSegment(); err != nil {
 		return nil, err
 	}
@@ -44,24 +61,27 @@ func NewWAL(dataDir string, maxFileSize int64) (*WAL, error) {
 	return wal, nil
 }
 
-func (w *WAL) Write(recordType string, data interface{}) error {
+// Write - возвращает номер записи для Checkpoint
+func (w *WAL) Write(recordType string, data interface{}) (uint64, error) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	w.lastLSN++
 	record := WALRecord{
 		Type:      recordType,
 		Timestamp: time.Now(),
 		Data:      jsonData,
+		LSN:       w.lastLSN,
 	}
 
 	recordData, err := json.Marshal(record)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	lengthBuf := make([]byte, 4)
@@ -71,27 +91,29 @@ func (w *WAL) Write(recordType string, data interface{}) error {
 
 	if w.currentSize+totalSize >= w.maxFileSize {
 		if err := w.rotate(); err != nil {
-			return err
+			return 0, err
 		}
 	}
 
 	if _, err := w.currentFile.Write(lengthBuf); err != nil {
-		return err
+		return 0, err
 	}
 
 	if _, err := w.currentFile.Write(recordData); err != nil {
-		return err
+		return 0, err
 	}
 
 	if err := w.currentFile.Sync(); err != nil {
-		return err
+		return 0, err
 	}
 
 	w.currentSize += totalSize
+	w.segmentLSN[w.segmentIndex] = record.LSN
 
-	return nil
+	return record.LSN, nil
 }
 
+// Read - передает handler записи после контрольной точки, записи старых версий без номера - всегда
 func (w *WAL) Read(handler func(recordType string, data []byte) error) error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
@@ -111,6 +133,12 @@ func (w *WAL) Read(handler func(recordType string, data []byte) error) error {
 	}
 
 	for _, segment := range segments {
+		// пустые сегменты и сегменты старых версий тоже удаляются на первой контрольной точке
+		index := segmentIndexOf(segment)
+		if _, ok := w.segmentLSN[index]; !ok {
+			w.segmentLSN[index] = 0
+		}
+
 		file, err := os.Open(segment)
 		if err != nil {
 			return err
@@ -143,6 +171,12 @@ func (w *WAL) Read(handler func(recordType string, data []byte) error) error {
 				continue
 			}
 
+			w.lastLSN = max(w.lastLSN, record.LSN)
+			w.segmentLSN[index] = max(w.segmentLSN[index], record.LSN)
+			if record.LSN != 0 && record.LSN <= w.checkpointLSN {
+				continue
+			}
+
 			if err := handler(record.Type, record.Data); err != nil {
 				file.Close()
 				return err
@@ -153,8 +187,7 @@ func (w *WAL) Read(handler func(recordType string, data []byte) error) error {
 	}
 
 	if currentFile != nil {
-		filename := filepath.Join(w.dataDir, fmt.Sprintf("segment_%04d.wal", segmentIndex))
-		file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+		file, err := os.OpenFile(w.segmentPath(segmentIndex), os.O_APPEND|os.O_WRONLY, 0644)
 		if err != nil {
 			return err
 		}
@@ -181,6 +214,77 @@ func (w *WAL) Close() error {
 	return nil
 }
 
+// LastLSN - номер последней записи
+func (w *WAL) LastLSN() uint64 {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.lastLSN
+}
+
+// Checkpoint - записи до lsn включительно применены и при старте не повторяются. Сегменты,
+// где все записи не новее lsn, удаляются, текущий сегмент в этом случае обрезается
+func (w *WAL) Checkpoint(lsn uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if lsn < w.checkpointLSN {
+		return nil
+	}
+	if lsn > w.checkpointLSN {
+		if err := w.writeCheckpoint(lsn); err != nil {
+			return err
+		}
+		w.checkpointLSN = lsn
+	}
+
+	for index, last := range w.segmentLSN {
+		if index == w.segmentIndex || last > lsn {
+			continue
+		}
+		if err := os.Remove(w.segmentPath(index)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(w.segmentLSN, index)
+	}
+
+	if w.currentSize == 0 || w.segmentLSN[w.segmentIndex] > lsn {
+		return nil
+	}
+	if err := w.currentFile.Truncate(0); err != nil {
+		return err
+	}
+	w.currentSize = 0
+	return w.currentFile.Sync()
+}
+
+func (w *WAL) readCheckpoint() error {
+	data, err := os.ReadFile(filepath.Join(w.dataDir, checkpointFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lsn, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid WAL checkpoint: %w", err)
+	}
+	w.checkpointLSN = lsn
+	w.lastLSN = lsn
+	return nil
+}
+
+// writeCheckpoint - через временный файл, чтобы при сбое не остался обрезанный номер
+func (w *WAL) writeCheckpoint(lsn uint64) error {
+	path := filepath.Join(w.dataDir, checkpointFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(lsn, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func (w *WAL) Rotate() error {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
@@ -207,8 +311,7 @@ func (w *WAL) openOrCreateSegment() error {
 		w.segmentIndex = 1
 	}
 
-	filename := filepath.Join(w.dataDir, fmt.Sprintf("segment_%04d.wal", w.segmentIndex))
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	file, err := os.OpenFile(w.segmentPath(w.segmentIndex), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
@@ -240,7 +343,7 @@ func (w *WAL) getSegments() ([]string, error) {
 
 	var segments []string
 	for _, file := range files {
-		if !file.IsDir() {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), "segment_") && strings.HasSuffix(file.Name(), ".wal") {
 			segments = append(segments, filepath.Join(w.dataDir, file.Name()))
 		}
 	}
@@ -251,3 +354,13 @@ func (w *WAL) getSegments() ([]string, error) {
 
 	return segments, nil
 }
+
+func (w *WAL) segmentPath(index int) string {
+	return filepath.Join(w.dataDir, fmt.Sprintf("segment_%04d.wal", index))
+}
+
+func segmentIndexOf(path string) int {
+	var index int
+	fmt.Sscanf(filepath.Base(path), "segment_%d.wal", &index)
+	return index
+}